@@ -2,11 +2,16 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
@@ -14,48 +19,322 @@ import (
 
 type App struct {
 	Router *mux.Router
-	DB     *sql.DB
+	DB     *sql.DB // the first tenant's, handlers use the request's tenant
+	Keys   *Keyring
+
+	// requests without an API key act as this tenant, 0 requires a key
+	DefaultTenant int
+
+	// takes deposits and settles folios
+	Gateway PaymentGateway
+
+	// guests are anonymised this many days after checkout, 0 disables it
+	RetentionDays int
+
+	connString string
+	tenantsMu  sync.Mutex
+	tenantDBs  map[int]*tenantPool
 }
 
 // sets up the database connection and routes for the app
 func (a *App) Initialize(user, password, dbname string) {
-	connectionString :=
-		fmt.Sprintf("user=%s password=%s dbname=%s", user, password, dbname)
+	a.connString = fmt.Sprintf("user=%s password=%s dbname=%s", user, password, dbname)
 
 	var err error
-	a.DB, err = sql.Open("postgres", connectionString)
+	a.DB, err = openTenantDB(a.connString, FirstTenantID)
 	if err != nil {
 		log.Fatal(err)
 	}
+	a.tenantDBs = map[int]*tenantPool{FirstTenantID: {db: a.DB}}
 
 	a.Router = mux.NewRouter()
+	a.Router.Use(a.authenticate)
 	a.initializeRoutes()
 }
 
 // Run starts the app and serves on the specified addr
 func (a *App) Run(addr string) {
+	if a.RetentionDays > 0 {
+		go a.every(time.Hour, "guests anonymised", func(db *sql.DB) (int, error) {
+			return AnonymiseExpiredGuests(db, a.Keys, a.RetentionDays)
+		})
+	}
+	go a.every(15*time.Minute, "no-shows marked", func(db *sql.DB) (int, error) {
+		return MarkNoShows(db, a.Gateway, time.Now().UTC())
+	})
+	go a.every(15*time.Minute, "penalties settled", func(db *sql.DB) (int, error) {
+		return SettlePenalties(db, a.Gateway)
+	})
+	go a.every(time.Hour, "group blocks released", func(db *sql.DB) (int, error) {
+		return ReleaseGroups(db, today())
+	})
+	go a.every(time.Minute, "waitlist offers expired", ExpireWaitlistOffers)
+	go a.every(time.Minute, "holds expired", ExpireHolds)
 	log.Fatal(http.ListenAndServe(":8000", a.Router))
 
 }
 
 func (a *App) initializeRoutes() {
+	a.Router.HandleFunc("/properties", a.getProperties).Methods("GET")
+	a.Router.HandleFunc("/property", a.createProperty).Methods("POST")
+	a.Router.HandleFunc("/property/{id:[0-9]+}", a.getProperty).Methods("GET")
+	a.Router.HandleFunc("/property/{id:[0-9]+}", a.updateProperty).Methods("PUT")
+	a.Router.HandleFunc("/property/{id:[0-9]+}", a.deleteProperty).Methods("DELETE")
+	a.Router.HandleFunc("/properties/{pid:[0-9]+}/rooms", a.getRooms).Methods("GET")
+	a.Router.HandleFunc("/properties/{pid:[0-9]+}/rooms", a.createRoom).Methods("POST")
+	a.Router.HandleFunc("/properties/{pid:[0-9]+}/room_types", a.getRoomTypes).Methods("GET")
+	a.Router.HandleFunc("/properties/{pid:[0-9]+}/room_types", a.createRoomType).Methods("POST")
+
 	a.Router.HandleFunc("/rooms", a.getRooms).Methods("GET")
 	a.Router.HandleFunc("/room", a.createRoom).Methods("POST")
 	a.Router.HandleFunc("/room/{id:[0-9]+}", a.getRoom).Methods("GET")
 	a.Router.HandleFunc("/room/{id:[0-9]+}", a.updateRoom).Methods("PUT")
 	a.Router.HandleFunc("/room/{id:[0-9]+}", a.deleteRoom).Methods("DELETE")
+	a.Router.HandleFunc("/room/{id:[0-9]+}/housekeeping", a.setHousekeeping).Methods("PUT")
+	a.Router.HandleFunc("/room/{id:[0-9]+}/blocks", a.getRoomBlocks).Methods("GET")
+	a.Router.HandleFunc("/room/{id:[0-9]+}/blocks", a.createRoomBlock).Methods("POST")
+	a.Router.HandleFunc("/room/{id:[0-9]+}/blocks/{bid:[0-9]+}", a.deleteRoomBlock).Methods("DELETE")
+	a.Router.HandleFunc("/room/{id:[0-9]+}/tickets", a.getRoomTickets).Methods("GET")
+	a.Router.HandleFunc("/room/{id:[0-9]+}/tickets", a.createTicket).Methods("POST")
+
+	a.Router.HandleFunc("/tickets", a.getTickets).Methods("GET")
+	a.Router.HandleFunc("/ticket/{id:[0-9]+}", a.getTicket).Methods("GET")
+	a.Router.HandleFunc("/ticket/{id:[0-9]+}/assign", a.assignTicket).Methods("PUT")
+	a.Router.HandleFunc("/ticket/{id:[0-9]+}/resolve", a.resolveTicket).Methods("POST")
+
+	a.Router.HandleFunc("/housekeeping/board", a.getHousekeepingBoard).Methods("GET")
+	a.Router.HandleFunc("/housekeeping/assign", a.assignHousekeeper).Methods("POST")
+
+	a.Router.HandleFunc("/room_types", a.getRoomTypes).Methods("GET")
+	a.Router.HandleFunc("/room_type", a.createRoomType).Methods("POST")
+	a.Router.HandleFunc("/room_type/{id:[0-9]+}", a.getRoomType).Methods("GET")
+	a.Router.HandleFunc("/room_type/{id:[0-9]+}", a.updateRoomType).Methods("PUT")
+	a.Router.HandleFunc("/room_type/{id:[0-9]+}", a.deleteRoomType).Methods("DELETE")
+	a.Router.HandleFunc("/room_type/{id:[0-9]+}/overbooking", a.getOverbookingLimits).Methods("GET")
+	a.Router.HandleFunc("/room_type/{id:[0-9]+}/overbooking", a.createOverbookingLimit).Methods("POST")
+	a.Router.HandleFunc("/room_type/{id:[0-9]+}/overbooking/{oid:[0-9]+}", a.deleteOverbookingLimit).Methods("DELETE")
+	a.Router.HandleFunc("/availability", a.getAvailability).Methods("GET")
+	a.Router.HandleFunc("/reports/walk_list", a.getWalkList).Methods("GET")
+	a.Router.HandleFunc("/reports/occupancy", a.getOccupancyReport).Methods("GET")
+	a.Router.HandleFunc("/reports/arrivals", a.getMovementReport("arrivals", GetArrivals)).Methods("GET")
+	a.Router.HandleFunc("/reports/departures", a.getMovementReport("departures", GetDepartures)).Methods("GET")
+	a.Router.HandleFunc("/reports/in_house", a.getMovementReport("in_house", GetInHouse)).Methods("GET")
+	a.Router.HandleFunc("/reports/nationalities", a.getNationalityReport).Methods("GET")
+
+	a.Router.HandleFunc("/business_date", a.getBusinessDate).Methods("GET")
+	a.Router.HandleFunc("/night_audits", a.getNightAudits).Methods("GET")
+	a.Router.HandleFunc("/night_audit", a.runNightAudit).Methods("POST")
+
+	a.Router.HandleFunc("/import/rooms", a.importRooms).Methods("POST")
+	a.Router.HandleFunc("/import/guests", a.importGuests).Methods("POST")
+	a.Router.HandleFunc("/export/rooms", a.exportRooms).Methods("GET")
+	a.Router.HandleFunc("/properties/{pid:[0-9]+}/export/rooms", a.exportRooms).Methods("GET")
+	a.Router.HandleFunc("/export/guests", a.exportGuests).Methods("GET")
+
+	a.Router.HandleFunc("/rate_plans", a.getRatePlans).Methods("GET")
+	a.Router.HandleFunc("/rate_plan", a.createRatePlan).Methods("POST")
+	a.Router.HandleFunc("/rate_plan/{id:[0-9]+}", a.getRatePlan).Methods("GET")
+	a.Router.HandleFunc("/rate_plan/{id:[0-9]+}", a.updateRatePlan).Methods("PUT")
+	a.Router.HandleFunc("/rate_plan/{id:[0-9]+}", a.deleteRatePlan).Methods("DELETE")
+	a.Router.HandleFunc("/quote", a.getQuote).Methods("GET")
+
+	a.Router.HandleFunc("/exchange_rates", a.getExchangeRates).Methods("GET")
+	a.Router.HandleFunc("/exchange_rate", a.createExchangeRate).Methods("POST")
+	a.Router.HandleFunc("/exchange_rates/import", a.importExchangeRates).Methods("POST")
+
+	a.Router.HandleFunc("/tax_rules", a.getTaxRules).Methods("GET")
+	a.Router.HandleFunc("/tax_rule", a.createTaxRule).Methods("POST")
+	a.Router.HandleFunc("/tax_rule/{id:[0-9]+}", a.getTaxRule).Methods("GET")
+	a.Router.HandleFunc("/tax_rule/{id:[0-9]+}", a.updateTaxRule).Methods("PUT")
+	a.Router.HandleFunc("/tax_rule/{id:[0-9]+}", a.deleteTaxRule).Methods("DELETE")
+
+	a.Router.HandleFunc("/reservations", a.getReservations).Methods("GET")
+	a.Router.HandleFunc("/reservation", a.createReservation).Methods("POST")
+	a.Router.HandleFunc("/reservation/{id:[0-9]+}", a.getReservation).Methods("GET")
+	a.Router.HandleFunc("/reservation/{id:[0-9]+}/checkin", a.checkInReservation).Methods("POST")
+	a.Router.HandleFunc("/reservation/{id:[0-9]+}/cancel", a.cancelReservation).Methods("POST")
+
+	a.Router.HandleFunc("/holds", a.getHolds).Methods("GET")
+	a.Router.HandleFunc("/holds", a.createHold).Methods("POST")
+	a.Router.HandleFunc("/hold/{id:[0-9]+}", a.getHold).Methods("GET")
+	a.Router.HandleFunc("/hold/{id:[0-9]+}", a.releaseHold).Methods("DELETE")
+
+	a.Router.HandleFunc("/waitlist", a.getWaitlist).Methods("GET")
+	a.Router.HandleFunc("/waitlist", a.createWaitlistEntry).Methods("POST")
+	a.Router.HandleFunc("/waitlist/{id:[0-9]+}", a.getWaitlistEntry).Methods("GET")
+	a.Router.HandleFunc("/waitlist/{id:[0-9]+}", a.cancelWaitlistEntry).Methods("DELETE")
+	a.Router.HandleFunc("/waitlist/{id:[0-9]+}/accept", a.acceptWaitlistOffer).Methods("POST")
+
+	a.Router.HandleFunc("/groups", a.getGroups).Methods("GET")
+	a.Router.HandleFunc("/group", a.createGroup).Methods("POST")
+	a.Router.HandleFunc("/group/{id:[0-9]+}", a.getGroup).Methods("GET")
+	a.Router.HandleFunc("/group/{id:[0-9]+}/rooming_list", a.getRoomingList).Methods("GET")
+	a.Router.HandleFunc("/group/{id:[0-9]+}/rooming_list", a.addRoomingList).Methods("POST")
 
 	a.Router.HandleFunc("/guests", a.getGuests).Methods("GET")
+	a.Router.HandleFunc("/guests/duplicates", a.getDuplicateGuests).Methods("GET")
 	a.Router.HandleFunc("/guest", a.createGuest).Methods("POST")
 	a.Router.HandleFunc("/guest/{id:[0-9]+}", a.getGuest).Methods("GET")
 	a.Router.HandleFunc("/guest/{id:[0-9]+}", a.updateGuest).Methods("PUT")
 	a.Router.HandleFunc("/guest/{id:[0-9]+}", a.deleteGuest).Methods("DELETE")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/stays", a.checkInGuest).Methods("POST")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/documents", a.getDocuments).Methods("GET")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/documents", a.createDocument).Methods("POST")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/documents/{did:[0-9]+}", a.deleteDocument).Methods("DELETE")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/merge", a.mergeGuests).Methods("POST")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/checkout", a.checkoutGuest).Methods("POST")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/move", a.moveGuest).Methods("POST")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/folio", a.getFolio).Methods("GET")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/charges", a.postFolioLine(LineCharge)).Methods("POST")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/payments", a.postFolioLine(LinePayment)).Methods("POST")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/refunds", a.postFolioLine(LineRefund)).Methods("POST")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/invoice", a.getInvoice).Methods("GET")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/export", a.exportGuest).Methods("GET")
+	a.Router.HandleFunc("/guest/{id:[0-9]+}/erase", a.eraseGuest).Methods("POST")
+}
+
+// *** PROPERTIES ***//
+
+func (a *App) getProperties(w http.ResponseWriter, r *http.Request) {
+	properties, err := GetAllProperties(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, properties)
+}
+
+func (a *App) createProperty(w http.ResponseWriter, r *http.Request) {
+	var p Property
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := p.createProperty(a.db(r)); err != nil {
+		if _, invalid := err.(invalidError); invalid {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (a *App) getProperty(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid property ID")
+		return
+	}
+
+	p := Property{ID: id}
+	if err := p.getProperty(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Property not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) updateProperty(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid property ID")
+		return
+	}
+
+	var p Property
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	p.ID = id
+
+	if err := p.updateProperty(a.db(r)); err != nil {
+		if _, invalid := err.(invalidError); invalid {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) deleteProperty(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid property ID")
+		return
+	}
+
+	p := Property{ID: id}
+	if err := p.deleteProperty(a.db(r)); err != nil {
+		switch err {
+		case ErrPropertyInUse:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// pathProperty is the {pid} of the /properties/{pid}/... routes, 0 on the
+// routes without one. It answers 404 itself for unknown properties.
+func (a *App) pathProperty(w http.ResponseWriter, r *http.Request) (int, bool) {
+	pid, ok := mux.Vars(r)["pid"]
+	if !ok {
+		return 0, true
+	}
+	p := Property{}
+	p.ID, _ = strconv.Atoi(pid)
+	if err := p.getProperty(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Property not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return 0, false
+	}
+	return p.ID, true
 }
 
 // *** ROOMS ***//
 
 func (a *App) getRooms(w http.ResponseWriter, r *http.Request) {
-	rooms, err := GetAllRoomsWithGuests(a.DB)
+	propertyID, ok := a.pathProperty(w, r)
+	if !ok {
+		return
+	}
+
+	filter, err := ParseRoomFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rooms, err := GetAllRoomsWithGuests(a.db(r), a.Keys, propertyID, filter)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -65,6 +344,11 @@ func (a *App) getRooms(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) createRoom(w http.ResponseWriter, r *http.Request) {
+	propertyID, ok := a.pathProperty(w, r)
+	if !ok {
+		return
+	}
+
 	var room Room
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&room); err != nil {
@@ -73,8 +357,15 @@ func (a *App) createRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	if propertyID != 0 {
+		room.PropertyID = propertyID
+	}
 
-	if err := room.createRoom(a.DB); err != nil {
+	if err := room.createRoom(a.db(r)); err != nil {
+		if _, invalid := err.(invalidError); invalid {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -91,7 +382,11 @@ func (a *App) getRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	room := Room{ID: id}
-	if err := room.getRoom(a.DB); err != nil {
+	err = room.getRoom(a.db(r))
+	if err == nil {
+		err = room.getActiveIssues(a.db(r))
+	}
+	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			respondWithError(w, http.StatusNotFound, "Room not found")
@@ -121,8 +416,16 @@ func (a *App) updateRoom(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	room.ID = id
 
-	if err := room.updateRoom(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := room.updateRoom(a.db(r)); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
@@ -138,7 +441,7 @@ func (a *App) deleteRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	room := Room{ID: id}
-	if err := room.deleteRoom(a.DB); err != nil {
+	if err := room.deleteRoom(a.db(r)); err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -146,103 +449,2209 @@ func (a *App) deleteRoom(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
-// *** GUESTS ***//
+// *** HOUSEKEEPING ***//
 
-func (a *App) getGuests(w http.ResponseWriter, r *http.Request) {
-	guests, err := GetAllGuests(a.DB)
+func (a *App) setHousekeeping(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	var u HousekeepingUpdate
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&u); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	room := Room{ID: id}
+	if err := room.setHousekeeping(a.db(r), u.Status); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, room)
+}
+
+// GET /housekeeping/board takes optional status and housekeeper filters
+func (a *App) getHousekeepingBoard(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	board, err := GetHousekeepingBoard(a.db(r), q.Get("status"), q.Get("housekeeper"))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, guests)
+	respondWithJSON(w, http.StatusOK, board)
 }
 
-func (a *App) createGuest(w http.ResponseWriter, r *http.Request) {
-	var g Guest
+func (a *App) assignHousekeeper(w http.ResponseWriter, r *http.Request) {
+	var as HousekeepingAssignment
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&g); err != nil {
-		fmt.Println(err.Error())
+	if err := decoder.Decode(&as); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 	defer r.Body.Close()
 
-	if err := g.createGuest(a.DB); err != nil {
+	if err := AssignHousekeeper(a.db(r), as); err != nil {
+		switch err.(type) {
+		case invalidError:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// *** MAINTENANCE ***//
+
+// GET /room/{id}/blocks lists the blocks that have not ended
+func (a *App) getRoomBlocks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	blocks, err := GetRoomBlocks(a.db(r), id, today())
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, g)
+	respondWithJSON(w, http.StatusOK, blocks)
 }
 
-func (a *App) getGuest(w http.ResponseWriter, r *http.Request) {
+func (a *App) createRoomBlock(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		respondWithError(w, http.StatusBadRequest, "Invalid room ID")
 		return
 	}
 
-	g := Guest{ID: id}
-	if err := g.getGuest(a.DB); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Guest not found")
+	var b RoomBlock
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&b); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	b.RoomID = id
+
+	room := Room{ID: id}
+	err = room.getRoom(a.db(r))
+	if err == nil {
+		err = b.createRoomBlock(a.db(r))
+	}
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room not found")
 		default:
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 		}
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, g)
+	respondWithJSON(w, http.StatusCreated, b)
 }
 
-func (a *App) updateGuest(w http.ResponseWriter, r *http.Request) {
+func (a *App) deleteRoomBlock(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		respondWithError(w, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	blockID, err := strconv.Atoi(vars["bid"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid block ID")
 		return
 	}
 
-	var g Guest
+	b := RoomBlock{ID: blockID, RoomID: id}
+	if err := b.deleteRoomBlock(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getRoomTickets(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	tickets, err := GetTickets(a.db(r), id, r.URL.Query().Get("status"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tickets)
+}
+
+func (a *App) createTicket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	var t MaintenanceTicket
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&g); err != nil {
+	if err := decoder.Decode(&t); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 	defer r.Body.Close()
-	g.ID = id
+	t.RoomID = id
+
+	room := Room{ID: id}
+	err = room.getRoom(a.db(r))
+	if err == nil {
+		err = t.createTicket(a.db(r))
+	}
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, t)
+}
 
-	if err := g.updateGuest(a.DB); err != nil {
+// GET /tickets lists the tickets of all rooms, ?status= filters
+func (a *App) getTickets(w http.ResponseWriter, r *http.Request) {
+	tickets, err := GetTickets(a.db(r), 0, r.URL.Query().Get("status"))
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, g)
+	respondWithJSON(w, http.StatusOK, tickets)
 }
 
-func (a *App) deleteGuest(w http.ResponseWriter, r *http.Request) {
+func (a *App) getTicket(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		respondWithError(w, http.StatusBadRequest, "Invalid ticket ID")
 		return
 	}
 
-	g := Guest{ID: id}
-	if err := g.deleteGuest(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	t := MaintenanceTicket{ID: id}
+	if err := t.getTicket(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Ticket not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	respondWithJSON(w, http.StatusOK, t)
 }
 
-// *** RESPONDS *** //
-func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+func (a *App) assignTicket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ticket ID")
+		return
+	}
+
+	var body struct {
+		AssignedTo string `json:"assigned_to"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	t := MaintenanceTicket{ID: id}
+	a.respondWithTicket(w, &t, t.assign(a.db(r), body.AssignedTo))
+}
+
+func (a *App) resolveTicket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ticket ID")
+		return
+	}
+
+	t := MaintenanceTicket{ID: id}
+	a.respondWithTicket(w, &t, t.resolve(a.db(r)))
+}
+
+// answers a ticket status change
+func (a *App) respondWithTicket(w http.ResponseWriter, t *MaintenanceTicket, err error) {
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusConflict, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Ticket not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+// *** ROOM TYPES ***//
+
+func (a *App) getRoomTypes(w http.ResponseWriter, r *http.Request) {
+	propertyID, ok := a.pathProperty(w, r)
+	if !ok {
+		return
+	}
+
+	types, err := GetAllRoomTypes(a.db(r), propertyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, types)
+}
+
+func (a *App) createRoomType(w http.ResponseWriter, r *http.Request) {
+	propertyID, ok := a.pathProperty(w, r)
+	if !ok {
+		return
+	}
+
+	var t RoomType
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	if propertyID != 0 {
+		t.PropertyID = propertyID
+	}
+
+	if err := t.createRoomType(a.db(r)); err != nil {
+		if _, invalid := err.(invalidError); invalid {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, t)
+}
+
+func (a *App) getRoomType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+		return
+	}
+
+	t := RoomType{ID: id}
+	if err := t.getRoomType(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room type not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+func (a *App) updateRoomType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+		return
+	}
+
+	var t RoomType
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	t.ID = id
+
+	if err := t.updateRoomType(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room type not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+func (a *App) deleteRoomType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+		return
+	}
+
+	t := RoomType{ID: id}
+	if err := t.deleteRoomType(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getAvailability(w http.ResponseWriter, r *http.Request) {
+	var err error
+	typeID := 0
+	if v := r.URL.Query().Get("room_type"); v != "" {
+		if typeID, err = strconv.Atoi(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+			return
+		}
+	}
+
+	// with from and to the nights in between are counted, else right now
+	var availability []Availability
+	if q := r.URL.Query(); q.Get("from") != "" || q.Get("to") != "" {
+		from, err := ParseDate(q.Get("from"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		to, err := ParseDate(q.Get("to"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		availability, err = GetAvailabilityForDates(a.db(r), typeID, from, to)
+	} else {
+		availability, err = GetAvailability(a.db(r), typeID)
+	}
+	if err != nil {
+		switch err.(type) {
+		case invalidError:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, availability)
+}
+
+func (a *App) getOverbookingLimits(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+		return
+	}
+
+	limits, err := GetOverbookingLimits(a.db(r), id, today())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, limits)
+}
+
+func (a *App) createOverbookingLimit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+		return
+	}
+
+	var l OverbookingLimit
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&l); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	l.RoomTypeID = id
+
+	if err := l.createOverbookingLimit(a.db(r)); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room type not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, l)
+}
+
+func (a *App) deleteOverbookingLimit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+		return
+	}
+	limitID, err := strconv.Atoi(vars["oid"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid overbooking limit ID")
+		return
+	}
+
+	l := OverbookingLimit{ID: limitID, RoomTypeID: id}
+	if err := l.deleteOverbookingLimit(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// GET /reports/walk_list?date= lists the room types booked beyond their
+// rooms that night, today by default, and the arrivals to walk
+func (a *App) getWalkList(w http.ResponseWriter, r *http.Request) {
+	date := today()
+	if v := r.URL.Query().Get("date"); v != "" {
+		var err error
+		if date, err = ParseDate(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	lists, err := GetWalkList(a.db(r), date)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, lists)
+}
+
+// reports take ?format=csv or Accept: text/csv, JSON otherwise
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv" || r.Header.Get("Accept") == "text/csv"
+}
+
+// parseReportRange reads the from and to dates of a report, the last 30
+// nights up to tonight by default
+func parseReportRange(r *http.Request) (Date, Date, error) {
+	to := today().AddDays(1)
+	from := to.AddDays(-30)
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = ParseDate(v); err != nil {
+			return from, to, err
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = ParseDate(v); err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
+
+// GET /reports/occupancy?from=&to= counts occupancy, ADR and RevPAR for
+// every night of the range
+func (a *App) getOccupancyReport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseReportRange(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report, err := GetOccupancyReport(a.db(r), from, to)
+	if err != nil {
+		switch err.(type) {
+		case invalidError:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if wantsCSV(r) {
+		respondWithCSV(w, fmt.Sprintf("occupancy-%s-%s.csv", from, to), report.csvRecords())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// getMovementReport serves GET /reports/{name}?date= for one of the guest
+// lists of a date, today by default
+func (a *App) getMovementReport(name string, list func(*sql.DB, Date) ([]GuestMovement, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		date := today()
+		if v := r.URL.Query().Get("date"); v != "" {
+			var err error
+			if date, err = ParseDate(v); err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		movements, err := list(a.db(r), date)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if wantsCSV(r) {
+			respondWithCSV(w, fmt.Sprintf("%s-%s.csv", name, date), movementCSVRecords(movements))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, movements)
+	}
+}
+
+// GET /reports/nationalities?from=&to= counts the guests and nights by
+// nationality
+func (a *App) getNationalityReport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseReportRange(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stats, err := GetNationalityStats(a.db(r), from, to)
+	if err != nil {
+		switch err.(type) {
+		case invalidError:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if wantsCSV(r) {
+		respondWithCSV(w, fmt.Sprintf("nationalities-%s-%s.csv", from, to), nationalityCSVRecords(stats))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, stats)
+}
+
+// *** NIGHT AUDIT ***//
+
+func (a *App) getBusinessDate(w http.ResponseWriter, r *http.Request) {
+	date, err := BusinessDate(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]Date{"business_date": date})
+}
+
+// GET /night_audits?from=&to= lists the audits of the range, the last 30
+// days by default
+func (a *App) getNightAudits(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseReportRange(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	audits, err := GetNightAudits(a.db(r), from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, audits)
+}
+
+// POST /night_audit closes the business date, or finishes its interrupted
+// audit. The body is optional and names the date to close.
+func (a *App) runNightAudit(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		BusinessDate Date `json:"business_date"`
+	}
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&body); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		defer r.Body.Close()
+	}
+
+	audit, err := RunNightAudit(a.db(r), a.Gateway, body.BusinessDate)
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == ErrAuditDone, err == ErrAuditRunning:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, audit)
+}
+
+// *** IMPORT ***//
+
+// largest file an import accepts
+const maxImportBytes = 10 << 20
+
+// POST /import/rooms takes a CSV or XLSX sheet of rooms, ?dry_run=true only
+// validates it
+func (a *App) importRooms(w http.ResponseWriter, r *http.Request) {
+	records, ok := readImport(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := ImportRooms(a.db(r), records, r.URL.Query().Get("dry_run") == "true")
+	respondWithImport(w, result, err)
+}
+
+// POST /import/guests takes a CSV or XLSX sheet of guest profiles,
+// ?dry_run=true only validates it
+func (a *App) importGuests(w http.ResponseWriter, r *http.Request) {
+	records, ok := readImport(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := ImportGuests(a.db(r), a.Keys, records, r.URL.Query().Get("dry_run") == "true")
+	respondWithImport(w, result, err)
+}
+
+func readImport(w http.ResponseWriter, r *http.Request) ([][]string, bool) {
+	defer r.Body.Close()
+
+	records, err := readSheet(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		_, invalid := err.(invalidError)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case errors.As(err, &tooLarge):
+			respondWithError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("The file is larger than %d MB", maxImportBytes>>20))
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return nil, false
+	}
+	return records, true
+}
+
+// *** EXPORT ***//
+
+var exportContentTypes = map[string]string{
+	ExportCSV:    "text/csv",
+	ExportNDJSON: "application/x-ndjson",
+	ExportXLSX:   xlsxContentType,
+}
+
+// GET /export/rooms streams the rooms GET /rooms lists, as CSV by default,
+// or ?format=ndjson or xlsx
+func (a *App) exportRooms(w http.ResponseWriter, r *http.Request) {
+	propertyID, ok := a.pathProperty(w, r)
+	if !ok {
+		return
+	}
+
+	filter, err := ParseRoomFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	a.stream(w, r, "rooms", roomExportColumns, func(open func() (*exportWriter, error)) error {
+		return ExportRooms(a.db(r), propertyID, filter, open)
+	})
+}
+
+// GET /export/guests streams the profiles GET /guests lists, without
+// passports
+func (a *App) exportGuests(w http.ResponseWriter, r *http.Request) {
+	search := parseGuestSearch(r)
+
+	a.stream(w, r, "guests", guestExportColumns, func(open func() (*exportWriter, error)) error {
+		return ExportGuests(a.db(r), search, open)
+	})
+}
+
+// stream runs an export. Errors before the first byte are reported as
+// usual; later ones abort the response so the client sees it incomplete.
+func (a *App) stream(w http.ResponseWriter, r *http.Request, name string, columns []string,
+	export func(open func() (*exportWriter, error)) error) {
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportCSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Unknown format '%s', expected csv, ndjson or xlsx", format))
+		return
+	}
+
+	started := false
+	err := export(func() (*exportWriter, error) {
+		started = true
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", name, format))
+		w.WriteHeader(http.StatusOK)
+		return newExportWriter(w, format, columns)
+	})
+	if err != nil {
+		if started {
+			log.Printf("export %s: %v", name, err)
+			panic(http.ErrAbortHandler)
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// an import with invalid rows is a bad request unless it was a dry run
+func respondWithImport(w http.ResponseWriter, result *ImportResult, err error) {
+	if err != nil {
+		switch err.(type) {
+		case invalidError:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if len(result.Errors) > 0 && !result.DryRun {
+		respondWithJSON(w, http.StatusBadRequest, result)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+// *** RATES ***//
+
+func (a *App) getRatePlans(w http.ResponseWriter, r *http.Request) {
+	typeID := 0
+	if v := r.URL.Query().Get("room_type"); v != "" {
+		var err error
+		if typeID, err = strconv.Atoi(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+			return
+		}
+	}
+
+	plans, err := GetAllRatePlans(a.db(r), typeID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, plans)
+}
+
+func (a *App) createRatePlan(w http.ResponseWriter, r *http.Request) {
+	var p RatePlan
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := p.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := p.createRatePlan(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (a *App) getRatePlan(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid rate plan ID")
+		return
+	}
+
+	p := RatePlan{ID: id}
+	if err := p.getRatePlan(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Rate plan not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) updateRatePlan(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid rate plan ID")
+		return
+	}
+
+	var p RatePlan
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	p.ID = id
+
+	if err := p.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := p.updateRatePlan(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) deleteRatePlan(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid rate plan ID")
+		return
+	}
+
+	p := RatePlan{ID: id}
+	if err := p.deleteRatePlan(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// GET /quote?room_type=1&from=2026-07-01&to=2026-07-04&guests=2[&rate_plan=3][&ages=40,7][&currency=USD]
+func (a *App) getQuote(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	typeID, err := strconv.Atoi(q.Get("room_type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+		return
+	}
+	planID := 0
+	if v := q.Get("rate_plan"); v != "" {
+		if planID, err = strconv.Atoi(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid rate plan ID")
+			return
+		}
+	}
+	guests := 1
+	if v := q.Get("guests"); v != "" {
+		if guests, err = strconv.Atoi(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid number of guests")
+			return
+		}
+	}
+	// ages are optional and only used for tax exemptions
+	ages := []int{}
+	if v := q.Get("ages"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			age, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid ages")
+				return
+			}
+			ages = append(ages, age)
+		}
+	}
+	for len(ages) < guests {
+		ages = append(ages, -1)
+	}
+	if len(ages) > guests {
+		respondWithError(w, http.StatusBadRequest, "More ages than guests")
+		return
+	}
+	from, err := ParseDate(q.Get("from"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := ParseDate(q.Get("to"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	currency := ""
+	if v := q.Get("currency"); v != "" {
+		if currency, err = normaliseCurrency(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	quote, err := GetQuote(a.db(r), typeID, planID, from, to, ages, currency)
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room type or rate plan not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, quote)
+}
+
+// *** CURRENCIES ***//
+
+func (a *App) getExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := GetAllExchangeRates(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, rates)
+}
+
+func (a *App) createExchangeRate(w http.ResponseWriter, r *http.Request) {
+	var rate ExchangeRate
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&rate); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := rate.createExchangeRate(a.db(r)); err != nil {
+		switch err.(type) {
+		case invalidError:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, rate)
+}
+
+// POST /exchange_rates/import takes a CSV body of currency,effective_date,rate
+func (a *App) importExchangeRates(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	n, err := ImportExchangeRates(a.db(r), r.Body)
+	if err != nil {
+		switch err.(type) {
+		case invalidError:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]int{"imported": n})
+}
+
+// *** TAXES ***//
+
+func (a *App) getTaxRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := GetAllTaxRules(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, rules)
+}
+
+func (a *App) createTaxRule(w http.ResponseWriter, r *http.Request) {
+	var t TaxRule
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := t.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := t.createTaxRule(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, t)
+}
+
+func (a *App) getTaxRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tax rule ID")
+		return
+	}
+
+	t := TaxRule{ID: id}
+	if err := t.getTaxRule(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Tax rule not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+func (a *App) updateTaxRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tax rule ID")
+		return
+	}
+
+	var t TaxRule
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	t.ID = id
+
+	if err := t.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := t.updateTaxRule(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+func (a *App) deleteTaxRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tax rule ID")
+		return
+	}
+
+	t := TaxRule{ID: id}
+	if err := t.deleteTaxRule(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// *** RESERVATIONS ***//
+
+func (a *App) getReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := GetAllReservations(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, reservations)
+}
+
+// POST /reservation books a room type and captures the deposit with the
+// payment_token issued by the gateway. With a hold_id it books the held
+// room.
+func (a *App) createReservation(w http.ResponseWriter, r *http.Request) {
+	var res Reservation
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&res); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := res.createReservation(a.db(r), a.Gateway); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Room type or rate plan not found")
+		case err == ErrNoAvailability, err == ErrHoldExpired:
+			respondWithError(w, http.StatusConflict, err.Error())
+		case err == ErrPaymentDeclined:
+			respondWithError(w, http.StatusPaymentRequired, err.Error())
+		case err == ErrGatewayTimeout:
+			respondWithError(w, http.StatusGatewayTimeout, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	res.PaymentToken = ""
+
+	respondWithJSON(w, http.StatusCreated, res)
+}
+
+func (a *App) getReservation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid reservation ID")
+		return
+	}
+
+	res := Reservation{ID: id}
+	if err := res.getReservation(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Reservation not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// POST /reservation/{id}/checkin takes the guest's details, like
+// POST /guest, and returns the new guest
+func (a *App) checkInReservation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid reservation ID")
+		return
+	}
+
+	var g Guest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&g); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	res := Reservation{ID: id}
+	if err := res.checkIn(a.db(r), a.Keys, &g); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Reservation not found")
+		case err == ErrReservationStatus, err == ErrGuestStaying:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, g)
+}
+
+// POST /reservation/{id}/cancel returns the cancelled reservation with
+// the penalty kept under its rate plan's policy
+func (a *App) cancelReservation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid reservation ID")
+		return
+	}
+
+	res := Reservation{ID: id}
+	if err := res.cancel(a.db(r), a.Gateway, time.Now().UTC()); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Reservation not found")
+		case ErrReservationStatus:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// *** HOLDS ***//
+
+func (a *App) getHolds(w http.ResponseWriter, r *http.Request) {
+	holds, err := GetActiveHolds(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, holds)
+}
+
+// POST /holds keeps a room of the type for the dates for ttl_seconds,
+// while the guest checks out
+func (a *App) createHold(w http.ResponseWriter, r *http.Request) {
+	var h Hold
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&h); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := h.createHold(a.db(r)); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == ErrNoAvailability:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, h)
+}
+
+func (a *App) getHold(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid hold ID")
+		return
+	}
+
+	h := Hold{ID: id}
+	if err := h.getHold(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Hold not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, h)
+}
+
+func (a *App) releaseHold(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid hold ID")
+		return
+	}
+
+	h := Hold{ID: id}
+	if err := h.releaseHold(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Hold not found or no longer active")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, h)
+}
+
+// *** WAITLIST ***//
+
+// GET /waitlist, optionally filtered by ?room_type_id= and ?status=
+func (a *App) getWaitlist(w http.ResponseWriter, r *http.Request) {
+	var typeID int
+	if v := r.URL.Query().Get("room_type_id"); v != "" {
+		var err error
+		if typeID, err = strconv.Atoi(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid room type ID")
+			return
+		}
+	}
+
+	entries, err := GetWaitlist(a.db(r), typeID, r.URL.Query().Get("status"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+// POST /waitlist queues a request for dates the room type is sold out on
+func (a *App) createWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	var e WaitlistEntry
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&e); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := e.createWaitlistEntry(a.db(r)); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == ErrRoomsAvailable:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, e)
+}
+
+func (a *App) getWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid waitlist entry ID")
+		return
+	}
+
+	e := WaitlistEntry{ID: id}
+	if err := e.getWaitlistEntry(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Waitlist entry not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, e)
+}
+
+func (a *App) cancelWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid waitlist entry ID")
+		return
+	}
+
+	e := WaitlistEntry{ID: id}
+	if err := e.cancelWaitlistEntry(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Waitlist entry not found or closed")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, e)
+}
+
+// POST /waitlist/{id}/accept books the offered room with the
+// payment_token for the deposit and returns the reservation
+func (a *App) acceptWaitlistOffer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid waitlist entry ID")
+		return
+	}
+
+	var body struct {
+		PaymentToken string `json:"payment_token"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	e := WaitlistEntry{ID: id}
+	res, err := e.acceptOffer(a.db(r), a.Gateway, body.PaymentToken)
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Waitlist entry not found")
+		case err == ErrOfferExpired, err == ErrNoAvailability:
+			respondWithError(w, http.StatusConflict, err.Error())
+		case err == ErrPaymentDeclined:
+			respondWithError(w, http.StatusPaymentRequired, err.Error())
+		case err == ErrGatewayTimeout:
+			respondWithError(w, http.StatusGatewayTimeout, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, res)
+}
+
+// *** GROUPS ***//
+
+func (a *App) getGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := GetAllGroups(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, groups)
+}
+
+// POST /group takes the blocks' rooms from availability until the
+// release date
+func (a *App) createGroup(w http.ResponseWriter, r *http.Request) {
+	var g Group
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&g); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := g.createGroup(a.db(r)); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == ErrNoAvailability:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, g)
+}
+
+func (a *App) getGroup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	g := Group{ID: id}
+	if err := g.getGroup(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Group not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, g)
+}
+
+func (a *App) getRoomingList(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	g := Group{ID: id}
+	reservations, err := g.getRoomingList(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, reservations)
+}
+
+// POST /group/{id}/rooming_list books the named guests into the block and
+// returns their reservations
+func (a *App) addRoomingList(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	var entries []RoomingListEntry
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&entries); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	g := Group{ID: id}
+	reservations, err := g.addRoomingList(a.db(r), entries)
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Group not found")
+		case err == ErrNoAvailability, err == ErrGroupReleased:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, reservations)
+}
+
+// *** GUESTS ***//
+
+func parseGuestSearch(r *http.Request) GuestSearch {
+	q := r.URL.Query()
+	return GuestSearch{
+		Name:        q.Get("name"),
+		Email:       q.Get("email"),
+		Phone:       q.Get("phone"),
+		Nationality: q.Get("nationality"),
+		InHouse:     q.Get("in_house") == "true",
+	}
+}
+
+func (a *App) getGuests(w http.ResponseWriter, r *http.Request) {
+	if passport := r.URL.Query().Get("passport"); passport != "" {
+		a.getGuestByPassport(w, r, passport)
+		return
+	}
+
+	guests, err := SearchGuests(a.db(r), a.Keys, parseGuestSearch(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, guests)
+}
+
+func (a *App) getGuestByPassport(w http.ResponseWriter, r *http.Request, passport string) {
+	g := Guest{Passport: passport}
+	if err := g.getGuestByPassport(a.db(r), a.Keys); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, []Guest{g})
+}
+
+func (a *App) createGuest(w http.ResponseWriter, r *http.Request) {
+	var g Guest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&g); err != nil {
+		fmt.Println(err.Error())
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := g.createGuest(a.db(r), a.Keys); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == ErrGuestStaying:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, g)
+}
+
+func (a *App) getGuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	g := Guest{ID: id}
+	err = g.getGuest(a.db(r), a.Keys)
+	if err == nil {
+		g.Documents, err = g.getDocuments(a.db(r), a.Keys)
+	}
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, g)
+}
+
+func (a *App) updateGuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	var g Guest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&g); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	g.ID = id
+
+	if err := g.updateGuest(a.db(r), a.Keys); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, g)
+}
+
+func (a *App) deleteGuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	g := Guest{ID: id}
+	if err := g.deleteGuest(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) checkoutGuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	// the body is optional, it carries a payment token or a manager override
+	var body CheckoutRequest
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&body); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		defer r.Body.Close()
+	}
+
+	g := Guest{ID: id}
+	if err := g.checkout(a.db(r), a.Gateway, body); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest has no open stay")
+		case ErrBalanceDue:
+			respondWithError(w, http.StatusConflict, err.Error())
+		case ErrPaymentDeclined:
+			respondWithError(w, http.StatusPaymentRequired, err.Error())
+		case ErrGatewayTimeout:
+			respondWithError(w, http.StatusGatewayTimeout, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// POST /guest/{id}/stays checks an existing profile into room_id, or a
+// free room of room_type_id, and returns the new stay
+func (a *App) checkInGuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	var room Guest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&room); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	g := Guest{ID: id}
+	stay, err := g.checkInProfile(a.db(r), a.Keys, room)
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest not found")
+		case err == ErrGuestStaying:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, stay)
+}
+
+func (a *App) getDocuments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	g := Guest{ID: id}
+	docs, err := g.getDocuments(a.db(r), a.Keys)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, docs)
+}
+
+func (a *App) createDocument(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	var d Document
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&d); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	d.GuestID = id
+
+	if err := d.createDocument(a.db(r), a.Keys); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, d)
+}
+
+func (a *App) deleteDocument(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+	did, err := strconv.Atoi(vars["did"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid document ID")
+		return
+	}
+
+	d := Document{ID: did, GuestID: id}
+	if err := d.deleteDocument(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// GET /guests/duplicates lists pairs of profiles that look like the same
+// person, for review before a merge
+func (a *App) getDuplicateGuests(w http.ResponseWriter, r *http.Request) {
+	dups, err := FindDuplicateGuests(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, dups)
+}
+
+// POST /guest/{id}/merge merges the profiles in guest_ids into the guest
+// and returns it
+func (a *App) mergeGuests(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	var req MergeRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	g := Guest{ID: id}
+	if err := g.merge(a.db(r), a.Keys, req.GuestIDs); err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest not found")
+		case err == ErrGuestStaying:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, g)
+}
+
+// POST /guest/{id}/move returns the new stay
+func (a *App) moveGuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	var req MoveRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	g := Guest{ID: id}
+	stay, err := g.move(a.db(r), req)
+	if err != nil {
+		_, invalid := err.(invalidError)
+		switch {
+		case invalid:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest has no open stay")
+		case err == ErrRoomOccupied, err == ErrNoAvailability:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, stay)
+}
+
+// *** FOLIOS ***//
+
+func (a *App) getFolio(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	g := Guest{ID: id}
+	f, err := g.getFolio(a.db(r))
+	if err == nil {
+		err = f.getFolioLines(a.db(r))
+	}
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest has no stay")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, f)
+}
+
+// postFolioLine returns the handler posting one kind of line to the
+// folio of the guest's latest stay
+func (a *App) postFolioLine(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+			return
+		}
+
+		var p Posting
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&p); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		defer r.Body.Close()
+
+		g := Guest{ID: id}
+		f, err := g.getFolio(a.db(r))
+		if err == nil {
+			err = f.post(a.db(r), kind, p)
+		}
+		if err == nil {
+			err = f.getFolioLines(a.db(r))
+		}
+		if err != nil {
+			_, invalid := err.(invalidError)
+			switch {
+			case invalid:
+				respondWithError(w, http.StatusBadRequest, err.Error())
+			case err == sql.ErrNoRows:
+				respondWithError(w, http.StatusNotFound, "Guest has no stay")
+			case err == ErrFolioClosed:
+				respondWithError(w, http.StatusConflict, err.Error())
+			default:
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		respondWithJSON(w, http.StatusCreated, f)
+	}
+}
+
+// GET /guest/{id}/invoice returns JSON, or a PDF with ?format=pdf
+// or Accept: application/pdf
+func (a *App) getInvoice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	g := Guest{ID: id}
+	inv, err := g.getInvoice(a.db(r))
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest has no stay")
+		case ErrFolioOpen:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if r.URL.Query().Get("format") == "pdf" || r.Header.Get("Accept") == "application/pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=invoice-%d.pdf", inv.Number))
+		w.WriteHeader(http.StatusOK)
+		w.Write(inv.PDF())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, inv)
+}
+
+// *** PRIVACY ***//
+
+func (a *App) exportGuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	g := Guest{ID: id}
+	export, err := g.exportGuest(a.db(r), a.Keys)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, export)
+}
+
+func (a *App) eraseGuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid guest ID")
+		return
+	}
+
+	g := Guest{ID: id}
+	if err := g.eraseGuest(a.db(r), a.Keys); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Guest not found or already erased")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, g)
+}
+
+// *** RESPONDS *** //
+func respondWithError(w http.ResponseWriter, code int, message string) {
+	respondWithJSON(w, code, map[string]string{"error": message})
+}
+
+func respondWithCSV(w http.ResponseWriter, filename string, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	w.WriteHeader(http.StatusOK)
+	csv.NewWriter(w).WriteAll(records)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
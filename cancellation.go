@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// reservation statuses set by cancellation
+const (
+	ReservationCancelled = "cancelled"
+	ReservationNoShow    = "no_show"
+)
+
+// CancellationPolicy of a rate plan. Late cancellations and no-shows pay
+// the same penalty.
+type CancellationPolicy struct {
+	// cancelling at least this many hours before the arrival day starts is free
+	FreeUntilHours int `json:"free_until_hours"`
+
+	// the penalty is the first nights of the stay, or a percentage of
+	// the total when PenaltyPercent is set
+	PenaltyNights  int   `json:"penalty_nights"`
+	PenaltyPercent int64 `json:"penalty_percent,omitempty"`
+
+	// reservations not checked in this many hours after the arrival day
+	// started are no-shows
+	NoShowAfterHours int `json:"no_show_after_hours"`
+}
+
+// applies to plans without a policy: free until arrival, then the first
+// night, no-show at the end of the arrival day
+var defaultCancellationPolicy = CancellationPolicy{PenaltyNights: 1, NoShowAfterHours: 24}
+
+func (c *CancellationPolicy) Validate() error {
+	if c.FreeUntilHours < 0 || c.PenaltyNights < 0 || c.NoShowAfterHours < 0 {
+		return invalidf("Cancellation policy values must not be negative")
+	}
+	if c.PenaltyPercent < 0 || c.PenaltyPercent > 100 {
+		return invalidf("Penalty percent must be between 0 and 100")
+	}
+	if c.NoShowAfterHours == 0 {
+		c.NoShowAfterHours = defaultCancellationPolicy.NoShowAfterHours
+	}
+	return nil
+}
+
+func (c *CancellationPolicy) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return json.Marshal(c)
+}
+
+// scans a nullable JSONB column into a *CancellationPolicy
+type policyScanner struct {
+	dest **CancellationPolicy
+}
+
+func (s policyScanner) Scan(src interface{}) error {
+	if src == nil {
+		*s.dest = nil
+		return nil
+	}
+	c := &CancellationPolicy{}
+	if err := scanJSON(src, c); err != nil {
+		return err
+	}
+	*s.dest = c
+	return nil
+}
+
+func (p *RatePlan) cancellationPolicy() CancellationPolicy {
+	if p.Cancellation == nil {
+		return defaultCancellationPolicy
+	}
+	return *p.Cancellation
+}
+
+// isFree tells if cancelling at now costs nothing
+func (c CancellationPolicy) isFree(arrival Date, now time.Time) bool {
+	deadline := arrival.Add(-time.Duration(c.FreeUntilHours) * time.Hour)
+	return now.Before(deadline)
+}
+
+func (c CancellationPolicy) noShowCutoff(arrival Date) time.Time {
+	return arrival.Add(time.Duration(c.NoShowAfterHours) * time.Hour)
+}
+
+// penalty of a reservation priced by q, never more than total
+func (c CancellationPolicy) penalty(q *Quote, total int64) int64 {
+	var penalty int64
+	if c.PenaltyPercent > 0 {
+		penalty = percentOf(total, c.PenaltyPercent)
+	} else {
+		for i, n := range q.Nights {
+			if i >= c.PenaltyNights {
+				break
+			}
+			penalty += n.Amount
+		}
+	}
+	if penalty > total {
+		penalty = total
+	}
+	return penalty
+}
+
+// cancel cancels a confirmed reservation, free or with the penalty of
+// its rate plan's policy depending on how close to arrival it is
+func (r *Reservation) cancel(db *sql.DB, gw PaymentGateway, now time.Time) error {
+	if err := r.getReservation(db); err != nil {
+		return err
+	}
+	if r.Status != ReservationConfirmed {
+		return ErrReservationStatus
+	}
+
+	plan, err := ratePlanForType(db, r.RoomTypeID, r.RatePlanID)
+	if err != nil {
+		return err
+	}
+	policy := plan.cancellationPolicy()
+
+	var penalty int64
+	if !policy.isFree(r.Arrival, now) {
+		if penalty, err = r.penalty(plan, policy); err != nil {
+			return err
+		}
+	}
+	return r.close(db, gw, ReservationCancelled, penalty)
+}
+
+// noShow marks a confirmed reservation whose guest never arrived and
+// charges the penalty
+func (r *Reservation) noShow(db *sql.DB, gw PaymentGateway) error {
+	plan, err := ratePlanForType(db, r.RoomTypeID, r.RatePlanID)
+	if err != nil {
+		return err
+	}
+	penalty, err := r.penalty(plan, plan.cancellationPolicy())
+	if err != nil {
+		return err
+	}
+	return r.close(db, gw, ReservationNoShow, penalty)
+}
+
+func (r *Reservation) penalty(plan *RatePlan, policy CancellationPolicy) (int64, error) {
+	q, err := plan.Price(r.Arrival, r.Departure, r.Guests)
+	if err != nil {
+		return 0, err
+	}
+	return policy.penalty(q, r.Total), nil
+}
+
+// close moves the reservation from confirmed to status, which releases its
+// nights to the waitlist, then settles the penalty with the deposit. The
+// settlement is marked pending with the status change, so when the gateway
+// fails the reservation is still closed and SettlePenalties retries it.
+func (r *Reservation) close(db *sql.DB, gw PaymentGateway, status string, penalty int64) error {
+	res, err := db.Exec(
+		`UPDATE reservations SET status=$1, penalty=$2, penalty_due=GREATEST($2 - deposit, 0),
+		settlement_pending=true, closed_at=now() WHERE id=$3 AND status=$4`,
+		status, penalty, r.ID, ReservationConfirmed)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrReservationStatus
+	}
+	if err := r.getReservation(db); err != nil {
+		return err
+	}
+
+	if err := r.settlePenalty(db, gw); err != nil {
+		log.Printf("reservation %d: penalty not settled, retrying later: %v", r.ID, err)
+	}
+	offerFreedRoom(db, r.RoomTypeID)
+	return r.getReservation(db)
+}
+
+// settlePenalty refunds the part of the deposit above the penalty that was
+// not refunded yet, or charges the card for penalty_due. What the card
+// declines is left as penalty_due. Every step is recorded as it completes,
+// so a failed settlement can be run again.
+func (r *Reservation) settlePenalty(db *sql.DB, gw PaymentGateway) error {
+	var token, captureID string
+	var refunded int64
+	err := db.QueryRow(
+		`SELECT r.payment_token,
+			COALESCE((SELECT t.gateway_id FROM payment_transactions t
+				WHERE t.reservation_id = r.id AND t.kind = 'capture' ORDER BY t.id LIMIT 1), ''),
+			(SELECT COALESCE(sum(t.amount), 0) FROM payment_transactions t
+				WHERE t.reservation_id = r.id AND t.kind = 'refund')
+		FROM reservations r WHERE r.id=$1`, r.ID).Scan(&token, &captureID, &refunded)
+	if err != nil {
+		return err
+	}
+
+	if refund := r.Deposit - r.Penalty - refunded; refund > 0 && captureID != "" {
+		t, err := gw.Refund(captureID, refund)
+		if err != nil {
+			return err
+		}
+		if err := recordTransaction(db, t, r.ID, 0); err != nil {
+			return err
+		}
+	}
+
+	if r.PenaltyDue > 0 {
+		auth, capture, err := chargeCard(gw, token, r.PenaltyDue, r.Currency)
+		if auth.ID != "" {
+			if err := recordTransaction(db, auth, r.ID, 0); err != nil {
+				return err
+			}
+		}
+		switch err {
+		case nil:
+			if err := r.collectPenalty(db, capture); err != nil {
+				return err
+			}
+		case ErrPaymentDeclined, ErrGatewayTimeout:
+			// left as penalty_due
+		default:
+			return err
+		}
+	}
+
+	_, err = db.Exec("UPDATE reservations SET settlement_pending=false WHERE id=$1", r.ID)
+	return err
+}
+
+// collectPenalty records the capture and takes it off penalty_due together
+func (r *Reservation) collectPenalty(db *sql.DB, capture Transaction) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordTransaction(tx, capture, r.ID, 0); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE reservations SET penalty_due = penalty_due - $1 WHERE id=$2",
+		capture.Amount, r.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SettlePenalties retries the settlements that failed when reservations
+// were cancelled or marked no-show. Those closed in the last minutes are
+// left to the request still settling them. It returns how many were
+// settled.
+func SettlePenalties(db *sql.DB, gw PaymentGateway) (int, error) {
+	rows, err := db.Query(
+		"SELECT " + reservationColumns + ` FROM reservations
+		WHERE settlement_pending AND closed_at < now() - interval '5 minutes' ORDER BY id`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	pending := []Reservation{}
+	for rows.Next() {
+		var r Reservation
+		if err := rows.Scan(r.scanFields()...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+
+	n := 0
+	for i := range pending {
+		if err := pending[i].settlePenalty(db, gw); err != nil {
+			log.Printf("reservation %d: penalty not settled: %v", pending[i].ID, err)
+			continue
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// MarkNoShows flags every confirmed reservation past its policy's no-show
+// cutoff at now and charges the penalties. It returns how many were marked.
+func MarkNoShows(db *sql.DB, gw PaymentGateway, now time.Time) (int, error) {
+	candidates, err := unarrivedReservations(db, now)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := range candidates {
+		r := &candidates[i]
+		plan, err := ratePlanForType(db, r.RoomTypeID, r.RatePlanID)
+		if err != nil {
+			return n, err
+		}
+		if now.Before(plan.cancellationPolicy().noShowCutoff(r.Arrival)) {
+			continue
+		}
+		err = r.noShow(db, gw)
+		if err == ErrReservationStatus {
+			// checked in or cancelled meanwhile
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// unarrivedReservations are the confirmed reservations arriving on or
+// before the day of through
+func unarrivedReservations(db *sql.DB, through time.Time) ([]Reservation, error) {
+	rows, err := db.Query(
+		"SELECT "+reservationColumns+" FROM reservations WHERE status=$1 AND arrival <= $2 ORDER BY id",
+		ReservationConfirmed, through)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	reservations := []Reservation{}
+
+	for rows.Next() {
+		var r Reservation
+		if err := rows.Scan(r.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		reservations = append(reservations, r)
+	}
+
+	return reservations, nil
+}
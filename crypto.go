@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Keyring holds the key encryption keys used to wrap per-row data keys,
+// and the key used for the deterministic passport hash.
+//
+// The keyfile is JSON:
+//
+//	{"current": "k2", "keys": {"k1": "<base64>", "k2": "<base64>"}, "hash_key": "<base64>"}
+//
+// All keys are 32 bytes. New rows are sealed with the current key, older
+// keys are kept so existing rows can be read until they are rotated.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+	hashKey []byte
+}
+
+// Sealed is an encrypted value together with its wrapped data key
+type Sealed struct {
+	Ciphertext []byte
+	WrappedKey []byte
+	KeyID      string
+}
+
+type keyfile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+	HashKey string            `json:"hash_key"`
+}
+
+// LoadKeyring reads a keyring from a local keyfile
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f keyfile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("keyfile %s: %v", path, err)
+	}
+
+	keys := map[string][]byte{}
+	for id, enc := range f.Keys {
+		if keys[id], err = decodeKey(enc); err != nil {
+			return nil, fmt.Errorf("keyfile %s: key %q: %v", path, id, err)
+		}
+	}
+	hashKey, err := decodeKey(f.HashKey)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile %s: hash_key: %v", path, err)
+	}
+
+	return NewKeyring(f.Current, keys, hashKey)
+}
+
+func NewKeyring(current string, keys map[string][]byte, hashKey []byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in the keyring", current)
+	}
+	for id, k := range keys {
+		if len(k) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes", id)
+		}
+	}
+	if len(hashKey) != 32 {
+		return nil, errors.New("hash key must be 32 bytes")
+	}
+	return &Keyring{current: current, keys: keys, hashKey: hashKey}, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != 32 {
+		return nil, errors.New("must be 32 bytes")
+	}
+	return k, nil
+}
+
+// CurrentKeyID is the key new values are sealed with
+func (k *Keyring) CurrentKeyID() string {
+	return k.current
+}
+
+// Hash returns a keyed hash of s, equal inputs give equal hashes
+func (k *Keyring) Hash(s string) []byte {
+	mac := hmac.New(sha256.New, k.hashKey)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// Seal encrypts s with a fresh data key and wraps that key with the
+// current key encryption key
+func (k *Keyring) Seal(s string) (Sealed, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return Sealed{}, err
+	}
+
+	ct, err := gcmSeal(dek, []byte(s))
+	if err != nil {
+		return Sealed{}, err
+	}
+	wrapped, err := gcmSeal(k.keys[k.current], dek)
+	if err != nil {
+		return Sealed{}, err
+	}
+
+	return Sealed{Ciphertext: ct, WrappedKey: wrapped, KeyID: k.current}, nil
+}
+
+// Open reverses Seal
+func (k *Keyring) Open(s Sealed) (string, error) {
+	dek, err := k.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+	pt, err := gcmOpen(dek, s.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(pt), nil
+}
+
+// Rewrap wraps the data key of s with the current key encryption key.
+// The ciphertext itself does not change.
+func (k *Keyring) Rewrap(s Sealed) (Sealed, error) {
+	dek, err := k.unwrap(s)
+	if err != nil {
+		return Sealed{}, err
+	}
+	wrapped, err := gcmSeal(k.keys[k.current], dek)
+	if err != nil {
+		return Sealed{}, err
+	}
+	return Sealed{Ciphertext: s.Ciphertext, WrappedKey: wrapped, KeyID: k.current}, nil
+}
+
+func (k *Keyring) unwrap(s Sealed) ([]byte, error) {
+	kek, ok := k.keys[s.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", s.KeyID)
+	}
+	return gcmOpen(kek, s.WrappedKey)
+}
+
+// gcmSeal returns nonce || ciphertext
+func gcmSeal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func gcmOpen(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ct := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealedColumns are the tables holding values sealed with the keyring,
+// each as <prefix>_enc, <prefix>_dek and <prefix>_key_id
+var sealedColumns = []struct{ table, prefix string }{
+	{"guests", "passport"},
+	{"guest_documents", "number"},
+}
+
+// RotatePassportKeys rewraps the data keys of every guest and document row
+// that is not sealed with the current key, batchSize rows per transaction.
+// It returns the number of rows rotated and can be re-run safely if
+// interrupted.
+func RotatePassportKeys(db *sql.DB, kr *Keyring, batchSize int) (int, error) {
+	total := 0
+	for _, c := range sealedColumns {
+		for {
+			n, err := rotateSealedBatch(db, kr, c.table, c.prefix, batchSize)
+			if err != nil {
+				return total, err
+			}
+			total += n
+			if n < batchSize {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+func rotateSealedBatch(db *sql.DB, kr *Keyring, table, prefix string, batchSize int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(fmt.Sprintf(
+		`SELECT id, %[2]s_enc, %[2]s_dek, %[2]s_key_id FROM %[1]s
+		WHERE %[2]s_key_id <> $1 ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED`, table, prefix),
+		kr.CurrentKeyID(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := []int{}
+	sealed := []Sealed{}
+	for rows.Next() {
+		var id int
+		var p Sealed
+		if err := rows.Scan(&id, &p.Ciphertext, &p.WrappedKey, &p.KeyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		sealed = append(sealed, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		p, err := kr.Rewrap(sealed[i])
+		if err != nil {
+			return 0, fmt.Errorf("%s %d: %v", table, id, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf(
+			"UPDATE %[1]s SET %[2]s_dek=$1, %[2]s_key_id=$2 WHERE id=$3", table, prefix),
+			p.WrappedKey, p.KeyID, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), tx.Commit()
+}
+
+// MigratePassports seals the passports that a database from before they
+// were encrypted keeps in plain text, batchSize rows per transaction, and
+// clears the plain text. It returns the number of rows sealed and can be
+// re-run safely if interrupted.
+func MigratePassports(db *sql.DB, kr *Keyring, batchSize int) (int, error) {
+	if plain, err := hasPlainPassports(db); err != nil || !plain {
+		return 0, err
+	}
+	total := 0
+	for {
+		n, err := sealPassportBatch(db, kr, batchSize)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < batchSize {
+			return total, nil
+		}
+	}
+}
+
+func hasPlainPassports(db queryer) (bool, error) {
+	var plain bool
+	err := db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'guests' AND column_name = 'passport')`).
+		Scan(&plain)
+	return plain, err
+}
+
+func sealPassportBatch(db *sql.DB, kr *Keyring, batchSize int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT id, passport FROM guests WHERE passport IS NOT NULL
+		ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := []int{}
+	passports := []string{}
+	for rows.Next() {
+		var id int
+		var passport string
+		if err := rows.Scan(&id, &passport); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		passports = append(passports, passport)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		p, err := kr.Seal(passports[i])
+		if err != nil {
+			return 0, fmt.Errorf("guests %d: %v", id, err)
+		}
+		_, err = tx.Exec(
+			`UPDATE guests SET passport=NULL, passport_hash=$1, passport_enc=$2, passport_dek=$3,
+			passport_key_id=$4 WHERE id=$5`,
+			kr.Hash(passports[i]), p.Ciphertext, p.WrappedKey, p.KeyID, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), tx.Commit()
+}
+
+// FinishPassportMigration drops the plain text column once the passports
+// of every tenant are sealed, and makes the sealed columns required
+func FinishPassportMigration(db *sql.DB) error {
+	if plain, err := hasPlainPassports(db); err != nil || !plain {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// fails while any row is left unsealed
+	_, err = tx.Exec(
+		`ALTER TABLE guests ALTER COLUMN passport_hash SET NOT NULL,
+		ALTER COLUMN passport_enc SET NOT NULL, ALTER COLUMN passport_dek SET NOT NULL,
+		ALTER COLUMN passport_key_id SET NOT NULL, DROP COLUMN passport`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'guests_passport_hash_key') THEN
+				ALTER TABLE guests ADD CONSTRAINT guests_passport_hash_key UNIQUE(tenant_id, passport_hash);
+			END IF;
+		END $$`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// BaseCurrency is the currency folios are kept in. Exchange rates are
+// quoted as units of a currency per one unit of BaseCurrency.
+var BaseCurrency = "EUR"
+
+// rates are stored as integers with six decimals, 1.0845 is 1084500
+const rateScale = 1000000
+
+// currencies whose minor unit is not a hundredth
+var minorUnitDigits = map[string]int{
+	"JPY": 0, "KRW": 0, "ISK": 0,
+	"BHD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+type ExchangeRate struct {
+	Currency      string `json:"currency"`
+	EffectiveDate Date   `json:"effective_date"`
+	Rate          string `json:"rate"`
+}
+
+// Conversion records an amount converted at a given rate
+type Conversion struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+
+	// units of Currency per unit of the source currency
+	Rate string `json:"rate,omitempty"`
+}
+
+func (c *Conversion) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return json.Marshal(c)
+}
+
+// scans a nullable JSONB column into a *Conversion
+type conversionScanner struct {
+	dest **Conversion
+}
+
+func (s conversionScanner) Scan(src interface{}) error {
+	if src == nil {
+		*s.dest = nil
+		return nil
+	}
+	c := &Conversion{}
+	if err := scanJSON(src, c); err != nil {
+		return err
+	}
+	*s.dest = c
+	return nil
+}
+
+func digits(currency string) int {
+	if d, ok := minorUnitDigits[currency]; ok {
+		return d
+	}
+	return 2
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
+// parseRate reads a positive decimal such as "1.0845" into rateScale units.
+// Both sides of the point need digits and signs are refused.
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	whole, frac := s, "0"
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if !isDigits(whole) || !isDigits(frac) {
+		return 0, invalidf("Invalid rate '%s'", s)
+	}
+	if len(frac) > 6 {
+		return 0, invalidf("Rate '%s' has more than 6 decimals", s)
+	}
+	frac += strings.Repeat("0", 6-len(frac))
+
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, invalidf("Invalid rate '%s'", s)
+	}
+	f, _ := strconv.ParseInt(frac, 10, 64)
+	rate := w*rateScale + f
+	if rate <= 0 {
+		return 0, invalidf("Rate '%s' must be positive", s)
+	}
+	return rate, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func formatRate(rate int64) string {
+	return fmt.Sprintf("%d.%06d", rate/rateScale, rate%rateScale)
+}
+
+func normaliseCurrency(c string) (string, error) {
+	c = strings.ToUpper(strings.TrimSpace(c))
+	if len(c) != 3 {
+		return "", invalidf("Invalid currency '%s'", c)
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return "", invalidf("Invalid currency '%s'", c)
+		}
+	}
+	return c, nil
+}
+
+// rate of currency against the base currency on the given day
+func getRate(db queryer, currency string, on Date) (int64, error) {
+	if currency == BaseCurrency {
+		return rateScale, nil
+	}
+	var rate int64
+	err := db.QueryRow(
+		`SELECT rate FROM exchange_rates WHERE currency=$1 AND effective_date <= $2
+		ORDER BY effective_date DESC LIMIT 1`, currency, on).Scan(&rate)
+	if err == sql.ErrNoRows {
+		return 0, invalidf("No exchange rate for %s on %s", currency, on)
+	}
+	return rate, err
+}
+
+// Convert converts amount in minor units of from into to, with the rates
+// effective on the given day
+func Convert(db queryer, amount int64, from, to string, on Date) (Conversion, error) {
+	if from == to {
+		return Conversion{Amount: amount, Currency: to}, nil
+	}
+	fromRate, err := getRate(db, from, on)
+	if err != nil {
+		return Conversion{}, err
+	}
+	toRate, err := getRate(db, to, on)
+	if err != nil {
+		return Conversion{}, err
+	}
+	return convertAt(amount, from, to, fromRate, toRate), nil
+}
+
+// convertAt converts with both rates against the base currency, rounding
+// half away from zero once at the end
+func convertAt(amount int64, from, to string, fromRate, toRate int64) Conversion {
+	num := amount * toRate
+	den := fromRate
+	if d := digits(to) - digits(from); d > 0 {
+		num *= pow10(d)
+	} else if d < 0 {
+		den *= pow10(-d)
+	}
+
+	sign := int64(1)
+	if num < 0 {
+		sign, num = -1, -num
+	}
+	converted := sign * divRound(num, den, RoundHalfUp)
+
+	return Conversion{
+		Amount:   converted,
+		Currency: to,
+		Rate:     crossRate(fromRate, toRate),
+	}
+}
+
+// crossRate is the rate from one currency to another given both against
+// the base currency
+func crossRate(fromRate, toRate int64) string {
+	return formatRate(divRound(toRate*rateScale, fromRate, RoundHalfUp))
+}
+
+func (r *ExchangeRate) createExchangeRate(db *sql.DB) error {
+	var err error
+	if r.Currency, err = normaliseCurrency(r.Currency); err != nil {
+		return err
+	}
+	if r.Currency == BaseCurrency {
+		return invalidf("%s is the base currency", r.Currency)
+	}
+	rate, err := parseRate(r.Rate)
+	if err != nil {
+		return err
+	}
+	r.Rate = formatRate(rate)
+
+	_, err = db.Exec(
+		`INSERT INTO exchange_rates(currency, effective_date, rate) VALUES($1, $2, $3)
+		ON CONFLICT (tenant_id, currency, effective_date) DO UPDATE SET rate = EXCLUDED.rate`,
+		r.Currency, r.EffectiveDate, rate)
+	return err
+}
+
+func GetAllExchangeRates(db *sql.DB) ([]ExchangeRate, error) {
+	rows, err := db.Query(
+		"SELECT currency, effective_date, rate FROM exchange_rates ORDER BY currency, effective_date")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	rates := []ExchangeRate{}
+
+	for rows.Next() {
+		var r ExchangeRate
+		var rate int64
+		if err := rows.Scan(&r.Currency, &r.EffectiveDate, &rate); err != nil {
+			return nil, err
+		}
+		r.Rate = formatRate(rate)
+
+		rates = append(rates, r)
+	}
+
+	return rates, nil
+}
+
+// ImportExchangeRates loads "currency,effective_date,rate" lines, an
+// optional header included, in one transaction. Rates for a day that is
+// already known are replaced.
+func ImportExchangeRates(db *sql.DB, src io.Reader) (int, error) {
+	records, err := csv.NewReader(src).ReadAll()
+	if err != nil {
+		return 0, invalidf("Invalid CSV: %v", err)
+	}
+	// line numbers in errors count the header too
+	first := 1
+	if len(records) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "currency") {
+		records = records[1:]
+		first = 2
+	}
+
+	rates := []ExchangeRate{}
+	for i, rec := range records {
+		if len(rec) != 3 {
+			return 0, invalidf("Line %d: expected currency,effective_date,rate", i+first)
+		}
+		date, err := ParseDate(strings.TrimSpace(rec[1]))
+		if err != nil {
+			return 0, invalidf("Line %d: %v", i+first, err)
+		}
+		rates = append(rates, ExchangeRate{Currency: rec[0], EffectiveDate: date, Rate: rec[2]})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for i := range rates {
+		r := &rates[i]
+		if r.Currency, err = normaliseCurrency(r.Currency); err != nil {
+			return 0, invalidf("Line %d: %v", i+first, err)
+		}
+		if r.Currency == BaseCurrency {
+			return 0, invalidf("Line %d: %s is the base currency", i+first, r.Currency)
+		}
+		rate, err := parseRate(r.Rate)
+		if err != nil {
+			return 0, invalidf("Line %d: %v", i+first, err)
+		}
+		_, err = tx.Exec(
+			`INSERT INTO exchange_rates(currency, effective_date, rate) VALUES($1, $2, $3)
+			ON CONFLICT (tenant_id, currency, effective_date) DO UPDATE SET rate = EXCLUDED.rate`,
+			r.Currency, r.EffectiveDate, rate)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(rates), tx.Commit()
+}
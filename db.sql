@@ -1,17 +1,455 @@
+-- Every table below belongs to a tenant. The app sets app.tenant_id on each
+-- connection from the API key; rows created here belong to the first tenant.
+SET app.tenant_id = 1;
+
+CREATE OR REPLACE FUNCTION current_tenant() RETURNS INTEGER AS $$
+    SELECT NULLIF(current_setting('app.tenant_id', true), '')::INTEGER
+$$ LANGUAGE SQL STABLE;
+
+CREATE TABLE IF NOT EXISTS tenants
+(
+    id SERIAL,
+    name TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT tenants_pkey PRIMARY KEY(id)
+);
+
+INSERT INTO tenants(id, name) VALUES(1, 'Default') ON CONFLICT DO NOTHING;
+SELECT setval('tenants_id_seq', GREATEST((SELECT max(id) FROM tenants), 1));
+
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    key_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMP,
+    CONSTRAINT api_keys_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS properties
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    CONSTRAINT properties_pkey PRIMARY KEY(id)
+);
+
+INSERT INTO properties(name) SELECT 'Main' WHERE NOT EXISTS (SELECT 1 FROM properties);
+
+CREATE TABLE IF NOT EXISTS room_types
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    property_id INTEGER NOT NULL DEFAULT 1,
+    name TEXT NOT NULL,
+    capacity INTEGER NOT NULL,
+    features JSONB,
+    default_rate BIGINT NOT NULL DEFAULT 0,
+    CONSTRAINT room_types_pkey PRIMARY KEY(id),
+    CONSTRAINT room_types_name_key UNIQUE(property_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS rate_plans
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_type_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'EUR',
+    base_rate BIGINT NOT NULL,
+    weekend_rate BIGINT NOT NULL DEFAULT 0,
+    base_occupancy INTEGER NOT NULL DEFAULT 0,
+    extra_guest_fee BIGINT NOT NULL DEFAULT 0,
+    seasons JSONB NOT NULL DEFAULT '[]',
+    los_discounts JSONB NOT NULL DEFAULT '[]',
+    cancellation_policy JSONB,
+    CONSTRAINT rate_plans_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS tax_rules
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    basis_points BIGINT NOT NULL DEFAULT 0,
+    inclusive BOOLEAN NOT NULL DEFAULT false,
+    categories JSONB NOT NULL DEFAULT '[]',
+    amount BIGINT NOT NULL DEFAULT 0,
+    max_nights INTEGER NOT NULL DEFAULT 0,
+    rounding TEXT NOT NULL DEFAULT 'half_up',
+    cap BIGINT NOT NULL DEFAULT 0,
+    exempt_under_age INTEGER NOT NULL DEFAULT 0,
+    exempt_from_nights INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT tax_rules_pkey PRIMARY KEY(id),
+    CONSTRAINT tax_rules_name_key UNIQUE(tenant_id, name)
+);
+
 CREATE TABLE IF NOT EXISTS rooms
 (
     id SERIAL,
-    number INTEGER NOT NULL UNIQUE,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    property_id INTEGER NOT NULL DEFAULT 1,
+    number INTEGER NOT NULL,
     params TEXT,
     beds INTEGER,
-    CONSTRAINT rooms_pkey PRIMARY KEY(id)
+    room_type_id INTEGER,
+    features JSONB,
+    housekeeping_status TEXT NOT NULL DEFAULT 'clean',
+    housekeeper TEXT NOT NULL DEFAULT '',
+    CONSTRAINT rooms_pkey PRIMARY KEY(id),
+    CONSTRAINT rooms_number_key UNIQUE(property_id, number)
 );
 
+-- Databases created before properties, room types, features and
+-- housekeeping get their columns with the defaults
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    ADD COLUMN IF NOT EXISTS property_id INTEGER NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS room_type_id INTEGER,
+    ADD COLUMN IF NOT EXISTS features JSONB,
+    ADD COLUMN IF NOT EXISTS housekeeping_status TEXT NOT NULL DEFAULT 'clean',
+    ADD COLUMN IF NOT EXISTS housekeeper TEXT NOT NULL DEFAULT '';
+
+-- Room numbers used to be unique in the whole database, under the name the
+-- per-property constraint has now. Databases from then get the new one.
+DO $$
+DECLARE c TEXT;
+BEGIN
+    FOR c IN SELECT conname FROM pg_constraint
+            WHERE conrelid = 'rooms'::regclass AND pg_get_constraintdef(oid) = 'UNIQUE (number)'
+    LOOP
+        EXECUTE format('ALTER TABLE rooms DROP CONSTRAINT %I', c);
+    END LOOP;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint
+            WHERE conrelid = 'rooms'::regclass AND pg_get_constraintdef(oid) = 'UNIQUE (property_id, number)') THEN
+        ALTER TABLE rooms ADD CONSTRAINT rooms_number_key UNIQUE(property_id, number);
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS rooms_features_idx ON rooms USING GIN (features);
+
 CREATE TABLE IF NOT EXISTS guests
 (
     id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    passport_hash BYTEA NOT NULL,
+    passport_enc BYTEA NOT NULL,
+    passport_dek BYTEA NOT NULL,
+    passport_key_id TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    phone TEXT NOT NULL DEFAULT '',
+    nationality TEXT NOT NULL DEFAULT '',
+    date_of_birth DATE,
+    preferences JSONB NOT NULL DEFAULT '[]',
+    erased_at TIMESTAMP,
+    CONSTRAINT guests_pkey PRIMARY KEY(id),
+    CONSTRAINT guests_passport_hash_key UNIQUE(tenant_id, passport_hash)
+);
+
+-- Databases created before guest profiles get their columns
+ALTER TABLE guests ADD COLUMN IF NOT EXISTS tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS phone TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS nationality TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS date_of_birth DATE,
+    ADD COLUMN IF NOT EXISTS preferences JSONB NOT NULL DEFAULT '[]',
+    ADD COLUMN IF NOT EXISTS erased_at TIMESTAMP;
+
+-- Passports used to be kept in plain text. Databases from then get the
+-- sealed columns empty and keep the plain ones until migrate-passports
+-- seals them.
+ALTER TABLE guests ADD COLUMN IF NOT EXISTS passport_hash BYTEA,
+    ADD COLUMN IF NOT EXISTS passport_enc BYTEA,
+    ADD COLUMN IF NOT EXISTS passport_dek BYTEA,
+    ADD COLUMN IF NOT EXISTS passport_key_id TEXT;
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+            WHERE table_schema = current_schema() AND table_name = 'guests' AND column_name = 'passport') THEN
+        ALTER TABLE guests ALTER COLUMN passport DROP NOT NULL;
+    END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS guest_documents
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    guest_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    number_enc BYTEA NOT NULL,
+    number_dek BYTEA NOT NULL,
+    number_key_id TEXT NOT NULL,
+    country TEXT NOT NULL DEFAULT '',
+    expires_on DATE,
+    CONSTRAINT guest_documents_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS stays
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    guest_id INTEGER NOT NULL,
+    room_id INTEGER NOT NULL,
+    property_id INTEGER NOT NULL DEFAULT 1,
+    checked_in_at TIMESTAMP NOT NULL DEFAULT now(),
+    checked_out_at TIMESTAMP,
+    rate_type_id INTEGER,
+    rate_plan_id INTEGER NOT NULL DEFAULT 0,
+    guests INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT stays_pkey PRIMARY KEY(id)
+);
+
+-- Guests used to be checked in by guests.room_id. Databases from then get
+-- an open stay for every guest in a room before the column goes.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+            WHERE table_schema = current_schema() AND table_name = 'guests' AND column_name = 'room_id') THEN
+        INSERT INTO stays(tenant_id, guest_id, room_id, property_id)
+        SELECT g.tenant_id, g.id, r.id, r.property_id FROM guests g JOIN rooms r ON r.id = g.room_id
+        WHERE NOT EXISTS (SELECT 1 FROM stays s WHERE s.guest_id = g.id AND s.checked_out_at IS NULL);
+        ALTER TABLE guests DROP COLUMN room_id;
+    END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS guest_audit
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    guest_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT guest_audit_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS folios
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    stay_id INTEGER NOT NULL UNIQUE,
+    closed_at TIMESTAMP,
+    CONSTRAINT folios_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS folio_lines
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    folio_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    category TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    amount BIGINT NOT NULL,
+    night DATE,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    original JSONB,
+    CONSTRAINT folio_lines_pkey PRIMARY KEY(id),
+    CONSTRAINT folio_lines_night_key UNIQUE(folio_id, night, category)
+);
+
+CREATE TABLE IF NOT EXISTS invoice_counter
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    last_number INTEGER NOT NULL,
+    CONSTRAINT invoice_counter_pkey PRIMARY KEY(tenant_id)
+);
+
+CREATE TABLE IF NOT EXISTS invoices
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    number INTEGER NOT NULL,
+    folio_id INTEGER NOT NULL UNIQUE,
+    guest_id INTEGER NOT NULL,
+    issued_at TIMESTAMP NOT NULL,
+    data JSONB NOT NULL,
+    CONSTRAINT invoices_pkey PRIMARY KEY(id),
+    CONSTRAINT invoices_number_key UNIQUE(tenant_id, number)
+);
+
+CREATE TABLE IF NOT EXISTS exchange_rates
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    currency TEXT NOT NULL,
+    effective_date DATE NOT NULL,
+    rate BIGINT NOT NULL,
+    CONSTRAINT exchange_rates_pkey PRIMARY KEY(tenant_id, currency, effective_date)
+);
+
+CREATE TABLE IF NOT EXISTS reservations
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
     name TEXT NOT NULL,
-    passport TEXT NOT NULL UNIQUE,
+    room_type_id INTEGER NOT NULL,
+    rate_plan_id INTEGER NOT NULL DEFAULT 0,
+    arrival DATE NOT NULL,
+    departure DATE NOT NULL,
+    guests INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    total BIGINT NOT NULL,
+    deposit BIGINT NOT NULL DEFAULT 0,
+    payment_token TEXT NOT NULL DEFAULT '',
+    stay_id INTEGER,
+    group_id INTEGER,
+    penalty BIGINT NOT NULL DEFAULT 0,
+    penalty_due BIGINT NOT NULL DEFAULT 0,
+    settlement_pending BOOLEAN NOT NULL DEFAULT false,
+    closed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT reservations_pkey PRIMARY KEY(id)
+);
+
+-- Databases created before penalties were settled in the background
+ALTER TABLE reservations ADD COLUMN IF NOT EXISTS settlement_pending BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS reservations_dates_idx ON reservations(room_type_id, arrival, departure);
+
+CREATE TABLE IF NOT EXISTS payment_transactions
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    gateway_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    amount BIGINT NOT NULL,
+    currency TEXT NOT NULL,
+    reservation_id INTEGER,
+    folio_id INTEGER,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT payment_transactions_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS group_bookings
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    arrival DATE NOT NULL,
+    departure DATE NOT NULL,
+    release_date DATE NOT NULL,
+    rate_plan_id INTEGER NOT NULL DEFAULT 0,
+    released_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT group_bookings_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS group_blocks
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    group_id INTEGER NOT NULL,
+    room_type_id INTEGER NOT NULL,
+    rooms INTEGER NOT NULL,
+    CONSTRAINT group_blocks_pkey PRIMARY KEY(id),
+    CONSTRAINT group_blocks_type_key UNIQUE(group_id, room_type_id)
+);
+
+CREATE TABLE IF NOT EXISTS waitlist
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    room_type_id INTEGER NOT NULL,
+    arrival DATE NOT NULL,
+    departure DATE NOT NULL,
+    guests INTEGER NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    offer_expires_at TIMESTAMP,
+    reservation_id INTEGER,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT waitlist_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS holds
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_type_id INTEGER NOT NULL,
+    arrival DATE NOT NULL,
+    departure DATE NOT NULL,
+    status TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    reservation_id INTEGER,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT holds_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS overbooking_limits
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_type_id INTEGER NOT NULL,
+    from_date DATE NOT NULL,
+    to_date DATE NOT NULL,
+    percent INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT overbooking_limits_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS room_blocks
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_id INTEGER NOT NULL,
+    from_date DATE NOT NULL,
+    to_date DATE NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT room_blocks_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS maintenance_tickets
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
     room_id INTEGER NOT NULL,
-    CONSTRAINT guests_pkey PRIMARY KEY(id)
+    title TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    assigned_to TEXT NOT NULL DEFAULT '',
+    opened_at TIMESTAMP NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMP,
+    CONSTRAINT maintenance_tickets_pkey PRIMARY KEY(id)
 );
+
+CREATE TABLE IF NOT EXISTS night_audits
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    business_date DATE NOT NULL,
+    step TEXT NOT NULL,
+    room_charges INTEGER NOT NULL DEFAULT 0,
+    no_shows INTEGER NOT NULL DEFAULT 0,
+    rooms INTEGER NOT NULL DEFAULT 0,
+    occupied INTEGER NOT NULL DEFAULT 0,
+    room_revenue BIGINT NOT NULL DEFAULT 0,
+    started_at TIMESTAMP NOT NULL DEFAULT now(),
+    completed_at TIMESTAMP,
+    CONSTRAINT night_audits_pkey PRIMARY KEY(id),
+    CONSTRAINT night_audits_business_date_key UNIQUE(tenant_id, business_date)
+);
+
+-- Row-level security keeps every tenant to its own rows, also for the table
+-- owner. The app's role must not be a superuser or have BYPASSRLS.
+DO $$
+DECLARE t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['properties', 'room_types', 'rate_plans', 'tax_rules', 'rooms', 'guests',
+        'guest_documents', 'stays', 'guest_audit', 'folios', 'folio_lines', 'invoice_counter', 'invoices',
+        'exchange_rates', 'reservations', 'payment_transactions', 'group_bookings', 'group_blocks',
+        'waitlist', 'holds', 'overbooking_limits', 'room_blocks', 'maintenance_tickets', 'night_audits']
+    LOOP
+        EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %I', t);
+        EXECUTE format('CREATE POLICY tenant_isolation ON %I USING (tenant_id = current_tenant())', t);
+    END LOOP;
+END $$;
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// rows fetched from the cursor at a time
+const exportBatchSize = 500
+
+// export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+	ExportXLSX   = "xlsx"
+)
+
+// exportCursor walks the rows of a query through a server side cursor, so
+// neither the database nor the service holds more than a batch
+type exportCursor struct {
+	tx   *sql.Tx
+	rows *sql.Rows
+	n    int
+}
+
+func openExportCursor(db *sql.DB, query string, args ...interface{}) (*exportCursor, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DECLARE export_cursor NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &exportCursor{tx: tx}, nil
+}
+
+// next moves to the next row, fetching a batch when the last one is used up
+func (c *exportCursor) next() (bool, error) {
+	for {
+		if c.rows != nil {
+			if c.rows.Next() {
+				c.n++
+				return true, nil
+			}
+			err := c.rows.Err()
+			c.rows.Close()
+			c.rows = nil
+			if err != nil || c.n < exportBatchSize {
+				return false, err
+			}
+		}
+		var err error
+		if c.rows, err = c.tx.Query(fmt.Sprintf("FETCH %d FROM export_cursor", exportBatchSize)); err != nil {
+			return false, err
+		}
+		c.n = 0
+	}
+}
+
+func (c *exportCursor) scan(dest ...interface{}) error {
+	return c.rows.Scan(dest...)
+}
+
+// close ends the read only transaction of the cursor
+func (c *exportCursor) close() {
+	if c.rows != nil {
+		c.rows.Close()
+	}
+	c.tx.Rollback()
+}
+
+// exportWriter writes records of the columns as CSV with a header, as
+// NDJSON objects or as an XLSX sheet with a header row
+type exportWriter struct {
+	format  string
+	columns []string
+	w       io.Writer
+	csv     *csv.Writer
+	xlsx    *xlsxWriter
+}
+
+func newExportWriter(w io.Writer, format string, columns []string) (*exportWriter, error) {
+	e := &exportWriter{format: format, columns: columns, w: w}
+	header := make([]interface{}, len(columns))
+	for i, c := range columns {
+		header[i] = c
+	}
+
+	switch format {
+	case ExportCSV:
+		e.csv = csv.NewWriter(w)
+		return e, e.write(header)
+	case ExportXLSX:
+		var err error
+		if e.xlsx, err = newXLSXWriter(w); err != nil {
+			return nil, err
+		}
+		return e, e.write(header)
+	case ExportNDJSON:
+		return e, nil
+	}
+	return nil, invalidf("Unknown format '%s', expected csv, ndjson or xlsx", format)
+}
+
+func (e *exportWriter) write(record []interface{}) error {
+	switch e.format {
+	case ExportCSV:
+		text := make([]string, len(record))
+		for i, v := range record {
+			text[i] = cellText(v)
+		}
+		return e.csv.Write(text)
+	case ExportXLSX:
+		return e.xlsx.writeRow(record)
+	}
+
+	// the object keeps the order of the columns
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, v := range record {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(e.columns[i])
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteString("}\n")
+	_, err := e.w.Write(b.Bytes())
+	return err
+}
+
+func (e *exportWriter) close() error {
+	switch e.format {
+	case ExportCSV:
+		e.csv.Flush()
+		return e.csv.Error()
+	case ExportXLSX:
+		return e.xlsx.close()
+	}
+	return nil
+}
+
+var roomExportColumns = []string{"id", "property_id", "number", "params", "beds", "room_type_id",
+	"housekeeping_status", "housekeeper", "floor", "view", "bed_configuration", "accessible", "smoking",
+	"amenities"}
+
+// exportRecord flattens the room's features into columns
+func (r *Room) exportRecord() []interface{} {
+	f := RoomFeatures{}
+	if r.Features != nil {
+		f = *r.Features
+	}
+	amenities := f.Amenities
+	if amenities == nil {
+		amenities = []string{}
+	}
+	return []interface{}{r.ID, r.PropertyID, r.Number, r.Parameters, r.Beds, r.TypeID, r.Housekeeping,
+		r.Housekeeper, f.Floor, f.View, f.BedConfiguration, f.Accessible, f.Smoking, amenities}
+}
+
+// ExportRooms writes the rooms of one property, or of all of them when
+// propertyID is 0, that have the features of the filter
+func ExportRooms(db *sql.DB, propertyID int, filter RoomFilter, open func() (*exportWriter, error)) error {
+	query, args := roomsQuery(propertyID, filter)
+	cursor, err := openExportCursor(db, query, args...)
+	if err != nil {
+		return err
+	}
+	defer cursor.close()
+
+	e, err := open()
+	if err != nil {
+		return err
+	}
+	for {
+		ok, err := cursor.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		var r Room
+		if err := cursor.scan(r.scanFields()...); err != nil {
+			return err
+		}
+		if err := e.write(r.exportRecord()); err != nil {
+			return err
+		}
+	}
+	return e.close()
+}
+
+// guests are exported without their passports
+var guestExportColumns = []string{"id", "name", "email", "phone", "nationality", "date_of_birth",
+	"preferences", "room_id"}
+
+// ExportGuests writes the profiles matching the search, all of them for an
+// empty one
+func ExportGuests(db *sql.DB, q GuestSearch, open func() (*exportWriter, error)) error {
+	cursor, err := openExportCursor(db,
+		`SELECT g.id, g.name, g.email, g.phone, g.nationality, g.date_of_birth, g.preferences,
+		COALESCE(s.room_id, 0)
+		FROM guests g LEFT JOIN stays s ON s.guest_id = g.id AND s.checked_out_at IS NULL
+		WHERE `+guestSearchConditions+" ORDER BY g.id", q.args()...)
+	if err != nil {
+		return err
+	}
+	defer cursor.close()
+
+	e, err := open()
+	if err != nil {
+		return err
+	}
+	for {
+		ok, err := cursor.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		var g Guest
+		err = cursor.scan(&g.ID, &g.Name, &g.Email, &g.Phone, &g.Nationality, &g.DateOfBirth,
+			&g.Preferences, &g.RoomID)
+		if err != nil {
+			return err
+		}
+		var birth interface{}
+		if g.DateOfBirth != nil {
+			birth = g.DateOfBirth.String()
+		}
+		preferences := []string(g.Preferences)
+		if preferences == nil {
+			preferences = []string{}
+		}
+		err = e.write([]interface{}{g.ID, g.Name, g.Email, g.Phone, g.Nationality, birth, preferences, g.RoomID})
+		if err != nil {
+			return err
+		}
+	}
+	return e.close()
+}
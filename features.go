@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RoomFeatures is the typed description of a room, stored as JSONB
+type RoomFeatures struct {
+	Floor            int      `json:"floor"`
+	View             string   `json:"view,omitempty"`
+	BedConfiguration string   `json:"bed_configuration,omitempty"`
+	Accessible       bool     `json:"accessible"`
+	Smoking          bool     `json:"smoking"`
+	Amenities        []string `json:"amenities,omitempty"`
+}
+
+func (f RoomFeatures) Value() (driver.Value, error) {
+	return json.Marshal(f)
+}
+
+func (f *RoomFeatures) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, f)
+	case string:
+		return json.Unmarshal([]byte(v), f)
+	default:
+		return fmt.Errorf("cannot scan %T into RoomFeatures", src)
+	}
+}
+
+// Describe renders the features as free text, used to fill params for
+// clients that still read it
+func (f RoomFeatures) Describe() string {
+	parts := []string{fmt.Sprintf("floor %d", f.Floor)}
+	if f.View != "" {
+		parts = append(parts, f.View+" view")
+	}
+	if f.BedConfiguration != "" {
+		parts = append(parts, f.BedConfiguration)
+	}
+	if f.Accessible {
+		parts = append(parts, "accessible")
+	}
+	if f.Smoking {
+		parts = append(parts, "smoking")
+	} else {
+		parts = append(parts, "non-smoking")
+	}
+	parts = append(parts, f.Amenities...)
+	return strings.Join(parts, ", ")
+}
+
+// scans a nullable JSONB column into a *RoomFeatures
+type featuresScanner struct {
+	dest **RoomFeatures
+}
+
+func (s featuresScanner) Scan(src interface{}) error {
+	if src == nil {
+		*s.dest = nil
+		return nil
+	}
+	f := &RoomFeatures{}
+	if err := f.Scan(src); err != nil {
+		return err
+	}
+	*s.dest = f
+	return nil
+}
+
+// RoomFilter is a partial set of features a room must have. It is matched
+// with JSONB containment, so only the keys that were set are compared.
+type RoomFilter map[string]interface{}
+
+// ParseRoomFilter reads floor, view, bed_configuration, accessible, smoking
+// and amenity (repeatable) from the query string
+func ParseRoomFilter(q url.Values) (RoomFilter, error) {
+	f := RoomFilter{}
+
+	if v := q.Get("floor"); v != "" {
+		floor, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("Invalid floor")
+		}
+		f["floor"] = floor
+	}
+	if v := q.Get("view"); v != "" {
+		f["view"] = v
+	}
+	if v := q.Get("bed_configuration"); v != "" {
+		f["bed_configuration"] = v
+	}
+	for _, key := range []string{"accessible", "smoking"} {
+		if v := q.Get(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s", key)
+			}
+			f[key] = b
+		}
+	}
+	if amenities := q["amenity"]; len(amenities) > 0 {
+		f["amenities"] = amenities
+	}
+
+	return f, nil
+}
+
+func (f RoomFilter) Value() (driver.Value, error) {
+	return json.Marshal(map[string]interface{}(f))
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// folio line kinds
+const (
+	LineRoom    = "room"
+	LineCharge  = "charge"
+	LinePayment = "payment"
+	LineRefund  = "refund"
+	LineTax     = "tax"
+)
+
+// ErrBalanceDue is returned by checkout while the folio is not settled
+var ErrBalanceDue = errors.New("Folio balance must be zero before checkout")
+
+// ErrFolioClosed is returned when posting charges to a checked out stay
+var ErrFolioClosed = errors.New("Folio is closed")
+
+// Folio is the financial record of one stay. Charges and refunds are
+// positive amounts, payments negative, so Balance is what the guest owes.
+type Folio struct {
+	ID       int         `json:"id"`
+	StayID   int         `json:"stay_id"`
+	Currency string      `json:"currency"`
+	ClosedAt *time.Time  `json:"closed_at,omitempty"`
+	Lines    []FolioLine `json:"lines"`
+	Balance  int64       `json:"balance"`
+}
+
+type FolioLine struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	Category    string    `json:"category,omitempty"`
+	Description string    `json:"description"`
+	Amount      int64     `json:"amount"`
+	Night       *Date     `json:"night,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// what was posted when it was not in the base currency
+	Original *Conversion `json:"original,omitempty"`
+}
+
+// Posting is the payload of the charge, payment and refund endpoints.
+// Currency defaults to the base currency.
+type Posting struct {
+	Category    string `json:"category"`
+	Description string `json:"description"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency,omitempty"`
+}
+
+// CheckoutOverride lets a manager check a guest out with an open balance
+type CheckoutOverride struct {
+	Manager string `json:"manager"`
+	Reason  string `json:"reason"`
+}
+
+// CheckoutRequest is the optional body of a checkout. The balance is
+// charged to PaymentToken, or to the card of the reservation if not set.
+type CheckoutRequest struct {
+	PaymentToken string            `json:"payment_token,omitempty"`
+	Override     *CheckoutOverride `json:"override,omitempty"`
+}
+
+// Returns the folio of a stay, opening it on first use
+func getFolioForStay(db queryer, stayID int) (*Folio, error) {
+	f := &Folio{StayID: stayID, Currency: BaseCurrency}
+	_, err := db.Exec("INSERT INTO folios(stay_id) VALUES($1) ON CONFLICT (stay_id) DO NOTHING", stayID)
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow("SELECT id, closed_at FROM folios WHERE stay_id=$1", stayID).Scan(&f.ID, &f.ClosedAt)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Folio) getFolioLines(db queryer) error {
+	rows, err := db.Query(
+		`SELECT id, kind, category, description, amount, night, created_at, original
+		FROM folio_lines WHERE folio_id=$1 ORDER BY id`, f.ID)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	f.Lines = []FolioLine{}
+	f.Balance = 0
+
+	for rows.Next() {
+		var l FolioLine
+		var night sql.NullTime
+		if err := rows.Scan(&l.ID, &l.Kind, &l.Category, &l.Description, &l.Amount, &night,
+			&l.CreatedAt, conversionScanner{&l.Original}); err != nil {
+			return err
+		}
+		if night.Valid {
+			l.Night = &Date{night.Time}
+		}
+
+		f.Lines = append(f.Lines, l)
+		f.Balance += l.Amount
+	}
+
+	return nil
+}
+
+func (f *Folio) balance(db queryer) (int64, error) {
+	var balance int64
+	err := db.QueryRow("SELECT COALESCE(sum(amount), 0) FROM folio_lines WHERE folio_id=$1",
+		f.ID).Scan(&balance)
+	return balance, err
+}
+
+// addLine posts p, converting it to the base currency at today's rate
+// if it is in another currency
+func (f *Folio) addLine(db queryer, kind string, p Posting) error {
+	var original *Conversion
+	if p.Currency != "" && p.Currency != BaseCurrency {
+		c, err := Convert(db, p.Amount, p.Currency, BaseCurrency, today())
+		if err != nil {
+			return err
+		}
+		original = &Conversion{Amount: p.Amount, Currency: p.Currency, Rate: c.Rate}
+		p.Amount = c.Amount
+	}
+
+	_, err := db.Exec(
+		`INSERT INTO folio_lines(folio_id, kind, category, description, amount, original)
+		VALUES($1, $2, $3, $4, $5, $6)`,
+		f.ID, kind, p.Category, p.Description, p.Amount, original)
+	return err
+}
+
+// post records a charge, payment or refund; amounts are always sent positive
+func (f *Folio) post(db queryer, kind string, p Posting) error {
+	if p.Amount <= 0 {
+		return invalidf("Amount must be positive")
+	}
+	if p.Currency != "" {
+		var err error
+		if p.Currency, err = normaliseCurrency(p.Currency); err != nil {
+			return err
+		}
+	}
+
+	switch kind {
+	case LineCharge:
+		if f.ClosedAt != nil {
+			return ErrFolioClosed
+		}
+		if p.Category == "" {
+			return invalidf("Category is required")
+		}
+	case LinePayment:
+		p.Amount = -p.Amount
+	case LineRefund:
+	default:
+		return fmt.Errorf("unknown folio line kind %q", kind)
+	}
+
+	if err := f.addLine(db, kind, p); err != nil {
+		return err
+	}
+	if kind == LineCharge {
+		guests, err := stayGuests(db, f.StayID)
+		if err != nil {
+			return err
+		}
+		return f.syncTaxes(db, guests)
+	}
+	return nil
+}
+
+// Posts every night of the stay up to, but excluding, until that has not
+// been posted yet, priced with the room type's rate plan
+func (f *Folio) postRoomNights(db queryer, s Stay, until Date) error {
+	room := Room{ID: s.RoomID}
+	if err := room.getRoom(db); err != nil {
+		return err
+	}
+	if room.TypeID == 0 {
+		// rooms without a type have no price
+		return nil
+	}
+
+	from := Date{time.Date(s.CheckedInAt.Year(), s.CheckedInAt.Month(), s.CheckedInAt.Day(), 0, 0, 0, 0, time.UTC)}
+	if !until.After(from.Time) {
+		// same day checkout is still charged one night, unless the
+		// guest moved rooms today after nights were posted
+		var posted bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM folio_lines WHERE folio_id=$1 AND kind=$2)",
+			f.ID, LineRoom).Scan(&posted)
+		if err != nil || posted {
+			return err
+		}
+		until = from.AddDays(1)
+	}
+
+	typeID := room.TypeID
+	if s.PricedAsTypeID != 0 {
+		typeID = s.PricedAsTypeID
+	}
+	plan, err := ratePlanForType(db, typeID, s.RatePlanID)
+	if err != nil {
+		return err
+	}
+	quote, err := plan.Price(from, until, s.Guests)
+	if err != nil {
+		return err
+	}
+
+	// rates in another currency are converted at today's rate
+	fromRate, err := getRate(db, plan.Currency, today())
+	if err != nil {
+		return err
+	}
+
+	for _, n := range quote.Nights {
+		amount := n.Amount
+		var original *Conversion
+		if plan.Currency != BaseCurrency {
+			c := convertAt(n.Amount, plan.Currency, BaseCurrency, fromRate, rateScale)
+			original = &Conversion{Amount: n.Amount, Currency: plan.Currency, Rate: c.Rate}
+			amount = c.Amount
+		}
+
+		_, err := db.Exec(
+			`INSERT INTO folio_lines(folio_id, kind, category, description, amount, night, original)
+			VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (folio_id, night, category) DO NOTHING`,
+			f.ID, LineRoom, "room", fmt.Sprintf("Room %d, night of %s", room.Number, n.Date),
+			amount, n.Date, original)
+		if err != nil {
+			return err
+		}
+	}
+
+	return f.syncTaxes(db, s.Guests)
+}
+
+// stayGuests is how many guests the stay is for
+func stayGuests(db queryer, stayID int) (int, error) {
+	var guests int
+	err := db.QueryRow("SELECT guests FROM stays WHERE id=$1", stayID).Scan(&guests)
+	return guests, err
+}
+
+// taxables returns the lines taxes are computed on, for a stay of guests
+// whose ages are not known
+func (f *Folio) taxables(guests int) ([]Taxable, TaxContext) {
+	taxables := []Taxable{}
+	ctx := TaxContext{Ages: make([]int, guests)}
+	for i := range ctx.Ages {
+		ctx.Ages[i] = -1
+	}
+	for _, l := range f.Lines {
+		switch l.Kind {
+		case LineRoom:
+			ctx.Nights++
+			taxables = append(taxables, Taxable{Category: l.Category, Amount: l.Amount})
+		case LineCharge:
+			taxables = append(taxables, Taxable{Category: l.Category, Amount: l.Amount})
+		}
+	}
+	return taxables, ctx
+}
+
+// syncTaxes brings the posted taxes in line with the tax rules for
+// everything posted so far. Differences are posted as new tax lines, so
+// it is safe to run after every posting.
+func (f *Folio) syncTaxes(db queryer, guests int) error {
+	rules, err := GetAllTaxRules(db)
+	if err != nil {
+		return err
+	}
+	if err := f.getFolioLines(db); err != nil {
+		return err
+	}
+
+	posted := map[string]int64{}
+	names := []string{}
+	for _, l := range f.Lines {
+		if l.Kind == LineTax {
+			if _, ok := posted[l.Category]; !ok {
+				names = append(names, l.Category)
+			}
+			posted[l.Category] += l.Amount
+		}
+	}
+
+	expected := map[string]int64{}
+	taxables, ctx := f.taxables(guests)
+	for _, t := range ComputeTaxes(rules, taxables, ctx) {
+		if t.Inclusive {
+			continue
+		}
+		if _, ok := posted[t.Name]; !ok {
+			names = append(names, t.Name)
+			posted[t.Name] = 0
+		}
+		expected[t.Name] += t.Amount
+	}
+
+	for _, name := range names {
+		delta := expected[name] - posted[name]
+		if delta == 0 {
+			continue
+		}
+		p := Posting{Category: name, Description: name, Amount: delta}
+		if err := f.addLine(db, LineTax, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settle charges the card behind token for amount, which is in the base
+// currency, and posts what was captured as a payment. A partial approval
+// posts less than amount.
+func (f *Folio) settle(db queryer, gw PaymentGateway, token string, amount int64) (int64, error) {
+	auth, capture, err := chargeCard(gw, token, amount, BaseCurrency)
+	if auth.ID != "" {
+		if err := recordTransaction(db, auth, 0, f.ID); err != nil {
+			return 0, err
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := recordTransaction(db, capture, 0, f.ID); err != nil {
+		return 0, err
+	}
+
+	p := Posting{Category: "card", Description: "Card payment " + capture.ID, Amount: capture.Amount}
+	return capture.Amount, f.post(db, LinePayment, p)
+}
+
+// refundOverpayment gives back up to amount, in the base currency, on the
+// latest card capture of the folio and posts it as a refund
+func (f *Folio) refundOverpayment(db queryer, gw PaymentGateway, amount int64) (int64, error) {
+	var captureID string
+	var captured int64
+	err := db.QueryRow(
+		`SELECT gateway_id, amount FROM payment_transactions
+		WHERE folio_id=$1 AND kind='capture' AND currency=$2 ORDER BY id DESC LIMIT 1`,
+		f.ID, BaseCurrency).Scan(&captureID, &captured)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if amount > captured {
+		amount = captured
+	}
+
+	t, err := gw.Refund(captureID, amount)
+	if err != nil {
+		return 0, err
+	}
+	if err := recordTransaction(db, t, 0, f.ID); err != nil {
+		return 0, err
+	}
+
+	p := Posting{Category: "card", Description: "Card refund " + t.ID, Amount: t.Amount}
+	return t.Amount, f.post(db, LineRefund, p)
+}
+
+func (f *Folio) close(db queryer) error {
+	_, err := db.Exec("UPDATE folios SET closed_at=now() WHERE id=$1", f.ID)
+	return err
+}
+
+// Returns the folio of the guest's most recent stay
+func (g *Guest) getFolio(db *sql.DB) (*Folio, error) {
+	s, err := g.getLatestStay(db)
+	if err != nil {
+		return nil, err
+	}
+	return getFolioForStay(db, s.ID)
+}
+
+// getGuestFolios are the folios of all the guest's stays with their lines
+func (g *Guest) getGuestFolios(db *sql.DB) ([]Folio, error) {
+	rows, err := db.Query(
+		`SELECT f.id, f.stay_id, f.closed_at FROM folios f JOIN stays s ON s.id = f.stay_id
+		WHERE s.guest_id=$1 AND f.tenant_id = current_tenant() ORDER BY f.id`, g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	folios := []Folio{}
+
+	for rows.Next() {
+		f := Folio{Currency: BaseCurrency}
+		if err := rows.Scan(&f.ID, &f.StayID, &f.ClosedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		folios = append(folios, f)
+	}
+	rows.Close()
+
+	for i := range folios {
+		if err := folios[i].getFolioLines(db); err != nil {
+			return nil, err
+		}
+	}
+
+	return folios, nil
+}
+
+func today() Date {
+	now := time.Now().UTC()
+	return Date{time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errors every gateway maps its failures to
+var (
+	ErrPaymentDeclined = errors.New("Payment declined")
+	ErrGatewayTimeout  = errors.New("Payment gateway timed out")
+)
+
+// PaymentGateway takes payments with tokens issued by the provider. Card
+// data never reaches this service, only the tokens do.
+type PaymentGateway interface {
+	// Authorize reserves amount on the card behind token. The approved
+	// amount can be lower than requested.
+	Authorize(token string, amount int64, currency string) (Transaction, error)
+	// Capture collects up to the authorized amount, in one or more parts
+	Capture(authorizationID string, amount int64) (Transaction, error)
+	// Refund returns up to the captured amount
+	Refund(captureID string, amount int64) (Transaction, error)
+	// Void releases what is left of an authorization
+	Void(authorizationID string) (Transaction, error)
+}
+
+// Transaction is the gateway's answer to one call
+type Transaction struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// FakeGateway is a deterministic in-process gateway for tests and
+// development. The token decides the outcome:
+//
+//	tok_decline   every authorization is declined
+//	tok_timeout   every authorization times out
+//	tok_partial   only half of the amount is approved
+//
+// any other token is approved in full. Ids are numbered in call order.
+type FakeGateway struct {
+	mu    sync.Mutex
+	seq   int
+	auths map[string]*fakeAuth
+	caps  map[string]*fakeCapture
+}
+
+type fakeAuth struct {
+	amount, captured int64
+	currency         string
+	voided           bool
+}
+
+type fakeCapture struct {
+	amount, refunded int64
+	currency         string
+}
+
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{auths: map[string]*fakeAuth{}, caps: map[string]*fakeCapture{}}
+}
+
+func (g *FakeGateway) nextID(prefix string) string {
+	g.seq++
+	return fmt.Sprintf("fake_%s_%d", prefix, g.seq)
+}
+
+func (g *FakeGateway) Authorize(token string, amount int64, currency string) (Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if amount <= 0 {
+		return Transaction{}, invalidf("Amount must be positive")
+	}
+	switch {
+	case token == "":
+		return Transaction{}, invalidf("Payment token is required")
+	case strings.HasPrefix(token, "tok_decline"):
+		return Transaction{}, ErrPaymentDeclined
+	case strings.HasPrefix(token, "tok_timeout"):
+		return Transaction{}, ErrGatewayTimeout
+	case strings.HasPrefix(token, "tok_partial"):
+		amount = amount / 2
+	}
+
+	id := g.nextID("auth")
+	g.auths[id] = &fakeAuth{amount: amount, currency: currency}
+	return Transaction{ID: id, Kind: "authorize", Amount: amount, Currency: currency}, nil
+}
+
+func (g *FakeGateway) Capture(authorizationID string, amount int64) (Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	auth, ok := g.auths[authorizationID]
+	if !ok || auth.voided {
+		return Transaction{}, fmt.Errorf("unknown authorization %s", authorizationID)
+	}
+	if amount <= 0 || auth.captured+amount > auth.amount {
+		return Transaction{}, invalidf("Capture exceeds the authorized amount")
+	}
+
+	auth.captured += amount
+	id := g.nextID("capture")
+	g.caps[id] = &fakeCapture{amount: amount, currency: auth.currency}
+	return Transaction{ID: id, Kind: "capture", Amount: amount, Currency: auth.currency}, nil
+}
+
+func (g *FakeGateway) Refund(captureID string, amount int64) (Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c, ok := g.caps[captureID]
+	if !ok {
+		return Transaction{}, fmt.Errorf("unknown capture %s", captureID)
+	}
+	if amount <= 0 || c.refunded+amount > c.amount {
+		return Transaction{}, invalidf("Refund exceeds the captured amount")
+	}
+
+	c.refunded += amount
+	return Transaction{ID: g.nextID("refund"), Kind: "refund", Amount: amount, Currency: c.currency}, nil
+}
+
+func (g *FakeGateway) Void(authorizationID string) (Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	auth, ok := g.auths[authorizationID]
+	if !ok || auth.voided {
+		return Transaction{}, fmt.Errorf("unknown authorization %s", authorizationID)
+	}
+
+	auth.voided = true
+	return Transaction{ID: g.nextID("void"), Kind: "void", Amount: auth.amount - auth.captured,
+		Currency: auth.currency}, nil
+}
+
+// chargeCard authorizes and captures amount in one go, voiding the
+// authorization if the capture fails. Only what was approved is captured.
+func chargeCard(gw PaymentGateway, token string, amount int64, currency string) (auth, capture Transaction, err error) {
+	auth, err = gw.Authorize(token, amount, currency)
+	if err != nil {
+		return
+	}
+	capture, err = gw.Capture(auth.ID, auth.Amount)
+	if err != nil {
+		gw.Void(auth.ID)
+	}
+	return
+}
+
+// recordTransaction keeps the gateway's answer, with the reference of the
+// reservation or folio it belongs to
+func recordTransaction(db queryer, t Transaction, reservationID, folioID int) error {
+	_, err := db.Exec(
+		`INSERT INTO payment_transactions(gateway_id, kind, amount, currency, reservation_id, folio_id)
+		VALUES($1, $2, $3, $4, $5, $6)`,
+		t.ID, t.Kind, t.Amount, t.Currency, nullID(reservationID), nullID(folioID))
+	return err
+}
+
+// PaymentRecord is a transaction as kept in payment_transactions
+type PaymentRecord struct {
+	Transaction
+	ReservationID int       `json:"reservation_id,omitempty"`
+	FolioID       int       `json:"folio_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// getGuestPayments are the transactions of the guest's reservations and
+// folios
+func (g *Guest) getGuestPayments(db *sql.DB) ([]PaymentRecord, error) {
+	rows, err := db.Query(
+		`SELECT t.gateway_id, t.kind, t.amount, t.currency, COALESCE(t.reservation_id, 0),
+			COALESCE(t.folio_id, 0), t.created_at
+		FROM payment_transactions t
+		WHERE t.tenant_id = current_tenant() AND (
+			t.reservation_id IN (SELECT r.id FROM reservations r JOIN stays s ON s.id = r.stay_id
+				WHERE s.guest_id = $1)
+			OR t.folio_id IN (SELECT f.id FROM folios f JOIN stays s ON s.id = f.stay_id
+				WHERE s.guest_id = $1))
+		ORDER BY t.id`, g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	payments := []PaymentRecord{}
+
+	for rows.Next() {
+		var p PaymentRecord
+		if err := rows.Scan(&p.ID, &p.Kind, &p.Amount, &p.Currency, &p.ReservationID, &p.FolioID,
+			&p.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		payments = append(payments, p)
+	}
+
+	return payments, nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrGroupReleased is returned when adding to the rooming list of a group
+// whose block went back to general availability
+var ErrGroupReleased = errors.New("The group's block was released")
+
+// Group books a block of rooms for a conference or tour operator. The
+// rooms of the block are taken from availability until the release date;
+// those not on the rooming list by then are sold again.
+type Group struct {
+	ID          int          `json:"id"`
+	Name        string       `json:"name"`
+	Arrival     Date         `json:"arrival"`
+	Departure   Date         `json:"departure"`
+	ReleaseDate Date         `json:"release_date"`
+	RatePlanID  int          `json:"rate_plan_id,omitempty"`
+	Blocks      []GroupBlock `json:"blocks"`
+	ReleasedAt  *time.Time   `json:"released_at,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// GroupBlock is the number of rooms of one type a group holds. Assigned
+// counts the reservations of its rooming list.
+type GroupBlock struct {
+	RoomTypeID int `json:"room_type_id"`
+	Rooms      int `json:"rooms"`
+	Assigned   int `json:"assigned"`
+}
+
+// RoomingListEntry names a guest for a room of the block
+type RoomingListEntry struct {
+	Name       string `json:"name"`
+	RoomTypeID int    `json:"room_type_id"`
+	Guests     int    `json:"guests"`
+}
+
+// groupHoldsOn is the SQL for the rooms of type $1 that unreleased group
+// blocks hold on the night given by the date expression and have not yet
+// assigned. Assigned rooms are counted as reservations.
+func groupHoldsOn(date string) string {
+	return `(SELECT COALESCE(sum(GREATEST(b.rooms - (SELECT count(*) FROM reservations v
+			WHERE v.group_id = g.id AND v.room_type_id = b.room_type_id
+			AND v.status IN ('confirmed', 'checked_in', 'checked_out')), 0)), 0)::int
+		FROM group_blocks b JOIN group_bookings g ON g.id = b.group_id
+		WHERE b.room_type_id = $1 AND g.released_at IS NULL AND g.release_date > $4
+		AND g.arrival <= ` + date + ` AND g.departure > ` + date + `)`
+}
+
+func (g *Group) released() bool {
+	return g.ReleasedAt != nil || !today().Before(g.ReleaseDate.Time)
+}
+
+func (g *Group) hasBlock(typeID int) bool {
+	for _, b := range g.Blocks {
+		if b.RoomTypeID == typeID {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Group) getGroup(db queryer) error {
+	err := db.QueryRow(
+		`SELECT name, arrival, departure, release_date, rate_plan_id, released_at, created_at
+		FROM group_bookings WHERE id=$1`,
+		g.ID).Scan(&g.Name, &g.Arrival, &g.Departure, &g.ReleaseDate, &g.RatePlanID, &g.ReleasedAt, &g.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return g.getBlocks(db)
+}
+
+func (g *Group) getBlocks(db queryer) error {
+	rows, err := db.Query(
+		`SELECT b.room_type_id, b.rooms, (SELECT count(*) FROM reservations v
+			WHERE v.group_id = b.group_id AND v.room_type_id = b.room_type_id
+			AND v.status IN ('confirmed', 'checked_in', 'checked_out'))
+		FROM group_blocks b WHERE b.group_id=$1 ORDER BY b.room_type_id`, g.ID)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	g.Blocks = []GroupBlock{}
+
+	for rows.Next() {
+		var b GroupBlock
+		if err := rows.Scan(&b.RoomTypeID, &b.Rooms, &b.Assigned); err != nil {
+			return err
+		}
+
+		g.Blocks = append(g.Blocks, b)
+	}
+
+	return nil
+}
+
+// createGroup takes the block's rooms from availability, all of them or
+// none
+func (g *Group) createGroup(db *sql.DB) error {
+	if g.Name == "" {
+		return invalidf("Name is required")
+	}
+	if !g.Departure.After(g.Arrival.Time) {
+		return invalidf("Departure must be after arrival")
+	}
+	if g.ReleaseDate.IsZero() || g.ReleaseDate.After(g.Arrival.Time) {
+		return invalidf("Release date must be on or before arrival")
+	}
+	if len(g.Blocks) == 0 {
+		return invalidf("At least one block is required")
+	}
+
+	// lock the room types in id order like reservations do, so the
+	// rooms cannot be sold while the block is taken
+	sort.Slice(g.Blocks, func(i, j int) bool { return g.Blocks[i].RoomTypeID < g.Blocks[j].RoomTypeID })
+	for i, b := range g.Blocks {
+		if b.Rooms < 1 {
+			return invalidf("A block needs at least one room")
+		}
+		if i > 0 && g.Blocks[i-1].RoomTypeID == b.RoomTypeID {
+			return invalidf("Room type %d is given twice", b.RoomTypeID)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, b := range g.Blocks {
+		t := RoomType{ID: b.RoomTypeID}
+		if err := t.getRoomType(tx); err == sql.ErrNoRows {
+			return invalidf("Room type with ID: %d does not exist", b.RoomTypeID)
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", b.RoomTypeID); err != nil {
+			return err
+		}
+		if n, err := availableRooms(tx, b.RoomTypeID, g.Arrival, g.Departure); err != nil {
+			return err
+		} else if n < b.Rooms {
+			return ErrNoAvailability
+		}
+	}
+
+	err = tx.QueryRow(
+		`INSERT INTO group_bookings(name, arrival, departure, release_date, rate_plan_id)
+		VALUES($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		g.Name, g.Arrival, g.Departure, g.ReleaseDate, g.RatePlanID).Scan(&g.ID, &g.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for i := range g.Blocks {
+		b := &g.Blocks[i]
+		b.Assigned = 0
+		if _, err := tx.Exec("INSERT INTO group_blocks(group_id, room_type_id, rooms) VALUES($1, $2, $3)",
+			g.ID, b.RoomTypeID, b.Rooms); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// addRoomingList books a reservation in the block for every entry. The
+// group is billed as a whole, so there is no deposit.
+func (g *Group) addRoomingList(db *sql.DB, entries []RoomingListEntry) ([]Reservation, error) {
+	if err := g.getGroup(db); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, invalidf("The rooming list is empty")
+	}
+
+	// price outside of the transaction, quotes read on their own
+	reservations := make([]Reservation, len(entries))
+	for i, e := range entries {
+		if e.Name == "" {
+			return nil, invalidf("Name is required for every guest")
+		}
+		if e.RoomTypeID == 0 && len(g.Blocks) == 1 {
+			e.RoomTypeID = g.Blocks[0].RoomTypeID
+		}
+		if !g.hasBlock(e.RoomTypeID) {
+			return nil, invalidf("The group has no block of room type %d", e.RoomTypeID)
+		}
+		if e.Guests == 0 {
+			e.Guests = 1
+		}
+		ages := make([]int, e.Guests)
+		for j := range ages {
+			ages[j] = -1
+		}
+		q, err := GetQuote(db, e.RoomTypeID, g.RatePlanID, g.Arrival, g.Departure, ages, "")
+		if err != nil {
+			return nil, err
+		}
+		reservations[i] = Reservation{
+			Name: e.Name, RoomTypeID: e.RoomTypeID, RatePlanID: q.RatePlanID,
+			Arrival: g.Arrival, Departure: g.Departure, Guests: e.Guests,
+			Status: ReservationConfirmed, Currency: q.Currency, Total: q.GrandTotal, GroupID: g.ID,
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the group row serialises rooming lists and the release
+	err = tx.QueryRow("SELECT released_at FROM group_bookings WHERE id=$1 FOR UPDATE", g.ID).Scan(&g.ReleasedAt)
+	if err != nil {
+		return nil, err
+	}
+	if g.released() {
+		return nil, ErrGroupReleased
+	}
+	if err := g.getBlocks(tx); err != nil {
+		return nil, err
+	}
+
+	for i := range reservations {
+		r := &reservations[i]
+		var block *GroupBlock
+		for j := range g.Blocks {
+			if g.Blocks[j].RoomTypeID == r.RoomTypeID {
+				block = &g.Blocks[j]
+			}
+		}
+		if block.Assigned >= block.Rooms {
+			return nil, ErrNoAvailability
+		}
+		block.Assigned++
+
+		err := tx.QueryRow(
+			`INSERT INTO reservations(name, room_type_id, rate_plan_id, arrival, departure, guests,
+			status, currency, total, group_id)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, created_at`,
+			r.Name, r.RoomTypeID, r.RatePlanID, r.Arrival, r.Departure, r.Guests, r.Status,
+			r.Currency, r.Total, r.GroupID).Scan(&r.ID, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reservations, tx.Commit()
+}
+
+// getRoomingList is the group's reservations, cancelled ones included
+func (g *Group) getRoomingList(db *sql.DB) ([]Reservation, error) {
+	rows, err := db.Query("SELECT "+reservationColumns+" FROM reservations WHERE group_id=$1 ORDER BY id", g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	reservations := []Reservation{}
+
+	for rows.Next() {
+		var r Reservation
+		if err := rows.Scan(r.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		reservations = append(reservations, r)
+	}
+
+	return reservations, nil
+}
+
+func GetAllGroups(db *sql.DB) ([]Group, error) {
+	rows, err := db.Query(
+		`SELECT id, name, arrival, departure, release_date, rate_plan_id, released_at, created_at
+		FROM group_bookings ORDER BY arrival, id`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []Group{}
+
+	for rows.Next() {
+		var g Group
+		if err := rows.Scan(&g.ID, &g.Name, &g.Arrival, &g.Departure, &g.ReleaseDate, &g.RatePlanID,
+			&g.ReleasedAt, &g.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		groups = append(groups, g)
+	}
+	rows.Close()
+
+	for i := range groups {
+		if err := groups[i].getBlocks(db); err != nil {
+			return nil, err
+		}
+	}
+
+	return groups, nil
+}
+
+// ReleaseGroups marks the groups whose release date is on or before day as
+// released and offers their room types to the waitlist. Availability stops
+// counting their unassigned rooms from the release date on either way;
+// this records when it happened. It returns how many groups were released.
+func ReleaseGroups(db *sql.DB, day Date) (int, error) {
+	rows, err := db.Query(
+		`UPDATE group_bookings SET released_at=now() WHERE released_at IS NULL AND release_date <= $1
+		RETURNING id`, day)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		g := Group{ID: id}
+		if err := g.getBlocks(db); err != nil {
+			return len(ids), err
+		}
+		for _, b := range g.Blocks {
+			offerFreedRoom(db, b.RoomTypeID)
+		}
+	}
+
+	return len(ids), nil
+}
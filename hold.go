@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// hold statuses
+const (
+	HoldActive    = "active"
+	HoldConverted = "converted"
+	HoldReleased  = "released"
+	HoldExpired   = "expired"
+)
+
+// hold lifetimes, in seconds
+const (
+	defaultHoldTTL = 15 * 60
+	maxHoldTTL     = 60 * 60
+)
+
+// ErrHoldExpired is returned when booking with a hold that is no longer
+// active
+var ErrHoldExpired = errors.New("The hold has expired or was released")
+
+// Hold keeps a room of a type for the nights of a booking while the guest
+// pays. It counts against availability until it expires, is released or
+// becomes a reservation.
+type Hold struct {
+	ID            int       `json:"id"`
+	RoomTypeID    int       `json:"room_type_id"`
+	Arrival       Date      `json:"arrival"`
+	Departure     Date      `json:"departure"`
+	TTL           int       `json:"ttl_seconds,omitempty"` // only accepted on creation
+	Status        string    `json:"status"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	ReservationID int       `json:"reservation_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// an active hold past its expiry reads as expired before the job marks it
+const holdColumns = `id, room_type_id, arrival, departure,
+	CASE WHEN status = 'active' AND expires_at <= now() THEN 'expired' ELSE status END,
+	expires_at, COALESCE(reservation_id, 0), created_at`
+
+func (h *Hold) scanFields() []interface{} {
+	return []interface{}{&h.ID, &h.RoomTypeID, &h.Arrival, &h.Departure, &h.Status, &h.ExpiresAt,
+		&h.ReservationID, &h.CreatedAt}
+}
+
+// holdsOn is the SQL for the rooms of type $1 held on the night given by
+// the date expression
+func holdsOn(date string) string {
+	return `(SELECT count(*) FROM holds h WHERE h.room_type_id = $1 AND h.status = 'active'
+		AND h.expires_at > now() AND h.arrival <= ` + date + ` AND h.departure > ` + date + `)`
+}
+
+func (h *Hold) getHold(db *sql.DB) error {
+	return db.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id=$1", h.ID).Scan(h.scanFields()...)
+}
+
+// createHold takes a room of the type for TTL seconds if one is free on
+// every night
+func (h *Hold) createHold(db *sql.DB) error {
+	if h.TTL == 0 {
+		h.TTL = defaultHoldTTL
+	}
+	if h.TTL < 0 || h.TTL > maxHoldTTL {
+		return invalidf("ttl_seconds must be between 1 and %d", maxHoldTTL)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", h.RoomTypeID); err != nil {
+		return err
+	}
+	if n, err := availableRooms(tx, h.RoomTypeID, h.Arrival, h.Departure); err != nil {
+		return err
+	} else if n < 1 {
+		return ErrNoAvailability
+	}
+
+	h.Status = HoldActive
+	err = tx.QueryRow(
+		`INSERT INTO holds(room_type_id, arrival, departure, status, expires_at)
+		VALUES($1, $2, $3, $4, now() + make_interval(secs => $5)) RETURNING id, expires_at, created_at`,
+		h.RoomTypeID, h.Arrival, h.Departure, h.Status, h.TTL).Scan(&h.ID, &h.ExpiresAt, &h.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// releaseHold gives the room back before the hold expires
+func (h *Hold) releaseHold(db *sql.DB) error {
+	res, err := db.Exec("UPDATE holds SET status=$1 WHERE id=$2 AND status=$3",
+		HoldReleased, h.ID, HoldActive)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := h.getHold(db); err != nil {
+		return err
+	}
+	offerFreedRoom(db, h.RoomTypeID)
+	return nil
+}
+
+// applyHold takes the room type and dates of the reservation from its
+// hold, which must still be active
+func (r *Reservation) applyHold(db *sql.DB) error {
+	h := Hold{ID: r.HoldID}
+	if err := h.getHold(db); err == sql.ErrNoRows {
+		return invalidf("Hold with ID: %d does not exist", r.HoldID)
+	} else if err != nil {
+		return err
+	}
+	if h.Status != HoldActive {
+		return ErrHoldExpired
+	}
+
+	if r.RoomTypeID == 0 {
+		r.RoomTypeID = h.RoomTypeID
+	}
+	if r.Arrival.IsZero() && r.Departure.IsZero() {
+		r.Arrival, r.Departure = h.Arrival, h.Departure
+	}
+	if r.RoomTypeID != h.RoomTypeID || !r.Arrival.Equal(h.Arrival.Time) ||
+		!r.Departure.Equal(h.Departure.Time) {
+		return invalidf("The reservation must be for the room type and dates of hold %d", h.ID)
+	}
+	return nil
+}
+
+// claimHold converts the hold within the reservation's transaction, which
+// stops its room from being counted twice
+func claimHold(tx *sql.Tx, holdID int) error {
+	res, err := tx.Exec("UPDATE holds SET status=$1 WHERE id=$2 AND status=$3 AND expires_at > now()",
+		HoldConverted, holdID, HoldActive)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrHoldExpired
+	}
+	return nil
+}
+
+// ExpireHolds marks lapsed holds as expired and offers their rooms to the
+// waitlist. It returns how many holds expired.
+func ExpireHolds(db *sql.DB) (int, error) {
+	rows, err := db.Query(
+		"UPDATE holds SET status=$1 WHERE status=$2 AND expires_at <= now() RETURNING room_type_id",
+		HoldExpired, HoldActive)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	types := map[int]bool{}
+	for rows.Next() {
+		var typeID int
+		if err := rows.Scan(&typeID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		types[typeID] = true
+		n++
+	}
+	rows.Close()
+
+	for typeID := range types {
+		offerFreedRoom(db, typeID)
+	}
+
+	return n, nil
+}
+
+// GetActiveHolds lists the holds that still count against availability
+func GetActiveHolds(db *sql.DB) ([]Hold, error) {
+	rows, err := db.Query(
+		"SELECT "+holdColumns+" FROM holds WHERE status=$1 AND expires_at > now() ORDER BY expires_at, id",
+		HoldActive)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	holds := []Hold{}
+
+	for rows.Next() {
+		var h Hold
+		if err := rows.Scan(h.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		holds = append(holds, h)
+	}
+
+	return holds, nil
+}
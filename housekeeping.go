@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// housekeeping statuses of a room
+const (
+	HousekeepingClean        = "clean"
+	HousekeepingDirty        = "dirty"
+	HousekeepingInspected    = "inspected"
+	HousekeepingOutOfOrder   = "out_of_order"   // under repair, cannot be sold
+	HousekeepingOutOfService = "out_of_service" // held back for a while, not sold either
+)
+
+// board order
+var housekeepingStatuses = []string{
+	HousekeepingDirty, HousekeepingClean, HousekeepingInspected,
+	HousekeepingOutOfService, HousekeepingOutOfOrder,
+}
+
+// statuses a room can be set to from each status. Rooms taken out of
+// order or service are dirty when they come back.
+var housekeepingTransitions = map[string][]string{
+	HousekeepingClean:        {HousekeepingDirty, HousekeepingInspected, HousekeepingOutOfOrder, HousekeepingOutOfService},
+	HousekeepingDirty:        {HousekeepingClean, HousekeepingOutOfOrder, HousekeepingOutOfService},
+	HousekeepingInspected:    {HousekeepingDirty, HousekeepingOutOfOrder, HousekeepingOutOfService},
+	HousekeepingOutOfOrder:   {HousekeepingDirty, HousekeepingOutOfService},
+	HousekeepingOutOfService: {HousekeepingDirty, HousekeepingOutOfOrder},
+}
+
+// HousekeepingUpdate is the body of PUT /room/{id}/housekeeping
+type HousekeepingUpdate struct {
+	Status string `json:"status"`
+}
+
+// HousekeepingAssignment is the body of POST /housekeeping/assign. An
+// empty housekeeper unassigns the rooms.
+type HousekeepingAssignment struct {
+	Housekeeper string `json:"housekeeper"`
+	RoomIDs     []int  `json:"room_ids"`
+}
+
+// BoardRoom is a room on the housekeeping board
+type BoardRoom struct {
+	ID          int    `json:"id"`
+	Number      int    `json:"number"`
+	Housekeeper string `json:"housekeeper,omitempty"`
+	Occupied    bool   `json:"occupied"`
+}
+
+// BoardGroup holds the rooms of one floor in one status. Floor is not set
+// for rooms without features.
+type BoardGroup struct {
+	Status string      `json:"status"`
+	Floor  *int        `json:"floor,omitempty"`
+	Rooms  []BoardRoom `json:"rooms"`
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range housekeepingTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setHousekeeping moves the room to status if allowed from its current
+// one. Inspection finishes the housekeeper's work on the room.
+func (r *Room) setHousekeeping(db *sql.DB, status string) error {
+	if _, ok := housekeepingTransitions[status]; !ok {
+		return invalidf("Unknown housekeeping status '%s'", status)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow("SELECT housekeeping_status FROM rooms WHERE id=$1 FOR UPDATE", r.ID).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current != status && !canTransition(current, status) {
+		return invalidf("Room cannot go from %s to %s", current, status)
+	}
+
+	query := "UPDATE rooms SET housekeeping_status=$1 WHERE id=$2"
+	if status == HousekeepingInspected {
+		query = "UPDATE rooms SET housekeeping_status=$1, housekeeper='' WHERE id=$2"
+	}
+	if _, err := tx.Exec(query, status, r.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return r.getRoom(db)
+}
+
+// roomSellableOn is the SQL condition for room r being sellable on the
+// night given by the date expression: in order, in service and not blocked
+func roomSellableOn(date string) string {
+	return "r.housekeeping_status NOT IN ('" + HousekeepingOutOfOrder + "', '" + HousekeepingOutOfService +
+		"') AND NOT " + roomBlockedOn(date)
+}
+
+// markDirty is the transition after a guest leaves a room. Rooms out of
+// order or service keep their status.
+func markDirty(db queryer, roomID int) error {
+	_, err := db.Exec(
+		"UPDATE rooms SET housekeeping_status=$1 WHERE id=$2 AND housekeeping_status IN ($3, $4)",
+		HousekeepingDirty, roomID, HousekeepingClean, HousekeepingInspected)
+	return err
+}
+
+// markOccupied is the transition when a guest moves into a room. An
+// inspected room is ready for the next arrival, so once taken it is only
+// clean.
+func markOccupied(db queryer, roomID int) error {
+	_, err := db.Exec(
+		"UPDATE rooms SET housekeeping_status=$1 WHERE id=$2 AND housekeeping_status=$3",
+		HousekeepingClean, roomID, HousekeepingInspected)
+	return err
+}
+
+// AssignHousekeeper gives the rooms to a housekeeper, all or none
+func AssignHousekeeper(db *sql.DB, a HousekeepingAssignment) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range a.RoomIDs {
+		res, err := tx.Exec("UPDATE rooms SET housekeeper=$1 WHERE id=$2", a.Housekeeper, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return invalidf("Room with ID: %d does not exist", id)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetHousekeepingBoard lists the rooms by status and floor, optionally
+// only one status or one housekeeper's rooms
+func GetHousekeepingBoard(db *sql.DB, status, housekeeper string) ([]BoardGroup, error) {
+	rows, err := db.Query(
+		`SELECT r.id, r.number, r.housekeeping_status, r.housekeeper,
+		(COALESCE(r.features, t.features)->>'floor')::int,
+		EXISTS(SELECT 1 FROM stays s WHERE s.room_id = r.id AND s.checked_out_at IS NULL)
+		FROM rooms r LEFT JOIN room_types t ON t.id = r.room_type_id
+		WHERE ($1 = '' OR r.housekeeping_status = $1) AND ($2 = '' OR r.housekeeper = $2)
+		ORDER BY 5 NULLS LAST, r.number`, status, housekeeper)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	byStatus := map[string][]*BoardGroup{}
+
+	for rows.Next() {
+		var room BoardRoom
+		var roomStatus string
+		var floor sql.NullInt64
+		if err := rows.Scan(&room.ID, &room.Number, &roomStatus, &room.Housekeeper, &floor,
+			&room.Occupied); err != nil {
+			return nil, err
+		}
+
+		// rows come sorted by floor, so a new floor starts a new group
+		groups := byStatus[roomStatus]
+		var g *BoardGroup
+		if n := len(groups); n > 0 && sameFloor(groups[n-1].Floor, floor) {
+			g = groups[n-1]
+		} else {
+			g = &BoardGroup{Status: roomStatus, Rooms: []BoardRoom{}}
+			if floor.Valid {
+				f := int(floor.Int64)
+				g.Floor = &f
+			}
+			byStatus[roomStatus] = append(groups, g)
+		}
+		g.Rooms = append(g.Rooms, room)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	board := []BoardGroup{}
+	for _, s := range housekeepingStatuses {
+		for _, g := range byStatus[s] {
+			board = append(board, *g)
+		}
+	}
+
+	return board, nil
+}
+
+func sameFloor(a *int, b sql.NullInt64) bool {
+	if a == nil || !b.Valid {
+		return a == nil && !b.Valid
+	}
+	return int64(*a) == b.Int64
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportResult reports what an import did, or would do on a dry run. Rows
+// are numbered as in the file, the header being row 1.
+type ImportResult struct {
+	DryRun  bool       `json:"dry_run"`
+	Rows    int        `json:"rows"`
+	Created int        `json:"created"`
+	Updated int        `json:"updated"`
+	Errors  []RowError `json:"errors"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type RowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// importRow is a data row of a sheet with its values by column name
+type importRow struct {
+	number int
+	values map[string]string
+}
+
+func (r importRow) has(column string) bool {
+	_, ok := r.values[column]
+	return ok
+}
+
+func (r importRow) get(column string) string {
+	return strings.TrimSpace(r.values[column])
+}
+
+func (r importRow) getInt(column string) (int, error) {
+	v := r.get(column)
+	if v == "" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		return n, nil
+	}
+	// spreadsheets store numbers as floats
+	if f, err := strconv.ParseFloat(v, 64); err == nil && f == math.Trunc(f) {
+		return int(f), nil
+	}
+	return 0, invalidf("%s must be a whole number, not '%s'", column, v)
+}
+
+func (r importRow) getBool(column string) (bool, error) {
+	switch strings.ToLower(r.get(column)) {
+	case "", "0", "false", "no", "n":
+		return false, nil
+	case "1", "true", "yes", "y":
+		return true, nil
+	}
+	return false, invalidf("%s must be true or false, not '%s'", column, r.get(column))
+}
+
+// getDate takes YYYY-MM-DD, or the serial day number spreadsheets store
+// dates as
+func (r importRow) getDate(column string) (*Date, error) {
+	v := r.get(column)
+	if v == "" {
+		return nil, nil
+	}
+	if d, err := ParseDate(v); err == nil {
+		return &d, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		d := Date{time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)}.AddDays(n)
+		return &d, nil
+	}
+	return nil, invalidf("Invalid %s '%s', expected YYYY-MM-DD", column, v)
+}
+
+// getList splits a cell of values separated by semicolons
+func (r importRow) getList(column string) []string {
+	list := []string{}
+	for _, v := range strings.Split(r.get(column), ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// importRows maps the data rows of a sheet to the header's column names,
+// which must include the required ones and may only name known columns
+func importRows(records [][]string, known []string, required ...string) ([]importRow, error) {
+	if len(records) == 0 {
+		return nil, invalidf("The file is empty")
+	}
+	header := make([]string, len(records[0]))
+	seen := map[string]bool{}
+	for i, h := range records[0] {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			// cells left of the data or formatted but empty
+			continue
+		}
+		if !contains(known, h) {
+			return nil, invalidf("Unknown column '%s', expected some of %s", h, strings.Join(known, ", "))
+		}
+		if seen[h] {
+			return nil, invalidf("Column '%s' is given twice", h)
+		}
+		header[i], seen[h] = h, true
+	}
+	for _, c := range required {
+		if !seen[c] {
+			return nil, invalidf("Column '%s' is required", c)
+		}
+	}
+
+	rows := []importRow{}
+	for i, rec := range records[1:] {
+		row := importRow{number: i + 2, values: map[string]string{}}
+		blank := true
+		for j, h := range header {
+			if h == "" {
+				continue
+			}
+			if j < len(rec) {
+				row.values[h] = rec[j]
+				blank = blank && strings.TrimSpace(rec[j]) == ""
+			} else {
+				row.values[h] = ""
+			}
+		}
+		if !blank {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runImport applies every row in one transaction. Rows that fail
+// validation are reported; the transaction is committed only if there are
+// none and this is not a dry run.
+func runImport(db *sql.DB, rows []importRow, dryRun bool,
+	apply func(tx *sql.Tx, row importRow) (created bool, err error)) (*ImportResult, error) {
+
+	result := &ImportResult{DryRun: dryRun, Rows: len(rows), Errors: []RowError{}}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, row := range rows {
+		created, err := apply(tx, row)
+		if _, invalid := err.(invalidError); invalid {
+			result.Errors = append(result.Errors, RowError{Row: row.number, Error: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", row.number, err)
+		}
+		if created {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+
+	if len(result.Errors) > 0 {
+		result.Error = fmt.Sprintf("%d of %d rows are invalid", len(result.Errors), len(rows))
+		if !dryRun {
+			result.Created, result.Updated = 0, 0
+		}
+		return result, nil
+	}
+	if dryRun {
+		return result, nil
+	}
+	return result, tx.Commit()
+}
+
+var roomImportColumns = []string{"number", "property_id", "room_type_id", "beds", "params", "floor", "view",
+	"bed_configuration", "accessible", "smoking", "amenities"}
+
+// ImportRooms creates the rooms of the sheet, or updates the room with the
+// same number in the property. Columns left out keep their values.
+func ImportRooms(db *sql.DB, records [][]string, dryRun bool) (*ImportResult, error) {
+	rows, err := importRows(records, roomImportColumns, "number")
+	if err != nil {
+		return nil, err
+	}
+	return runImport(db, rows, dryRun, importRoom)
+}
+
+func importRoom(tx *sql.Tx, row importRow) (bool, error) {
+	var room Room
+	var err error
+	if room.Number, err = row.getInt("number"); err != nil {
+		return false, err
+	}
+	if room.Number <= 0 {
+		return false, invalidf("Number is required")
+	}
+	if room.PropertyID, err = row.getInt("property_id"); err != nil {
+		return false, err
+	}
+	if room.PropertyID == 0 {
+		if room.PropertyID, err = defaultPropertyID(tx); err != nil {
+			return false, err
+		}
+	}
+
+	err = tx.QueryRow("SELECT id FROM rooms WHERE property_id=$1 AND number=$2 AND tenant_id = current_tenant()",
+		room.PropertyID, room.Number).Scan(&room.ID)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	created := err == sql.ErrNoRows
+	if !created {
+		if err := room.getRoom(tx); err != nil {
+			return false, err
+		}
+	}
+
+	if row.has("room_type_id") {
+		if room.TypeID, err = row.getInt("room_type_id"); err != nil {
+			return false, err
+		}
+	}
+	if row.has("beds") {
+		if room.Beds, err = row.getInt("beds"); err != nil {
+			return false, err
+		}
+	}
+	if row.has("params") {
+		room.Parameters = row.get("params")
+	}
+
+	featureColumns := false
+	for _, c := range []string{"floor", "view", "bed_configuration", "accessible", "smoking", "amenities"} {
+		featureColumns = featureColumns || row.has(c)
+	}
+	if featureColumns {
+		f := RoomFeatures{}
+		if room.Features != nil {
+			f = *room.Features
+		}
+		if row.has("floor") {
+			if f.Floor, err = row.getInt("floor"); err != nil {
+				return false, err
+			}
+		}
+		if row.has("view") {
+			f.View = row.get("view")
+		}
+		if row.has("bed_configuration") {
+			f.BedConfiguration = row.get("bed_configuration")
+		}
+		if row.has("accessible") {
+			if f.Accessible, err = row.getBool("accessible"); err != nil {
+				return false, err
+			}
+		}
+		if row.has("smoking") {
+			if f.Smoking, err = row.getBool("smoking"); err != nil {
+				return false, err
+			}
+		}
+		if row.has("amenities") {
+			f.Amenities = row.getList("amenities")
+		}
+		room.Features = &f
+		if !row.has("params") {
+			// derived again from the new features
+			room.Parameters = ""
+		}
+	}
+
+	if created {
+		return true, room.createRoom(tx)
+	}
+	return false, room.updateRoom(tx)
+}
+
+var guestImportColumns = []string{"name", "passport", "email", "phone", "nationality", "date_of_birth",
+	"preferences"}
+
+// ImportGuests creates the guest profiles of the sheet. A guest whose
+// passport is known is updated, keeping what the row leaves empty.
+func ImportGuests(db *sql.DB, kr *Keyring, records [][]string, dryRun bool) (*ImportResult, error) {
+	rows, err := importRows(records, guestImportColumns, "name", "passport")
+	if err != nil {
+		return nil, err
+	}
+	return runImport(db, rows, dryRun, func(tx *sql.Tx, row importRow) (bool, error) {
+		return importGuest(tx, kr, row)
+	})
+}
+
+func importGuest(tx *sql.Tx, kr *Keyring, row importRow) (bool, error) {
+	g := Guest{
+		Name: row.get("name"), Passport: row.get("passport"), Email: row.get("email"),
+		Phone: row.get("phone"), Nationality: row.get("nationality"), Preferences: row.getList("preferences"),
+	}
+	if g.Passport == "" {
+		return false, invalidf("Passport is required")
+	}
+	var err error
+	if g.DateOfBirth, err = row.getDate("date_of_birth"); err != nil {
+		return false, err
+	}
+	if err := g.validateProfile(); err != nil {
+		return false, err
+	}
+
+	known := Guest{Passport: g.Passport}
+	err = known.getGuestByPassport(tx, kr)
+	if err == sql.ErrNoRows {
+		return true, g.insertProfile(tx, kr)
+	}
+	if err != nil {
+		return false, err
+	}
+	g.ID = known.ID
+	g.mergeProfile(known)
+	return false, g.saveProfile(tx, kr)
+}
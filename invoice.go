@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrFolioOpen is returned when invoicing a stay that is not checked out
+var ErrFolioOpen = errors.New("Invoices are issued after checkout")
+
+// Invoice is issued once per folio and stored as issued, so later
+// changes to the guest or the rates never alter it
+type Invoice struct {
+	Number     int           `json:"number"`
+	IssuedAt   time.Time     `json:"issued_at"`
+	GuestID    int           `json:"guest_id"`
+	GuestName  string        `json:"guest_name"`
+	StayID     int           `json:"stay_id"`
+	Currency   string        `json:"currency"`
+	Lines      []InvoiceLine `json:"lines"`
+	Taxes      []TaxAmount   `json:"taxes"`
+	Net        int64         `json:"net"`
+	Total      int64         `json:"total"`
+	Paid       int64         `json:"paid"`
+	BalanceDue int64         `json:"balance_due"`
+}
+
+type InvoiceLine struct {
+	Date        Date   `json:"date"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+	Amount      int64  `json:"amount"`
+}
+
+// Returns the invoice of the guest's latest stay, issuing it with the next
+// invoice number the first time it is requested
+func (g *Guest) getInvoice(db *sql.DB) (*Invoice, error) {
+	f, err := g.getFolio(db)
+	if err != nil {
+		return nil, err
+	}
+	if f.ClosedAt == nil {
+		return nil, ErrFolioOpen
+	}
+
+	if inv, err := getInvoiceForFolio(db, f.ID); err != sql.ErrNoRows {
+		return inv, err
+	}
+
+	if err := f.getFolioLines(db); err != nil {
+		return nil, err
+	}
+	inv := &Invoice{GuestID: g.ID, StayID: f.StayID, Currency: f.Currency, IssuedAt: time.Now().UTC()}
+	if err := db.QueryRow("SELECT name FROM guests WHERE id=$1", g.ID).Scan(&inv.GuestName); err != nil {
+		return nil, err
+	}
+	rules, err := GetAllTaxRules(db)
+	if err != nil {
+		return nil, err
+	}
+	guests, err := stayGuests(db, f.StayID)
+	if err != nil {
+		return nil, err
+	}
+	inv.fill(f, rules, guests)
+
+	err = issueInvoice(db, f.ID, inv)
+	if err == errInvoiceExists {
+		// issued concurrently, return that one
+		return getInvoiceForFolio(db, f.ID)
+	}
+	return inv, err
+}
+
+func getInvoiceForFolio(db *sql.DB, folioID int) (*Invoice, error) {
+	var data []byte
+	err := db.QueryRow("SELECT data FROM invoices WHERE folio_id=$1", folioID).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	inv := &Invoice{}
+	return inv, json.Unmarshal(data, inv)
+}
+
+// getGuestInvoices are the invoices issued to the guest, oldest first
+func (g *Guest) getGuestInvoices(db *sql.DB) ([]Invoice, error) {
+	rows, err := db.Query(
+		"SELECT data FROM invoices WHERE guest_id=$1 AND tenant_id = current_tenant() ORDER BY number", g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	invoices := []Invoice{}
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var inv Invoice
+		if err := json.Unmarshal(data, &inv); err != nil {
+			return nil, err
+		}
+
+		invoices = append(invoices, inv)
+	}
+
+	return invoices, nil
+}
+
+var errInvoiceExists = errors.New("invoice already issued")
+
+// Takes the tenant's next number and stores the invoice in one transaction.
+// The counter row stays locked until commit and is rolled back with a failed
+// insert, so numbers have no gaps.
+func issueInvoice(db *sql.DB, folioID int, inv *Invoice) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`INSERT INTO invoice_counter(last_number) VALUES(1)
+		ON CONFLICT (tenant_id) DO UPDATE SET last_number = invoice_counter.last_number + 1
+		RETURNING last_number`,
+	).Scan(&inv.Number)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO invoices(number, folio_id, guest_id, issued_at, data)
+		VALUES($1, $2, $3, $4, $5) ON CONFLICT (folio_id) DO NOTHING`,
+		inv.Number, folioID, inv.GuestID, inv.IssuedAt, data)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvoiceExists
+	}
+
+	return tx.Commit()
+}
+
+// fill builds the line items and totals from the folio. Posted taxes
+// are taken from the folio, taxes included in the prices are broken out.
+func (inv *Invoice) fill(f *Folio, rules []TaxRule, guests int) {
+	inv.Lines = []InvoiceLine{}
+	inv.Taxes = []TaxAmount{}
+	posted := map[string]int64{}
+	names := []string{}
+
+	for _, l := range f.Lines {
+		switch l.Kind {
+		case LineRoom, LineCharge:
+			date := Date{l.CreatedAt}
+			if l.Night != nil {
+				date = *l.Night
+			}
+			inv.Lines = append(inv.Lines, InvoiceLine{
+				Date: date, Category: l.Category, Description: l.Description, Amount: l.Amount,
+			})
+			inv.Total += l.Amount
+		case LineTax:
+			if _, ok := posted[l.Category]; !ok {
+				names = append(names, l.Category)
+			}
+			posted[l.Category] += l.Amount
+			inv.Total += l.Amount
+		case LinePayment, LineRefund:
+			inv.Paid -= l.Amount
+		}
+	}
+
+	var tax int64
+	taxables, ctx := f.taxables(guests)
+	for _, t := range ComputeTaxes(rules, taxables, ctx) {
+		if t.Inclusive {
+			inv.Taxes = append(inv.Taxes, t)
+			tax += t.Amount
+		}
+	}
+	for _, name := range names {
+		if posted[name] != 0 {
+			inv.Taxes = append(inv.Taxes, TaxAmount{Name: name, Amount: posted[name]})
+			tax += posted[name]
+		}
+	}
+
+	inv.Net = inv.Total - tax
+	inv.BalanceDue = inv.Total - inv.Paid
+}
+
+// PDF renders the invoice as a printable document
+func (inv *Invoice) PDF() []byte {
+	lines := []string{
+		fmt.Sprintf("INVOICE %d", inv.Number),
+		"",
+		fmt.Sprintf("Issued:  %s", inv.IssuedAt.Format("2006-01-02")),
+		fmt.Sprintf("Guest:   %s (#%d)", inv.GuestName, inv.GuestID),
+		fmt.Sprintf("Stay:    #%d", inv.StayID),
+		fmt.Sprintf("Amounts in %s", inv.Currency),
+		"",
+		fmt.Sprintf("%-10s  %-10s  %-38s %12s", "Date", "Category", "Description", "Amount"),
+		strings.Repeat("-", 74),
+	}
+	for _, l := range inv.Lines {
+		lines = append(lines, fmt.Sprintf("%-10s  %-10.10s  %-38.38s %12s",
+			l.Date, l.Category, l.Description, formatMinor(l.Amount)))
+	}
+	lines = append(lines, strings.Repeat("-", 74))
+	lines = append(lines, fmt.Sprintf("%-62s %12s", "Net", formatMinor(inv.Net)))
+	for _, t := range inv.Taxes {
+		name := t.Name
+		if t.Inclusive {
+			name += " (included)"
+		}
+		lines = append(lines, fmt.Sprintf("%-62s %12s", name, formatMinor(t.Amount)))
+	}
+	lines = append(lines,
+		fmt.Sprintf("%-62s %12s", "Total", formatMinor(inv.Total)),
+		fmt.Sprintf("%-62s %12s", "Paid", formatMinor(inv.Paid)),
+		fmt.Sprintf("%-62s %12s", "Balance due", formatMinor(inv.BalanceDue)))
+
+	return renderTextPDF(lines)
+}
+
+// formatMinor prints an amount in minor units with two decimals
+func formatMinor(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
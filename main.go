@@ -1,6 +1,13 @@
 package main
 
-import "os"
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
 
 func main() {
 	a := App{}
@@ -8,7 +15,167 @@ func main() {
 		os.Getenv("APP_DB_USERNAME"),
 		os.Getenv("APP_DB_PASSWORD"),
 		os.Getenv("APP_DB_NAME"))
+	a.RetentionDays, _ = strconv.Atoi(os.Getenv("APP_RETENTION_DAYS"))
+	a.DefaultTenant, _ = strconv.Atoi(os.Getenv("APP_DEFAULT_TENANT"))
+	if c := os.Getenv("APP_CURRENCY"); c != "" {
+		BaseCurrency = c
+	}
+	if h, _ := strconv.Atoi(os.Getenv("APP_WAITLIST_OFFER_HOURS")); h > 0 {
+		WaitlistOfferTTL = time.Duration(h) * time.Hour
+	}
+
+	var err error
+	a.Keys, err = LoadKeyring(os.Getenv("APP_KEYFILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch g := os.Getenv("APP_PAYMENT_GATEWAY"); g {
+	case "", "fake":
+		a.Gateway = NewFakeGateway()
+	default:
+		log.Fatalf("unknown payment gateway %q", g)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-keys":
+			rotateKeys(&a, os.Args[2:])
+			return
+		case "migrate-passports":
+			migratePassports(&a, os.Args[2:])
+			return
+		case "create-tenant":
+			createTenant(&a, os.Args[2:])
+			return
+		case "create-api-key":
+			createAPIKey(&a, os.Args[2:])
+			return
+		case "night-audit":
+			nightAudit(&a, os.Args[2:])
+			return
+		}
+	}
 
 	a.Run(":8080")
 
 }
+
+// rewraps passport data keys after a new current key was added to the keyfile
+func rotateKeys(a *App, args []string) {
+	fs := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	batch := fs.Int("batch", 500, "rows re-encrypted per transaction")
+	fs.Parse(args)
+
+	ids, err := tenantIDs(a.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, id := range ids {
+		db, release, err := a.tenantDB(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := RotatePassportKeys(db, a.Keys, *batch)
+		release()
+		if err != nil {
+			log.Fatalf("tenant %d: rotated %d rows before error: %v", id, n, err)
+		}
+		log.Printf("tenant %d: rotated %d rows to key %q", id, n, a.Keys.CurrentKeyID())
+	}
+}
+
+// encrypts the passports of a database created before they were encrypted
+func migratePassports(a *App, args []string) {
+	fs := flag.NewFlagSet("migrate-passports", flag.ExitOnError)
+	batch := fs.Int("batch", 500, "rows encrypted per transaction")
+	fs.Parse(args)
+
+	ids, err := tenantIDs(a.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, id := range ids {
+		db, release, err := a.tenantDB(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := MigratePassports(db, a.Keys, *batch)
+		release()
+		if err != nil {
+			log.Fatalf("tenant %d: encrypted %d passports before error: %v", id, n, err)
+		}
+		log.Printf("tenant %d: encrypted %d passports", id, n)
+	}
+	if err := FinishPassportMigration(a.DB); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// adds a tenant and prints its first API key
+func createTenant(a *App, args []string) {
+	fs := flag.NewFlagSet("create-tenant", flag.ExitOnError)
+	name := fs.String("name", "", "name of the hotelier")
+	fs.Parse(args)
+
+	t, err := a.CreateTenant(*name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	key, err := CreateAPIKey(a.DB, t.ID, "initial")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("tenant %d\napi key %s\n", t.ID, key)
+}
+
+// prints a new API key for an existing tenant
+func createAPIKey(a *App, args []string) {
+	fs := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	tenant := fs.Int("tenant", FirstTenantID, "tenant the key acts for")
+	name := fs.String("name", "", "what the key is used by")
+	fs.Parse(args)
+
+	key, err := CreateAPIKey(a.DB, *tenant, *name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(key)
+}
+
+// closes the business date of one tenant, or of every tenant
+func nightAudit(a *App, args []string) {
+	fs := flag.NewFlagSet("night-audit", flag.ExitOnError)
+	tenant := fs.Int("tenant", 0, "tenant to audit, all by default")
+	date := fs.String("date", "", "business date to close, the current one by default")
+	fs.Parse(args)
+
+	var day Date
+	if *date != "" {
+		var err error
+		if day, err = ParseDate(*date); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ids := []int{*tenant}
+	if *tenant == 0 {
+		var err error
+		if ids, err = tenantIDs(a.DB); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, id := range ids {
+		db, release, err := a.tenantDB(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := RunNightAudit(db, a.Gateway, day)
+		release()
+		if err != nil {
+			log.Fatalf("tenant %d: %v", id, err)
+		}
+		log.Printf("tenant %d: closed %s, %d stays charged, %d no-shows", id, n.BusinessDate,
+			n.RoomCharges, n.NoShows)
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var a App
@@ -18,9 +23,27 @@ func TestMain(m *testing.M) {
 		os.Getenv("TEST_DB_USERNAME"),
 		os.Getenv("TEST_DB_PASSWORD"),
 		os.Getenv("TEST_DB_NAME"))
+	a.Keys = newTestKeyring()
+	a.Gateway = NewFakeGateway()
+	a.DefaultTenant = FirstTenantID
 
+	ensureTableExistsTenants()
 	ensureTableExistsGuests()
+	ensureTableExistsGuestDocuments()
 	ensureTableExistsRooms()
+	ensureTableExistsStays()
+	ensureTableExistsGuestAudit()
+	ensureTableExistsRoomTypes()
+	ensureTableExistsRatePlans()
+	ensureTableExistsFolios()
+	ensureTableExistsInvoices()
+	ensureTableExistsTaxRules()
+	ensureTableExistsExchangeRates()
+	ensureTableExistsReservations()
+	ensureTableExistsMaintenance()
+	ensureTableExistsNightAudits()
+	ensureTableExistsProperties()
+	ensureRowLevelSecurity()
 
 	code := m.Run()
 
@@ -352,6 +375,2385 @@ func TestGetAllRoomsWithGuests(t *testing.T) {
 
 }
 
+func TestCheckoutFreesRoom(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+	addGuest()
+
+	req, _ := http.NewRequest("POST", "/guest/1/checkout", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	payload := []byte(`{"name":"Sara", "passport":"9985DF", "room_id":1}`)
+
+	req, _ = http.NewRequest("POST", "/guest", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+}
+
+func TestExportGuest(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+	addGuest()
+
+	payload := []byte(`{"category":"minibar", "description":"2 x water", "amount":600}`)
+	req, _ := http.NewRequest("POST", "/guest/1/charges", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/1/export", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var e GuestExport
+	json.Unmarshal(response.Body.Bytes(), &e)
+
+	if e.Profile.Passport != "ZZ178567" {
+		t.Errorf("Expected passport to be 'ZZ178567'. Got '%v'", e.Profile.Passport)
+	}
+
+	if len(e.Stays) != 1 {
+		t.Errorf("Expected 1 stay. Got %d", len(e.Stays))
+	}
+
+	if len(e.Folios) != 1 || len(e.Folios[0].Lines) == 0 {
+		t.Errorf("Expected the folio with its lines. Got %v", e.Folios)
+	}
+
+	if len(e.Audit) == 0 || e.Audit[len(e.Audit)-1].Action != "export" {
+		t.Errorf("Expected the export to be audited. Got %v", e.Audit)
+	}
+}
+
+func TestEraseGuest(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+	addGuest()
+
+	req, _ := http.NewRequest("POST", "/guest/1/erase", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["name"] == "John" || m["passport"] == "ZZ178567" {
+		t.Errorf("Expected personal fields to be pseudonymised. Got '%v' / '%v'", m["name"], m["passport"])
+	}
+
+	req, _ = http.NewRequest("GET", "/guest/1/export", nil)
+	response = executeRequest(req)
+
+	var e GuestExport
+	json.Unmarshal(response.Body.Bytes(), &e)
+
+	if len(e.Stays) != 1 {
+		t.Errorf("Expected the stay to be kept after erasure. Got %d stays", len(e.Stays))
+	}
+
+	req, _ = http.NewRequest("POST", "/guest/1/erase", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// tables that may hold a guest's personal data, each checked for the name
+// after erasure
+var guestDataTables = []string{"guests", "guest_documents", "invoices", "reservations", "waitlist"}
+
+func TestEraseGuestEverywhere(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableInvoices()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+	addGuest()
+
+	// the guest arrived with a reservation and its deposit
+	a.DB.Exec(`INSERT INTO reservations(name, room_type_id, arrival, departure, guests, status, currency,
+		total, deposit, stay_id) VALUES('John', 1, current_date, current_date + 1, 1, $1, 'EUR', 12000, 12000, 1)`,
+		ReservationCheckedIn)
+	a.DB.Exec(`INSERT INTO payment_transactions(gateway_id, kind, amount, currency, reservation_id)
+		VALUES('cap_1', 'capture', 12000, 'EUR', 1)`)
+	a.DB.Exec("UPDATE guests SET email='john@example.com' WHERE id=1")
+	a.DB.Exec(`INSERT INTO waitlist(name, email, room_type_id, arrival, departure, guests, status)
+		VALUES('John', 'john@example.com', 1, current_date + 30, current_date + 32, 1, 'waiting')`)
+
+	payload := []byte(`{"override":{"manager":"Ann", "reason":"invoice to company"}}`)
+	req, _ := http.NewRequest("POST", "/guest/1/checkout", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/1/invoice", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/1/export", nil)
+	response = executeRequest(req)
+
+	var e GuestExport
+	json.Unmarshal(response.Body.Bytes(), &e)
+
+	if len(e.Invoices) != 1 || e.Invoices[0].GuestName != "John" {
+		t.Errorf("Expected the invoice in the export. Got %v", e.Invoices)
+	}
+	if len(e.Waitlist) != 1 {
+		t.Errorf("Expected the waitlist entry in the export. Got %v", e.Waitlist)
+	}
+	if len(e.Reservations) != 1 || len(e.Payments) != 1 {
+		t.Errorf("Expected the reservation and its payment in the export. Got %v, %v", e.Reservations, e.Payments)
+	}
+
+	req, _ = http.NewRequest("POST", "/guest/1/erase", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	for _, table := range guestDataTables {
+		var n int
+		a.DB.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s t WHERE t::text LIKE '%%John%%'", table)).Scan(&n)
+		if n != 0 {
+			t.Errorf("Expected the name to be erased from %s. Found %d rows", table, n)
+		}
+	}
+}
+
+func TestAnonymiseExpiredGuests(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+	addGuest()
+
+	p, _ := a.Keys.Seal("9985DF")
+	a.DB.Exec(`INSERT INTO guests(name, passport_hash, passport_enc, passport_dek, passport_key_id)
+		VALUES($1, $2, $3, $4, $5)`,
+		"Sara", a.Keys.Hash("9985DF"), p.Ciphertext, p.WrappedKey, p.KeyID)
+	a.DB.Exec("INSERT INTO stays(guest_id, room_id) VALUES($1, $2)", 2, 1)
+
+	// John left past the retention window, Sara inside it
+	a.DB.Exec(`UPDATE stays SET checked_in_at = now() - interval '405 days',
+		checked_out_at = now() - interval '400 days' WHERE guest_id=1`)
+	a.DB.Exec(`UPDATE stays SET checked_in_at = now() - interval '15 days',
+		checked_out_at = now() - interval '10 days' WHERE guest_id=2`)
+
+	n, err := AnonymiseExpiredGuests(a.DB, a.Keys, 365)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 guest anonymised. Got %d, %v", n, err)
+	}
+
+	john := Guest{ID: 1}
+	sara := Guest{ID: 2}
+	john.getGuest(a.DB, a.Keys)
+	sara.getGuest(a.DB, a.Keys)
+	if john.Name == "John" || john.Passport == "ZZ178567" {
+		t.Errorf("Expected John to be anonymised. Got '%v' / '%v'", john.Name, john.Passport)
+	}
+	if sara.Name != "Sara" || sara.Passport != "9985DF" {
+		t.Errorf("Expected Sara to be kept. Got '%v' / '%v'", sara.Name, sara.Passport)
+	}
+
+	if n, err := AnonymiseExpiredGuests(a.DB, a.Keys, 365); err != nil || n != 0 {
+		t.Errorf("Expected erased guests to be skipped. Got %d, %v", n, err)
+	}
+}
+
+func TestGetGuestByPassport(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+	addGuest()
+
+	req, _ := http.NewRequest("GET", "/guests?passport=ZZ178567", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var guests []Guest
+	json.Unmarshal(response.Body.Bytes(), &guests)
+
+	if len(guests) != 1 || guests[0].Name != "John" {
+		t.Errorf("Expected to find 'John' by passport. Got %v", guests)
+	}
+}
+
+func TestReturningGuest(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+	addGuest()
+	a.DB.Exec("UPDATE stays SET checked_out_at = now()")
+
+	payload := []byte(`{"name":"John", "passport":"ZZ178567", "email":"John@Example.com", "room_id":1}`)
+
+	req, _ := http.NewRequest("POST", "/guest", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var g Guest
+	json.Unmarshal(response.Body.Bytes(), &g)
+
+	if g.ID != 1 || g.Email != "john@example.com" {
+		t.Errorf("Expected the profile to be reused and updated. Got %v", g)
+	}
+
+	stays, _ := g.getGuestStays(a.DB)
+	if len(stays) != 2 {
+		t.Errorf("Expected two stays on the profile. Got %d", len(stays))
+	}
+
+	req, _ = http.NewRequest("POST", "/guest/1/stays", bytes.NewBuffer([]byte(`{"room_id":1}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guests?email=john@example.com&in_house=true", nil)
+	response = executeRequest(req)
+
+	var guests []Guest
+	json.Unmarshal(response.Body.Bytes(), &guests)
+
+	if len(guests) != 1 || guests[0].RoomID != 1 {
+		t.Errorf("Expected to find the guest in house. Got %v", guests)
+	}
+}
+
+func TestMergeGuests(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+	addGuest()
+	a.DB.Exec("UPDATE guests SET email='john@example.com'")
+
+	payload := []byte(`{"name":"John Smith", "passport":"XY1234", "email":"john@example.com", "phone":"+44 20 7946 0000"}`)
+
+	req, _ := http.NewRequest("POST", "/guest", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guests/duplicates", nil)
+	response = executeRequest(req)
+
+	var dups []DuplicateGuests
+	json.Unmarshal(response.Body.Bytes(), &dups)
+
+	if len(dups) != 1 || dups[0].GuestIDs[1] != 2 || dups[0].Reasons[0] != "email" {
+		t.Errorf("Expected guests 1 and 2 to be duplicates by email. Got %v", dups)
+	}
+
+	req, _ = http.NewRequest("POST", "/guest/1/merge", bytes.NewBuffer([]byte(`{"guest_ids":[2]}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/2", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/1", nil)
+	response = executeRequest(req)
+
+	var g Guest
+	json.Unmarshal(response.Body.Bytes(), &g)
+
+	if g.Phone != "+44 20 7946 0000" || len(g.Documents) != 1 || g.Documents[0].Number != "XY1234" {
+		t.Errorf("Expected the phone and passport of guest 2 on guest 1. Got %v", g)
+	}
+}
+
+func TestPassportStoredEncrypted(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+
+	payload := []byte(`{"name":"Nastya", "passport":"7785DF", "room_id":1}`)
+
+	req, _ := http.NewRequest("POST", "/guest", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var enc []byte
+	a.DB.QueryRow("SELECT passport_enc FROM guests WHERE id=1").Scan(&enc)
+	if bytes.Contains(enc, []byte("7785DF")) {
+		t.Errorf("Expected passport to be stored encrypted")
+	}
+}
+
+func TestRotatePassportKeys(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+	addGuest()
+
+	old := a.Keys
+	defer func() { a.Keys = old }()
+
+	a.Keys, _ = NewKeyring("k2", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}, bytes.Repeat([]byte{9}, 32))
+
+	n, err := RotatePassportKeys(a.DB, a.Keys, 1)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 row rotated. Got %d, %v", n, err)
+	}
+
+	g := Guest{ID: 1}
+	if err := g.getGuest(a.DB, a.Keys); err != nil || g.Passport != "ZZ178567" {
+		t.Errorf("Expected passport to survive rotation. Got '%v', %v", g.Passport, err)
+	}
+}
+
+// the schema of the first release, which db.sql upgrades in place
+const baselineSchema = `CREATE TABLE rooms
+(
+    id SERIAL,
+    number INTEGER NOT NULL UNIQUE,
+    params TEXT,
+    beds INTEGER,
+    CONSTRAINT rooms_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE guests
+(
+    id SERIAL,
+    name TEXT NOT NULL,
+    passport TEXT NOT NULL UNIQUE,
+    room_id INTEGER NOT NULL,
+    CONSTRAINT guests_pkey PRIMARY KEY(id)
+)`
+
+func TestUpgradeSchema(t *testing.T) {
+	schema, err := os.ReadFile("db.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a schema of its own on one connection, so the upgrade cannot touch
+	// the tables of the other tests
+	ctx := context.Background()
+	conn, err := a.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer conn.ExecContext(ctx, "RESET search_path")
+	defer conn.ExecContext(ctx, "DROP SCHEMA IF EXISTS upgrade_test CASCADE")
+
+	for _, q := range []string{"DROP SCHEMA IF EXISTS upgrade_test CASCADE", "CREATE SCHEMA upgrade_test",
+		"SET search_path TO upgrade_test", baselineSchema,
+		"INSERT INTO rooms(number, params, beds) VALUES(101, 'five stars', 2)",
+		"INSERT INTO guests(name, passport, room_id) VALUES('John', 'ZZ178567', 1)",
+		string(schema)} {
+		if _, err := conn.ExecContext(ctx, q); err != nil {
+			t.Fatalf("%v in %.40q", err, q)
+		}
+	}
+
+	// a second property can have a room 101 of its own, the first cannot
+	if _, err := conn.ExecContext(ctx, "INSERT INTO properties(name) VALUES('Annex')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "INSERT INTO rooms(property_id, number) VALUES(2, 101)"); err != nil {
+		t.Errorf("Expected room numbers to be unique per property. Got %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, "INSERT INTO rooms(property_id, number) VALUES(1, 101)"); err == nil {
+		t.Errorf("Expected a second room 101 in the first property to be refused")
+	}
+
+	var stays int
+	conn.QueryRowContext(ctx, "SELECT count(*) FROM stays WHERE checked_out_at IS NULL").Scan(&stays)
+	if stays != 1 {
+		t.Errorf("Expected the guest in room 101 to have an open stay. Got %d", stays)
+	}
+}
+
+func TestMigratePassports(t *testing.T) {
+	clearTableRooms()
+	clearTableGuests()
+	addRoom()
+
+	// the guests table as it was before passports were encrypted
+	a.DB.Exec(`ALTER TABLE guests ADD COLUMN passport TEXT,
+		ALTER COLUMN passport_hash DROP NOT NULL, ALTER COLUMN passport_enc DROP NOT NULL,
+		ALTER COLUMN passport_dek DROP NOT NULL, ALTER COLUMN passport_key_id DROP NOT NULL`)
+	a.DB.Exec("INSERT INTO guests(name, passport) VALUES('John', 'ZZ178567'), ('Sara', '9985DF')")
+
+	n, err := MigratePassports(a.DB, a.Keys, 1)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 passports encrypted. Got %d, %v", n, err)
+	}
+	if err := FinishPassportMigration(a.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	var plain int
+	a.DB.QueryRow(`SELECT count(*) FROM information_schema.columns
+		WHERE table_name = 'guests' AND (column_name = 'passport'
+		OR column_name LIKE 'passport%' AND is_nullable = 'YES')`).Scan(&plain)
+	if plain != 0 {
+		t.Errorf("Expected the plain text column gone and the sealed ones required")
+	}
+
+	g := Guest{Passport: "9985DF"}
+	if err := g.getGuestByPassport(a.DB, a.Keys); err != nil || g.Name != "Sara" {
+		t.Errorf("Expected Sara to be found by passport. Got '%v', %v", g.Name, err)
+	}
+}
+
+func TestFilterRoomsByFeatures(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	addRoom()
+
+	payload := []byte(`{"number":30, "beds":2, "features":{"floor":3, "view":"sea",
+		"bed_configuration":"1 king", "accessible":true, "smoking":false, "amenities":["minibar","balcony"]}}`)
+
+	req, _ := http.NewRequest("POST", "/room", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var created Room
+	json.Unmarshal(response.Body.Bytes(), &created)
+
+	if created.Parameters == "" {
+		t.Errorf("Expected params to be derived from features")
+	}
+
+	req, _ = http.NewRequest("GET", "/rooms?view=sea&accessible=true&amenity=balcony", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var rooms []Room
+	json.Unmarshal(response.Body.Bytes(), &rooms)
+
+	if len(rooms) != 1 || rooms[0].Number != 30 {
+		t.Errorf("Expected only room 30 to match. Got %v", rooms)
+	}
+
+	req, _ = http.NewRequest("GET", "/rooms?floor=high", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestBookByRoomType(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	addRoom()
+	addRoomType()
+
+	req, _ := http.NewRequest("GET", "/availability?room_type=1", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var av []Availability
+	json.Unmarshal(response.Body.Bytes(), &av)
+
+	if len(av) != 1 || av[0].Total != 1 || av[0].Available != 1 {
+		t.Errorf("Expected 1 of 1 rooms available. Got %v", av)
+	}
+
+	payload := []byte(`{"name":"Nastya", "passport":"7785DF", "room_type_id":1}`)
+
+	req, _ = http.NewRequest("POST", "/guest", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var g Guest
+	json.Unmarshal(response.Body.Bytes(), &g)
+
+	if g.RoomID != 1 {
+		t.Errorf("Expected guest to be assigned room 1. Got %d", g.RoomID)
+	}
+
+	req, _ = http.NewRequest("GET", "/room/1", nil)
+	response = executeRequest(req)
+
+	var room Room
+	json.Unmarshal(response.Body.Bytes(), &room)
+
+	if room.Features == nil || room.Features.View != "garden" {
+		t.Errorf("Expected room to inherit the type's features. Got %v", room.Features)
+	}
+
+	payload = []byte(`{"name":"Sara", "passport":"9985DF", "room_type_id":1}`)
+
+	req, _ = http.NewRequest("POST", "/guest", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusInternalServerError, response.Code)
+}
+
+func TestPriceRatePlan(t *testing.T) {
+	plan := RatePlan{
+		BaseRate:      10000,
+		WeekendRate:   12000,
+		BaseOccupancy: 2,
+		ExtraGuestFee: 1500,
+		Seasons: seasonList{{
+			Name: "summer",
+			From: Date{time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)},
+			To:   Date{time.Date(2026, 8, 31, 0, 0, 0, 0, time.UTC)},
+			Rate: 15000,
+		}},
+		LOSDiscounts: losDiscountList{{MinNights: 3, Percent: 10}},
+	}
+
+	// Wed 2026-06-24 to Sat 2026-06-27: two weekday nights and a Friday
+	from, _ := ParseDate("2026-06-24")
+	to, _ := ParseDate("2026-06-27")
+
+	q, err := plan.Price(from, to, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10000, 10000 and 12000 less 10%, plus 1500 for the third guest each night
+	if q.Total != 9000+9000+10800+3*1500 {
+		t.Errorf("Expected total to be 33300. Got %d", q.Total)
+	}
+
+	from, _ = ParseDate("2026-07-01")
+	to, _ = ParseDate("2026-07-02")
+
+	q, _ = plan.Price(from, to, 1)
+	if q.Nights[0].Season != "summer" || q.Total != 15000 {
+		t.Errorf("Expected a summer night at 15000. Got %v", q.Nights[0])
+	}
+
+	if _, err := plan.Price(to, from, 1); err == nil {
+		t.Errorf("Expected an error for 'to' before 'from'")
+	}
+}
+
+func TestGetQuote(t *testing.T) {
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	addRoomType()
+
+	req, _ := http.NewRequest("GET", "/quote?room_type=1&from=2026-06-22&to=2026-06-24&guests=2", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var q Quote
+	json.Unmarshal(response.Body.Bytes(), &q)
+
+	if len(q.Nights) != 2 || q.Total != 24000 {
+		t.Errorf("Expected 2 nights at the default rate of 12000. Got %v", q)
+	}
+
+	req, _ = http.NewRequest("GET", "/quote?room_type=1&from=2026-06-22&to=2026-06-24&guests=5", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestCheckoutRequiresSettledFolio(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	addRoom()
+	addRoomType()
+	addGuest()
+
+	payload := []byte(`{"category":"minibar", "description":"2 x water", "amount":600}`)
+
+	req, _ := http.NewRequest("POST", "/guest/1/charges", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/1/folio", nil)
+	response = executeRequest(req)
+
+	var f Folio
+	json.Unmarshal(response.Body.Bytes(), &f)
+
+	// one room night at the type's default rate plus the minibar
+	if f.Balance != 12000+600 {
+		t.Fatalf("Expected balance to be 12600. Got %d", f.Balance)
+	}
+
+	payload = []byte(`{"description":"card", "amount":12600}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/payments", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestCheckoutManagerOverride(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	addRoom()
+	addGuest()
+
+	payload := []byte(`{"category":"parking", "description":"1 day", "amount":2000}`)
+
+	req, _ := http.NewRequest("POST", "/guest/1/charges", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	payload = []byte(`{"override":{"manager":"Ann", "reason":"company will pay"}}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestInvoiceNumbering(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableInvoices()
+	addRoom()
+	addRoomType()
+	addGuest()
+
+	req, _ := http.NewRequest("GET", "/guest/1/invoice", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	payload := []byte(`{"override":{"manager":"Ann", "reason":"invoice to company"}}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/1/invoice", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var inv Invoice
+	json.Unmarshal(response.Body.Bytes(), &inv)
+
+	if inv.Number != 1 || inv.Total != 12000 || inv.BalanceDue != 12000 {
+		t.Errorf("Expected invoice 1 over 12000. Got %d over %d", inv.Number, inv.Total)
+	}
+
+	req, _ = http.NewRequest("GET", "/guest/1/invoice?format=pdf", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if !bytes.HasPrefix(response.Body.Bytes(), []byte("%PDF-")) {
+		t.Errorf("Expected a PDF document")
+	}
+
+	var n int
+	a.DB.QueryRow("SELECT last_number FROM invoice_counter").Scan(&n)
+	if n != 1 {
+		t.Errorf("Expected repeated requests to reuse invoice 1. Counter is at %d", n)
+	}
+}
+
+func TestComputeTaxes(t *testing.T) {
+	rules := []TaxRule{
+		{Name: "VAT", Kind: TaxPercent, BasisPoints: 1000, Inclusive: true, Rounding: RoundHalfUp},
+		{Name: "City tax", Kind: TaxPerGuestNight, Amount: 250, MaxNights: 3, ExemptUnderAge: 12},
+		{Name: "Service", Kind: TaxPercent, BasisPoints: 500, Categories: stringList{"restaurant"},
+			Rounding: RoundUp, Cap: 1000},
+		{Name: "Resort fee", Kind: TaxPerNight, Amount: 500, ExemptFromNights: 7},
+	}
+	lines := []Taxable{
+		{Category: "room", Amount: 11000},
+		{Category: "room", Amount: 11000},
+		{Category: "room", Amount: 11000},
+		{Category: "room", Amount: 11000},
+		{Category: "restaurant", Amount: 4510},
+	}
+
+	got := map[string]int64{}
+	for _, tax := range ComputeTaxes(rules, lines, TaxContext{Nights: 4, Ages: []int{40, 8}}) {
+		got[tax.Name] = tax.Amount
+	}
+
+	// 48510 gross contains 4410 VAT at 10%
+	if got["VAT"] != 4410 {
+		t.Errorf("Expected VAT to be 4410. Got %d", got["VAT"])
+	}
+	// one adult, the first 3 nights only
+	if got["City tax"] != 750 {
+		t.Errorf("Expected city tax to be 750. Got %d", got["City tax"])
+	}
+	// 5% of 4510 is 225.5, rounded up
+	if got["Service"] != 226 {
+		t.Errorf("Expected service to be 226. Got %d", got["Service"])
+	}
+	if got["Resort fee"] != 2000 {
+		t.Errorf("Expected resort fee to be 2000. Got %d", got["Resort fee"])
+	}
+
+	got = map[string]int64{}
+	for _, tax := range ComputeTaxes(rules, lines, TaxContext{Nights: 7, Ages: []int{-1}}) {
+		got[tax.Name] = tax.Amount
+	}
+	if _, ok := got["Resort fee"]; ok {
+		t.Errorf("Expected stays of 7 nights to be exempt from the resort fee")
+	}
+}
+
+func TestFolioPostsTaxes(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	addRoom()
+	addRoomType()
+	addGuest()
+
+	payload := []byte(`{"name":"City tax", "kind":"per_guest_night", "amount":300}`)
+
+	req, _ := http.NewRequest("POST", "/tax_rule", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/1/folio", nil)
+	response = executeRequest(req)
+
+	var f Folio
+	json.Unmarshal(response.Body.Bytes(), &f)
+
+	if f.Balance != 12000+300 {
+		t.Errorf("Expected one night and its city tax. Got balance %d", f.Balance)
+	}
+
+	req, _ = http.NewRequest("GET", "/quote?room_type=1&from=2026-06-22&to=2026-06-24&guests=2", nil)
+	response = executeRequest(req)
+
+	var q Quote
+	json.Unmarshal(response.Body.Bytes(), &q)
+
+	if q.GrandTotal != 24000+4*300 {
+		t.Errorf("Expected grand total to be 25200. Got %d", q.GrandTotal)
+	}
+}
+
+func TestFolioTaxesPerGuest(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	payload := []byte(`{"name":"City tax", "kind":"per_guest_night", "amount":300}`)
+
+	req, _ := http.NewRequest("POST", "/tax_rule", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	payload = []byte(`{"name":"Jane", "room_type_id":1, "guests":2, "arrival":"` + today().String() +
+		`", "departure":"` + today().AddDays(1).String() + `", "payment_token":"tok_visa"}`)
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	payload = []byte(`{"passport":"XY123"}`)
+
+	req, _ = http.NewRequest("POST", "/reservation/1/checkin", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// both guests pay the city tax, as they were quoted
+	req, _ = http.NewRequest("GET", "/guest/1/folio", nil)
+	response = executeRequest(req)
+
+	var f Folio
+	json.Unmarshal(response.Body.Bytes(), &f)
+
+	var tax int64
+	for _, l := range f.Lines {
+		if l.Kind == LineTax {
+			tax += l.Amount
+		}
+	}
+	if tax != 2*300 {
+		t.Errorf("Expected the city tax for two guests. Got %d", tax)
+	}
+
+	req, _ = http.NewRequest("GET", "/guest/1/invoice", nil)
+	response = executeRequest(req)
+
+	var inv Invoice
+	json.Unmarshal(response.Body.Bytes(), &inv)
+
+	if len(inv.Taxes) != 1 || inv.Taxes[0].Amount != 2*300 {
+		t.Errorf("Expected the invoice to show the city tax for two guests. Got %v", inv.Taxes)
+	}
+}
+
+func TestConvertCurrency(t *testing.T) {
+	usd, _ := parseRate("1.0845")
+	jpy, _ := parseRate("162.5")
+
+	// 100.00 EUR at 1.0845
+	if c := convertAt(10000, "EUR", "USD", rateScale, usd); c.Amount != 10845 || c.Rate != "1.084500" {
+		t.Errorf("Expected 108.45 USD at 1.084500. Got %d at %s", c.Amount, c.Rate)
+	}
+
+	// 108.45 USD back to EUR
+	if c := convertAt(10845, "USD", "EUR", usd, rateScale); c.Amount != 10000 {
+		t.Errorf("Expected 100.00 EUR. Got %d", c.Amount)
+	}
+
+	// yen have no minor unit: 10.00 EUR is 1625 JPY
+	if c := convertAt(1000, "EUR", "JPY", rateScale, jpy); c.Amount != 1625 {
+		t.Errorf("Expected 1625 JPY. Got %d", c.Amount)
+	}
+
+	if _, err := parseRate("1.1234567"); err == nil {
+		t.Errorf("Expected rates with more than 6 decimals to be refused")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1.0845", 1084500, true},
+		{"162", 162000000, true},
+		{" 0.5 ", 500000, true},
+		{"-0.5", 0, false},
+		{"+0.5", 0, false},
+		{"-1", 0, false},
+		{".5", 0, false},
+		{"1.", 0, false},
+		{"0", 0, false},
+		{"1.-5", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		rate, err := parseRate(tt.in)
+		if (err == nil) != tt.ok || rate != tt.want {
+			t.Errorf("parseRate(%q): expected %d, ok %v. Got %d, %v", tt.in, tt.want, tt.ok, rate, err)
+		}
+	}
+}
+
+func TestForeignCurrencyPayment(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableTaxRules()
+	a.DB.Exec("DELETE FROM exchange_rates")
+	addRoom()
+	addGuest()
+
+	csv := []byte("currency,effective_date,rate\nUSD,2020-01-01,1.25\nGBP,2020-01-01,0.8\n")
+
+	req, _ := http.NewRequest("POST", "/exchange_rates/import", bytes.NewBuffer(csv))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	payload := []byte(`{"category":"restaurant", "description":"dinner", "amount":5000}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/charges", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	payload = []byte(`{"description":"cash", "amount":6250, "currency":"usd"}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/payments", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var f Folio
+	json.Unmarshal(response.Body.Bytes(), &f)
+
+	payment := f.Lines[len(f.Lines)-1]
+	if f.Balance != 0 || payment.Original == nil || payment.Original.Rate != "0.800000" {
+		t.Errorf("Expected 62.50 USD to settle 50.00 EUR at 0.8. Got balance %d, %v", f.Balance, payment.Original)
+	}
+}
+
+func TestFakeGateway(t *testing.T) {
+	gw := NewFakeGateway()
+
+	if _, err := gw.Authorize("tok_decline", 1000, "EUR"); err != ErrPaymentDeclined {
+		t.Errorf("Expected a decline. Got %v", err)
+	}
+	if _, err := gw.Authorize("tok_timeout", 1000, "EUR"); err != ErrGatewayTimeout {
+		t.Errorf("Expected a timeout. Got %v", err)
+	}
+
+	auth, err := gw.Authorize("tok_partial", 1000, "EUR")
+	if err != nil || auth.Amount != 500 {
+		t.Fatalf("Expected 500 of 1000 to be approved. Got %v, %v", auth, err)
+	}
+	capture, err := gw.Capture(auth.ID, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gw.Capture(auth.ID, 300); err == nil {
+		t.Errorf("Expected capturing more than authorized to fail")
+	}
+	if _, err := gw.Refund(capture.ID, 400); err == nil {
+		t.Errorf("Expected refunding more than captured to fail")
+	}
+	if void, err := gw.Void(auth.ID); err != nil || void.Amount != 200 {
+		t.Errorf("Expected the remaining 200 to be released. Got %v, %v", void, err)
+	}
+}
+
+func TestReservationDeposit(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	payload := []byte(`{"name":"Jane", "room_type_id":1, "arrival":"2030-03-04", "departure":"2030-03-06",
+		"payment_token":"tok_decline"}`)
+
+	req, _ := http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusPaymentRequired, response.Code)
+
+	payload = bytes.Replace(payload, []byte("tok_decline"), []byte("tok_visa"), 1)
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var res Reservation
+	json.Unmarshal(response.Body.Bytes(), &res)
+
+	if res.Deposit != 12000 || res.Total != 24000 || res.PaymentToken != "" {
+		t.Errorf("Expected the first night as deposit and no token in the response. Got %v", res)
+	}
+
+	var stored string
+	a.DB.QueryRow("SELECT payment_token FROM reservations WHERE id=$1", res.ID).Scan(&stored)
+	if stored != "tok_visa" {
+		t.Errorf("Expected the gateway token to be stored. Got '%s'", stored)
+	}
+
+	// the only room is taken on those nights
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestReservationAgainstWalkIn(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+	addGuest()
+
+	// the walk-in has no departure, so the room stays taken after tonight
+	payload := []byte(`{"name":"Jane", "room_type_id":1, "arrival":"` + today().AddDays(3).String() +
+		`", "departure":"` + today().AddDays(5).String() + `", "payment_token":"tok_visa"}`)
+
+	req, _ := http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	a.DB.Exec("UPDATE stays SET checked_out_at=now()")
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+}
+
+func TestRefundDeposit(t *testing.T) {
+	clearTableReservations()
+	gw := NewFakeGateway()
+
+	auth, capture, err := chargeCard(gw, "tok_visa", 12000, "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refundDeposit(a.DB, gw, auth, capture)
+
+	// a capture the gateway does not know cannot be refunded
+	refundDeposit(a.DB, gw, Transaction{ID: "auth_x", Kind: "authorize", Amount: 500, Currency: "EUR"},
+		Transaction{ID: "cap_x", Kind: "capture", Amount: 500, Currency: "EUR"})
+
+	var kinds []string
+	rows, _ := a.DB.Query(`SELECT kind FROM payment_transactions
+		WHERE reservation_id IS NULL AND folio_id IS NULL ORDER BY id`)
+	for rows.Next() {
+		var kind string
+		rows.Scan(&kind)
+		kinds = append(kinds, kind)
+	}
+	rows.Close()
+
+	if strings.Join(kinds, ",") != "authorize,capture,refund,authorize,capture" {
+		t.Errorf("Expected both deposits on record and one refund. Got %v", kinds)
+	}
+}
+
+func TestCheckoutSettlesWithReservationCard(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	arrival := today()
+	payload := []byte(`{"name":"Jane", "room_type_id":1, "arrival":"` + arrival.String() +
+		`", "departure":"` + arrival.AddDays(1).String() + `", "payment_token":"tok_visa"}`)
+
+	req, _ := http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	payload = []byte(`{"passport":"XY123"}`)
+
+	req, _ = http.NewRequest("POST", "/reservation/1/checkin", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	payload = []byte(`{"category":"minibar", "description":"water", "amount":300}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/charges", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	// the deposit paid the night, the minibar goes on the reservation's card
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/guest/1/folio", nil)
+	response = executeRequest(req)
+
+	var f Folio
+	json.Unmarshal(response.Body.Bytes(), &f)
+
+	if f.Balance != 0 || f.Lines[len(f.Lines)-1].Amount != -300 {
+		t.Errorf("Expected the minibar to be settled by card. Got %v", f)
+	}
+}
+
+func TestCheckoutDeclinedCard(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableTaxRules()
+	addRoom()
+	addGuest()
+
+	payload := []byte(`{"category":"parking", "description":"1 day", "amount":2000}`)
+
+	req, _ := http.NewRequest("POST", "/guest/1/charges", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	payload = []byte(`{"payment_token":"tok_decline"}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusPaymentRequired, response.Code)
+
+	// half approved leaves a balance
+	payload = []byte(`{"payment_token":"tok_partial"}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	payload = []byte(`{"payment_token":"tok_visa"}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/checkout", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestConcurrentCheckout(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addGuest()
+
+	payload := []byte(`{"category":"parking", "description":"1 day", "amount":2000}`)
+
+	req, _ := http.NewRequest("POST", "/guest/1/charges", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	// the second checkout waits for the first and finds the stay closed
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			g := Guest{ID: 1}
+			errs <- g.checkout(a.DB, a.Gateway, CheckoutRequest{PaymentToken: "tok_visa"})
+		}()
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if <-errs != nil {
+			failed++
+		}
+	}
+
+	var captures int
+	a.DB.QueryRow("SELECT count(*) FROM payment_transactions WHERE kind='capture'").Scan(&captures)
+	if failed != 1 || captures != 1 {
+		t.Errorf("Expected one checkout to charge the card once. Got %d failed, %d captures", failed, captures)
+	}
+}
+
+func TestCancellationPolicy(t *testing.T) {
+	policy := CancellationPolicy{FreeUntilHours: 48, PenaltyNights: 1, NoShowAfterHours: 30}
+	arrival, _ := ParseDate("2030-05-10")
+
+	if !policy.isFree(arrival, time.Date(2030, 5, 7, 23, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected cancelling 49 hours before arrival to be free")
+	}
+	if policy.isFree(arrival, time.Date(2030, 5, 8, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected cancelling 47 hours before arrival to cost a penalty")
+	}
+	if cutoff := policy.noShowCutoff(arrival); !cutoff.Equal(time.Date(2030, 5, 11, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the no-show cutoff at 06:00 the next day. Got %v", cutoff)
+	}
+
+	q := &Quote{Nights: []NightPrice{{Amount: 10000}, {Amount: 15000}}}
+	if p := policy.penalty(q, 25000); p != 10000 {
+		t.Errorf("Expected the first night as penalty. Got %d", p)
+	}
+	policy.PenaltyPercent = 50
+	if p := policy.penalty(q, 25000); p != 12500 {
+		t.Errorf("Expected half the total as penalty. Got %d", p)
+	}
+}
+
+func TestCancelReservation(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	far := today().AddDays(30)
+	payload := []byte(`{"name":"Jane", "room_type_id":1, "arrival":"` + far.String() +
+		`", "departure":"` + far.AddDays(2).String() + `", "payment_token":"tok_visa"}`)
+
+	req, _ := http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	req, _ = http.NewRequest("POST", "/reservation/1/cancel", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var res Reservation
+	json.Unmarshal(response.Body.Bytes(), &res)
+
+	if res.Status != ReservationCancelled || res.Penalty != 0 {
+		t.Errorf("Expected a free cancellation. Got %v", res)
+	}
+
+	var refunded int64
+	a.DB.QueryRow("SELECT COALESCE(sum(amount), 0) FROM payment_transactions WHERE kind='refund'").Scan(&refunded)
+	if refunded != 12000 {
+		t.Errorf("Expected the deposit to be refunded. Got %d", refunded)
+	}
+
+	req, _ = http.NewRequest("POST", "/reservation/1/cancel", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	// arriving today is past the default policy's free period
+	payload = []byte(`{"name":"Jane", "room_type_id":1, "arrival":"` + today().String() +
+		`", "departure":"` + today().AddDays(2).String() + `", "payment_token":"tok_visa"}`)
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	req, _ = http.NewRequest("POST", "/reservation/2/cancel", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &res)
+
+	if res.Penalty != 12000 || res.PenaltyDue != 0 {
+		t.Errorf("Expected the first night to be kept from the deposit. Got %v", res)
+	}
+}
+
+func TestMarkNoShows(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	payload := []byte(`{"room_type_id":1, "name":"Two nights", "base_rate":10000,
+		"cancellation_policy":{"free_until_hours":24, "penalty_nights":2, "no_show_after_hours":30}}`)
+
+	req, _ := http.NewRequest("POST", "/rate_plan", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	payload = []byte(`{"name":"Jane", "room_type_id":1, "rate_plan_id":1, "arrival":"` + today().String() +
+		`", "departure":"` + today().AddDays(3).String() + `", "payment_token":"tok_visa"}`)
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	if n, _ := MarkNoShows(a.DB, a.Gateway, today().Add(29*time.Hour)); n != 0 {
+		t.Errorf("Expected no no-shows before the cutoff. Got %d", n)
+	}
+	if n, err := MarkNoShows(a.DB, a.Gateway, today().Add(31*time.Hour)); n != 1 || err != nil {
+		t.Fatalf("Expected one no-show. Got %d, %v", n, err)
+	}
+
+	res := Reservation{ID: 1}
+	res.getReservation(a.DB)
+
+	// one night was the deposit, the second is charged to the card
+	if res.Status != ReservationNoShow || res.Penalty != 20000 || res.PenaltyDue != 0 {
+		t.Errorf("Expected a no-show with two nights charged. Got %v", res)
+	}
+}
+
+// refunds fail as if the gateway were down
+type refundOutage struct {
+	PaymentGateway
+}
+
+func (refundOutage) Refund(captureID string, amount int64) (Transaction, error) {
+	return Transaction{}, ErrGatewayTimeout
+}
+
+func TestSettlePenalties(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	far := today().AddDays(30)
+	payload := []byte(`{"name":"Jane", "room_type_id":1, "arrival":"` + far.String() +
+		`", "departure":"` + far.AddDays(2).String() + `", "payment_token":"tok_visa"}`)
+
+	req, _ := http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	res := Reservation{ID: 1}
+	if err := res.cancel(a.DB, refundOutage{a.Gateway}, time.Now()); err != nil {
+		t.Fatalf("Expected the cancellation to stand when the refund fails. Got %v", err)
+	}
+	if res.Status != ReservationCancelled || !res.SettlementPending {
+		t.Errorf("Expected a cancelled reservation with the refund pending. Got %v", res)
+	}
+
+	// left to the request for a few minutes
+	if n, _ := SettlePenalties(a.DB, a.Gateway); n != 0 {
+		t.Errorf("Expected a fresh cancellation to be skipped. Got %d", n)
+	}
+	a.DB.Exec("UPDATE reservations SET closed_at = closed_at - interval '10 minutes'")
+
+	if n, err := SettlePenalties(a.DB, a.Gateway); n != 1 || err != nil {
+		t.Fatalf("Expected one settlement. Got %d, %v", n, err)
+	}
+	if n, _ := SettlePenalties(a.DB, a.Gateway); n != 0 {
+		t.Errorf("Expected nothing left to settle. Got %d", n)
+	}
+
+	var refunded int64
+	a.DB.QueryRow("SELECT COALESCE(sum(amount), 0) FROM payment_transactions WHERE kind='refund'").Scan(&refunded)
+	res.getReservation(a.DB)
+	if refunded != 12000 || res.SettlementPending {
+		t.Errorf("Expected the deposit to be refunded once. Got %d, %v", refunded, res)
+	}
+}
+
+func TestGroupBlock(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	arrival := today().AddDays(30)
+	dates := `"arrival":"` + arrival.String() + `", "departure":"` + arrival.AddDays(2).String() + `"`
+	payload := []byte(`{"name":"Dental congress", ` + dates + `, "release_date":"` + arrival.AddDays(-7).String() +
+		`", "blocks":[{"room_type_id":1, "rooms":1}]}`)
+
+	req, _ := http.NewRequest("POST", "/group", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	// the block holds the only room
+	payload = []byte(`{"name":"Jane", "room_type_id":1, ` + dates + `, "payment_token":"tok_visa"}`)
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("POST", "/group/1/rooming_list", bytes.NewBuffer([]byte(`[{"name":"Dr. Ann Lee"}]`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var reservations []Reservation
+	json.Unmarshal(response.Body.Bytes(), &reservations)
+
+	if len(reservations) != 1 || reservations[0].GroupID != 1 || reservations[0].Deposit != 0 {
+		t.Errorf("Expected a reservation in the group without deposit. Got %v", reservations)
+	}
+
+	req, _ = http.NewRequest("POST", "/group/1/rooming_list", bytes.NewBuffer([]byte(`[{"name":"Dr. Bo Chan"}]`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	// a cancelled guest gives the room back to the block, and at the
+	// release date to everyone
+	req, _ = http.NewRequest("POST", "/reservation/1/cancel", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	a.DB.Exec("UPDATE group_bookings SET release_date=$1", today())
+	if n, err := ReleaseGroups(a.DB, today()); err != nil || n != 1 {
+		t.Errorf("Expected the group to be released. Got %d, %v", n, err)
+	}
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+}
+
+func TestWaitlist(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	far := today().AddDays(30)
+	dates := `"room_type_id":1, "arrival":"` + far.String() + `", "departure":"` + far.AddDays(2).String() + `"`
+	booking := []byte(`{"name":"Jane", ` + dates + `, "payment_token":"tok_visa"}`)
+
+	req, _ := http.NewRequest("POST", "/reservation", bytes.NewBuffer(booking))
+	executeRequest(req)
+
+	for _, payload := range []string{`{"name":"Tom", ` + dates + `}`, `{"name":"Ann", "priority":5, ` + dates + `}`} {
+		req, _ = http.NewRequest("POST", "/waitlist", bytes.NewBufferString(payload))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/reservation/1/cancel", nil)
+	executeRequest(req)
+
+	// Ann goes first and the room is held for her
+	var e WaitlistEntry
+	req, _ = http.NewRequest("GET", "/waitlist/2", nil)
+	response := executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &e)
+
+	if e.Status != WaitlistOffered || e.OfferExpiresAt == nil {
+		t.Errorf("Expected the room to be offered to the priority entry. Got %v", e)
+	}
+
+	req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(booking))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("POST", "/waitlist/1/accept", bytes.NewBufferString(`{"payment_token":"tok_visa"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("POST", "/waitlist/2/accept", bytes.NewBufferString(`{"payment_token":"tok_visa"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/waitlist/2", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &e)
+
+	if e.Status != WaitlistAccepted || e.ReservationID == 0 {
+		t.Errorf("Expected the offer to be booked. Got %v", e)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	far := today().AddDays(30)
+	dates := `"room_type_id":1, "arrival":"` + far.String() + `", "departure":"` + far.AddDays(2).String() + `"`
+
+	req, _ := http.NewRequest("POST", "/holds", bytes.NewBufferString(`{`+dates+`, "ttl_seconds":600}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	// the held room cannot be booked or held by anyone else
+	req, _ = http.NewRequest("POST", "/reservation",
+		bytes.NewBufferString(`{"name":"Jane", `+dates+`, "payment_token":"tok_visa"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("POST", "/holds", bytes.NewBufferString(`{`+dates+`}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("POST", "/reservation",
+		bytes.NewBufferString(`{"name":"Jane", "hold_id":1, "payment_token":"tok_visa"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var h Hold
+	req, _ = http.NewRequest("GET", "/hold/1", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &h)
+
+	if h.Status != HoldConverted || h.ReservationID != 1 {
+		t.Errorf("Expected the hold to become reservation 1. Got %v", h)
+	}
+
+	later := `"room_type_id":1, "arrival":"` + far.AddDays(5).String() + `", "departure":"` +
+		far.AddDays(6).String() + `"`
+	req, _ = http.NewRequest("POST", "/holds", bytes.NewBufferString(`{`+later+`}`))
+	executeRequest(req)
+
+	a.DB.Exec("UPDATE holds SET expires_at = now() - interval '1 second' WHERE id=2")
+	if n, err := ExpireHolds(a.DB); err != nil || n != 1 {
+		t.Errorf("Expected one hold to expire. Got %d, %v", n, err)
+	}
+
+	req, _ = http.NewRequest("POST", "/reservation",
+		bytes.NewBufferString(`{"name":"Jim", "hold_id":2, "payment_token":"tok_visa"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestOverbooking(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	addRoomType()
+
+	far := today().AddDays(30)
+	payload := []byte(`{"from":"` + far.String() + `", "to":"` + far.AddDays(7).String() + `", "percent":100}`)
+
+	req, _ := http.NewRequest("POST", "/room_type/1/overbooking", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	// one room sold twice, but not three times
+	booking := []byte(`{"name":"Jane", "room_type_id":1, "arrival":"` + far.String() +
+		`", "departure":"` + far.AddDays(2).String() + `", "payment_token":"tok_visa"}`)
+	for _, code := range []int{http.StatusCreated, http.StatusCreated, http.StatusConflict} {
+		req, _ = http.NewRequest("POST", "/reservation", bytes.NewBuffer(booking))
+		response = executeRequest(req)
+		checkResponseCode(t, code, response.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/reports/walk_list?date="+far.String(), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var lists []WalkList
+	json.Unmarshal(response.Body.Bytes(), &lists)
+
+	if len(lists) != 1 || lists[0].Excess != 1 || len(lists[0].Reservations) != 1 || lists[0].Reservations[0].ID != 2 {
+		t.Errorf("Expected the later booking to be walked. Got %v", lists)
+	}
+}
+
+func TestReports(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	addRoom()
+	a.DB.Exec("INSERT INTO rooms(number, params, beds) VALUES($1, $2, $3)", 2, "sea view", 2)
+	addRoomType()
+	addGuest()
+	a.DB.Exec("UPDATE guests SET nationality='DE'")
+	a.DB.Exec("UPDATE stays SET checked_in_at = now() - interval '2 days'")
+
+	// moving posts the two nights in room 1
+	req, _ := http.NewRequest("POST", "/guest/1/move", bytes.NewBuffer([]byte(`{"room_id":2}`)))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	from := today().AddDays(-2)
+	req, _ = http.NewRequest("GET", "/reports/occupancy?from="+from.String()+"&to="+today().String(), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var report OccupancyReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+
+	if len(report.Nights) != 2 {
+		t.Fatalf("Expected 2 nights. Got %v", report.Nights)
+	}
+	n := report.Nights[0]
+	if n.Rooms != 2 || n.Occupied != 1 || n.Occupancy != 50 || n.RoomRevenue != 12000 || n.ADR != 12000 ||
+		n.RevPAR != 6000 {
+		t.Errorf("Expected half the rooms sold at 120.00. Got %v", n)
+	}
+	if report.Total.Rooms != 4 || report.Total.RoomRevenue != 24000 {
+		t.Errorf("Expected 4 room nights and 240.00 revenue in total. Got %v", report.Total)
+	}
+
+	req, _ = http.NewRequest("GET", "/reports/occupancy?format=csv&from="+from.String()+"&to="+today().String(), nil)
+	response = executeRequest(req)
+	if body := response.Body.String(); response.Header().Get("Content-Type") != "text/csv" ||
+		!strings.Contains(body, "total,4,2,50.00,240.00,120.00,60.00") {
+		t.Errorf("Expected a CSV report with totals. Got '%s'", body)
+	}
+
+	// the move is not a departure and arrival
+	var movements []GuestMovement
+	req, _ = http.NewRequest("GET", "/reports/arrivals?date="+from.String(), nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &movements)
+	if len(movements) != 1 || movements[0].Name != "John" || movements[0].RoomNumber != 1 {
+		t.Errorf("Expected John to arrive in room 1. Got %v", movements)
+	}
+
+	req, _ = http.NewRequest("GET", "/reports/departures", nil)
+	response = executeRequest(req)
+	movements = nil
+	json.Unmarshal(response.Body.Bytes(), &movements)
+	if len(movements) != 0 {
+		t.Errorf("Expected no departures. Got %v", movements)
+	}
+
+	req, _ = http.NewRequest("GET", "/reports/in_house", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &movements)
+	if len(movements) != 1 || movements[0].RoomNumber != 2 || movements[0].Departure != nil {
+		t.Errorf("Expected John in house in room 2. Got %v", movements)
+	}
+
+	req, _ = http.NewRequest("GET", "/reports/nationalities?from="+from.String()+"&to="+today().AddDays(1).String(), nil)
+	response = executeRequest(req)
+
+	var stats []NationalityStats
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	if len(stats) != 1 || stats[0].Nationality != "DE" || stats[0].Guests != 1 || stats[0].Nights != 3 {
+		t.Errorf("Expected one German guest for 3 nights. Got %v", stats)
+	}
+}
+
+func TestNightAudit(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	clearTableReservations()
+	clearTableNightAudits()
+	addRoom()
+	a.DB.Exec("INSERT INTO rooms(number, params, beds) VALUES($1, $2, $3)", 2, "sea view", 2)
+	addRoomType()
+	addGuest()
+
+	payload := []byte(`{"name":"Jane", "room_type_id":1, "arrival":"` + today().String() +
+		`", "departure":"` + today().AddDays(2).String() + `", "payment_token":"tok_visa"}`)
+	req, _ := http.NewRequest("POST", "/reservation", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	// yesterday's audit was interrupted before its statistics
+	a.DB.Exec("INSERT INTO night_audits(business_date, step) VALUES($1, $2)", today().AddDays(-1), AuditNoShows)
+
+	req, _ = http.NewRequest("POST", "/night_audit", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var audit NightAudit
+	json.Unmarshal(response.Body.Bytes(), &audit)
+	if !audit.BusinessDate.Equal(today().AddDays(-1).Time) || audit.Step != AuditCompleted || audit.NoShows != 0 {
+		t.Errorf("Expected yesterday's audit to be finished. Got %v", audit)
+	}
+
+	req, _ = http.NewRequest("POST", "/night_audit", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	audit = NightAudit{}
+	json.Unmarshal(response.Body.Bytes(), &audit)
+	if audit.RoomCharges != 1 || audit.NoShows != 1 || audit.Stats == nil || audit.Stats.Occupied != 1 ||
+		audit.Stats.RoomRevenue != 12000 {
+		t.Errorf("Expected tonight charged to the guest and Jane a no-show. Got %v", audit)
+	}
+
+	res := Reservation{ID: 1}
+	res.getReservation(a.DB)
+	if res.Status != ReservationNoShow {
+		t.Errorf("Expected the reservation to be a no-show. Got '%s'", res.Status)
+	}
+
+	// a run that fell behind cannot take the audit back a step
+	behind := NightAudit{ID: audit.ID, BusinessDate: audit.BusinessDate}
+	if err := behind.setStep(a.DB, AuditStarted, AuditRoomCharges); err != ErrAuditRunning {
+		t.Errorf("Expected the late step to be refused. Got %v", err)
+	}
+	behind.getNightAudit(a.DB)
+	if behind.Step != AuditCompleted || behind.NoShows != 1 {
+		t.Errorf("Expected the audit to stay completed. Got %v", behind)
+	}
+
+	payload = []byte(`{"business_date":"` + today().String() + `"}`)
+	req, _ = http.NewRequest("POST", "/night_audit", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	// tomorrow cannot be closed yet
+	req, _ = http.NewRequest("POST", "/night_audit", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("GET", "/business_date", nil)
+	response = executeRequest(req)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["business_date"] != today().AddDays(1).String() {
+		t.Errorf("Expected the business date to be tomorrow. Got '%s'", m["business_date"])
+	}
+}
+
+func TestImportRooms(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	addRoom()
+	addRoomType()
+
+	sheet := "number,beds,room_type_id,view,amenities\n" +
+		"1,3,,sea,minibar;balcony\n" +
+		"2,2,1,garden,\n" +
+		"3,two,1,,\n"
+
+	// the dry run reports the bad row and writes nothing
+	req, _ := http.NewRequest("POST", "/import/rooms?dry_run=true", strings.NewReader(sheet))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var result ImportResult
+	json.Unmarshal(response.Body.Bytes(), &result)
+	if result.Rows != 3 || len(result.Errors) != 1 || result.Errors[0].Row != 4 {
+		t.Errorf("Expected row 4 to be reported. Got %v", result)
+	}
+
+	req, _ = http.NewRequest("POST", "/import/rooms", strings.NewReader(sheet))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	var n int
+	a.DB.QueryRow("SELECT count(*) FROM rooms").Scan(&n)
+	if n != 1 {
+		t.Errorf("Expected nothing imported. Got %d rooms", n)
+	}
+
+	sheet = strings.Replace(sheet, "3,two", "3,2", 1)
+	req, _ = http.NewRequest("POST", "/import/rooms", strings.NewReader(sheet))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	result = ImportResult{}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	if result.Created != 2 || result.Updated != 1 {
+		t.Errorf("Expected 2 rooms created and 1 updated. Got %v", result)
+	}
+
+	// room 1 takes the values of its row, the empty type included
+	room := Room{ID: 1}
+	room.getRoom(a.DB)
+	if room.Beds != 3 || room.TypeID != 0 || room.Features == nil || room.Features.View != "sea" ||
+		len(room.Features.Amenities) != 2 {
+		t.Errorf("Expected room 1 to be updated from its row. Got %v", room)
+	}
+
+	req, _ = http.NewRequest("POST", "/import/rooms", bytes.NewReader(make([]byte, maxImportBytes+1)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, response.Code)
+}
+
+func TestImportGuests(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	addRoom()
+	addGuest()
+
+	sheet := "name,passport,email,nationality,date_of_birth\n" +
+		"John,ZZ178567,john@example.com,gb,\n" +
+		"Sara,9985DF,,fr,1990-04-02\n"
+
+	req, _ := http.NewRequest("POST", "/import/guests", strings.NewReader(sheet))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var result ImportResult
+	json.Unmarshal(response.Body.Bytes(), &result)
+	if result.Created != 1 || result.Updated != 1 {
+		t.Errorf("Expected Sara created and John updated. Got %v", result)
+	}
+
+	g := Guest{Passport: "ZZ178567"}
+	g.getGuestByPassport(a.DB, a.Keys)
+	if g.ID != 1 || g.Email != "john@example.com" || g.Nationality != "GB" || g.RoomID != 1 {
+		t.Errorf("Expected John's profile to be updated in place. Got %v", g)
+	}
+}
+
+func TestReadXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+			xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+			<sheets><sheet name="Rooms" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+			<Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>number</t></si><si><r><t>vi</t></r><r><t>ew</t></r></si></sst>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>
+			<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="s"><v>1</v></c></row>
+			<row r="2"><c r="A2"><v>101</v></c><c r="C2" t="inlineStr"><is><t>sea</t></is></c></row>
+			</sheetData></worksheet>`,
+	}
+	for name, content := range parts {
+		f, _ := z.Create(name)
+		f.Write([]byte(content))
+	}
+	z.Close()
+
+	records, err := readSheet(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(records) != "[[number  view] [101  sea]]" {
+		t.Errorf("Expected the cells in their columns. Got %q", records)
+	}
+
+	// a part that inflates beyond the limit is refused
+	parts["xl/sharedStrings.xml"] = "<sst>" + strings.Repeat(" ", maxXLSXPartBytes) + "</sst>"
+	buf.Reset()
+	z = zip.NewWriter(&buf)
+	for name, content := range parts {
+		f, _ := z.Create(name)
+		f.Write([]byte(content))
+	}
+	z.Close()
+
+	if _, err := readSheet(&buf); err == nil {
+		t.Errorf("Expected the oversized shared strings to be refused")
+	} else if _, invalid := err.(invalidError); !invalid {
+		t.Errorf("Expected the oversized shared strings to be invalid. Got %v", err)
+	}
+}
+
+func TestExportRooms(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	addRoom()
+
+	payload := []byte(`{"number":30, "beds":2, "features":{"floor":3, "view":"sea",
+		"bed_configuration":"1 king", "accessible":true, "smoking":false, "amenities":["minibar","balcony"]}}`)
+
+	req, _ := http.NewRequest("POST", "/room", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/export/rooms", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "id,property_id,number") ||
+		!strings.HasSuffix(lines[2], ",3,sea,1 king,true,false,minibar;balcony") {
+		t.Errorf("Expected a header and two rooms. Got %q", lines)
+	}
+
+	// the filters of GET /rooms apply
+	req, _ = http.NewRequest("GET", "/export/rooms?format=ndjson&view=sea", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var room map[string]interface{}
+	lines = strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	json.Unmarshal([]byte(lines[0]), &room)
+	if len(lines) != 1 || room["number"] != 30.0 || room["view"] != "sea" {
+		t.Errorf("Expected room 30 only. Got %q", lines)
+	}
+
+	req, _ = http.NewRequest("GET", "/export/rooms?format=xlsx", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	records, err := readSheet(response.Body)
+	if err != nil || len(records) != 3 || records[2][2] != "30" || records[2][11] != "1" {
+		t.Errorf("Expected the rooms in the sheet. Got %q, %v", records, err)
+	}
+
+	req, _ = http.NewRequest("GET", "/export/rooms?format=pdf", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestExportGuests(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	addRoom()
+	addGuest()
+
+	req, _ := http.NewRequest("GET", "/export/guests?format=ndjson&in_house=true", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	body := response.Body.String()
+	if !strings.HasPrefix(body, `{"id":1,"name":"John",`) || strings.Contains(body, "passport") ||
+		!strings.Contains(body, `"room_id":1}`) {
+		t.Errorf("Expected John without his passport. Got '%s'", body)
+	}
+}
+
+func TestMoveGuest(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	clearTableTaxRules()
+	addRoom()
+	a.DB.Exec("INSERT INTO rooms(number, params, beds) VALUES($1, $2, $3)", 2, "sea view", 2)
+	addRoomType()
+	addGuest()
+	a.DB.Exec("UPDATE stays SET checked_in_at = now() - interval '2 days'")
+
+	payload := []byte(`{"room_id":1}`)
+
+	req, _ := http.NewRequest("POST", "/guest/1/move", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	// rooms out of service are not given out
+	a.DB.Exec("INSERT INTO rooms(number, params, beds, housekeeping_status) VALUES($1, $2, $3, $4)",
+		3, "garden view", 2, "out_of_service")
+	payload = []byte(`{"room_id":3}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/move", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	a.DB.Exec("UPDATE rooms SET housekeeping_status='inspected' WHERE id=2")
+	payload = []byte(`{"room_id":2, "reason":"noisy neighbours"}`)
+
+	req, _ = http.NewRequest("POST", "/guest/1/move", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	g := Guest{ID: 1}
+	stays, _ := g.getGuestStays(a.DB)
+	if len(stays) != 2 || stays[0].CheckedOutAt == nil || stays[1].RoomID != 2 {
+		t.Errorf("Expected the stay to be split into rooms 1 and 2. Got %v", stays)
+	}
+
+	var status string
+	a.DB.QueryRow("SELECT housekeeping_status FROM rooms WHERE id=1").Scan(&status)
+	if status != "dirty" {
+		t.Errorf("Expected the old room to be dirty. Got '%s'", status)
+	}
+	a.DB.QueryRow("SELECT housekeeping_status FROM rooms WHERE id=2").Scan(&status)
+	if status != "clean" {
+		t.Errorf("Expected the new room to be taken out of inspected. Got '%s'", status)
+	}
+
+	// the nights in room 1 are on the folio that followed the guest
+	req, _ = http.NewRequest("GET", "/guest/1/folio", nil)
+	response = executeRequest(req)
+
+	var f Folio
+	json.Unmarshal(response.Body.Bytes(), &f)
+	if f.Balance != 24000 {
+		t.Errorf("Expected two nights in room 1. Got %d", f.Balance)
+	}
+
+	payload = []byte(`{"name":"John", "passport":"ZZ178567", "room_id":1}`)
+
+	req, _ = http.NewRequest("PUT", "/guest/1", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestMoveGuestToOtherType(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	addRoom()
+	addRoomType()
+	a.DB.Exec("INSERT INTO room_types(name, capacity, default_rate) VALUES($1, $2, $3)", "Suite", 2, 30000)
+	a.DB.Exec("INSERT INTO rooms(number, params, beds, room_type_id) VALUES($1, $2, $3, $4)", 2, "suite", 2, 2)
+	addGuest()
+
+	// an occupied room is refused
+	a.DB.Exec("INSERT INTO stays(guest_id, room_id) VALUES($1, $2)", 99, 2)
+
+	payload := []byte(`{"room_id":2, "waive_rate_change":true}`)
+
+	req, _ := http.NewRequest("POST", "/guest/1/move", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	a.DB.Exec("DELETE FROM stays WHERE guest_id=99")
+
+	req, _ = http.NewRequest("POST", "/guest/1/move", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var s Stay
+	json.Unmarshal(response.Body.Bytes(), &s)
+	if s.RoomID != 2 || s.PricedAsTypeID != 1 {
+		t.Errorf("Expected the suite to be priced as a Double Deluxe. Got %v", s)
+	}
+}
+
+func TestHousekeeping(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableRatePlans()
+	addRoom()
+	a.DB.Exec("INSERT INTO rooms(number, params, beds) VALUES($1, $2, $3)", 2, "sea view", 2)
+	addRoomType()
+	addGuest()
+
+	payload := []byte(`{"override":{"manager":"Ann"}}`)
+
+	req, _ := http.NewRequest("POST", "/guest/1/checkout", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// a dirty room has to be cleaned before inspection
+	payload = []byte(`{"status":"inspected"}`)
+
+	req, _ = http.NewRequest("PUT", "/room/1/housekeeping", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	payload = []byte(`{"housekeeper":"Maria", "room_ids":[1]}`)
+
+	req, _ = http.NewRequest("POST", "/housekeeping/assign", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/housekeeping/board?housekeeper=Maria", nil)
+	response = executeRequest(req)
+
+	var board []BoardGroup
+	json.Unmarshal(response.Body.Bytes(), &board)
+
+	if len(board) != 1 || board[0].Status != "dirty" || *board[0].Floor != 2 || board[0].Rooms[0].Number != 1 {
+		t.Errorf("Expected Maria to have room 1 dirty on floor 2. Got %v", board)
+	}
+
+	payload = []byte(`{"status":"out_of_order"}`)
+
+	req, _ = http.NewRequest("PUT", "/room/2/housekeeping", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/availability?room_type=1", nil)
+	response = executeRequest(req)
+
+	var av []Availability
+	json.Unmarshal(response.Body.Bytes(), &av)
+
+	if len(av) != 1 || av[0].Total != 1 || av[0].Available != 1 {
+		t.Errorf("Expected the out of order room not to be counted. Got %v", av)
+	}
+
+	// rooms out of service are not sold either, tonight or later
+	payload = []byte(`{"status":"out_of_service"}`)
+
+	req, _ = http.NewRequest("PUT", "/room/2/housekeeping", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/availability?room_type=1&from="+today().AddDays(1).String()+
+		"&to="+today().AddDays(2).String(), nil)
+	response = executeRequest(req)
+
+	av = nil
+	json.Unmarshal(response.Body.Bytes(), &av)
+
+	if len(av) != 1 || len(av[0].Nights) != 1 || av[0].Nights[0].Available != 1 {
+		t.Errorf("Expected the out of service room not to be counted. Got %v", av)
+	}
+}
+
+func TestRoomBlocks(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableReservations()
+	clearTableMaintenance()
+	addRoom()
+	addRoomType()
+
+	payload := []byte(`{"from":"` + today().String() + `", "to":"` + today().AddDays(3).String() +
+		`", "reason":"new bathroom"}`)
+
+	req, _ := http.NewRequest("POST", "/room/1/blocks", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	payload = []byte(`{"name":"Ann", "passport":"B123", "room_type_id":1}`)
+
+	req, _ = http.NewRequest("POST", "/guest", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusInternalServerError, response.Code)
+
+	req, _ = http.NewRequest("GET", "/availability?room_type=1&from="+today().AddDays(2).String()+
+		"&to="+today().AddDays(4).String(), nil)
+	response = executeRequest(req)
+
+	var av []Availability
+	json.Unmarshal(response.Body.Bytes(), &av)
+
+	// blocked on the first night, free on the second
+	if len(av) != 1 || len(av[0].Nights) != 2 || av[0].Nights[0].Available != 0 || av[0].Nights[1].Available != 1 {
+		t.Errorf("Expected the block to be respected. Got %v", av)
+	}
+}
+
+func TestMaintenanceTickets(t *testing.T) {
+	clearTableRooms()
+	clearTableMaintenance()
+	addRoom()
+
+	payload := []byte(`{"title":"Leaking tap"}`)
+
+	req, _ := http.NewRequest("POST", "/room/1/tickets", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	payload = []byte(`{"assigned_to":"Bob"}`)
+
+	req, _ = http.NewRequest("PUT", "/ticket/1/assign", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/room/1", nil)
+	response = executeRequest(req)
+
+	var room Room
+	json.Unmarshal(response.Body.Bytes(), &room)
+
+	if len(room.Tickets) != 1 || room.Tickets[0].Status != TicketAssigned || room.Tickets[0].AssignedTo != "Bob" {
+		t.Errorf("Expected the assigned ticket on the room. Got %v", room.Tickets)
+	}
+
+	req, _ = http.NewRequest("POST", "/ticket/1/resolve", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/ticket/1/resolve", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("GET", "/room/1", nil)
+	response = executeRequest(req)
+
+	room = Room{}
+	json.Unmarshal(response.Body.Bytes(), &room)
+
+	if len(room.Tickets) != 0 {
+		t.Errorf("Expected no active tickets. Got %v", room.Tickets)
+	}
+}
+
+func TestPropertyRooms(t *testing.T) {
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableProperties()
+	addRoom()
+
+	payload := []byte(`{"name":"Seaside", "address":"1 Beach Road"}`)
+
+	req, _ := http.NewRequest("POST", "/property", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var p Property
+	json.Unmarshal(response.Body.Bytes(), &p)
+
+	if p.ID != 2 {
+		t.Fatalf("Expected the second property. Got %v", p)
+	}
+
+	// room 1 exists in the main property only
+	payload = []byte(`{"number":1, "params":"sea view", "beds":2}`)
+
+	req, _ = http.NewRequest("POST", "/properties/2/rooms", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/properties/2/rooms", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("GET", "/properties/2/rooms", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var rooms []Room
+	json.Unmarshal(response.Body.Bytes(), &rooms)
+
+	if len(rooms) != 1 || rooms[0].PropertyID != 2 || rooms[0].Number != 1 {
+		t.Errorf("Expected only the Seaside room. Got %v", rooms)
+	}
+
+	// a room type of the main property cannot be used in another
+	addRoomType()
+	payload = []byte(`{"number":2, "params":"garden", "beds":2, "room_type_id":1}`)
+
+	req, _ = http.NewRequest("POST", "/properties/2/rooms", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/property/2", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("GET", "/properties/3/rooms", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestTenantIsolation(t *testing.T) {
+	clearTableGuests()
+	clearTableRooms()
+	clearTableRoomTypes()
+	clearTableTaxRules()
+	addRoom()
+	addRoomType()
+	addGuest()
+	a.DB.Exec("INSERT INTO tax_rules(name, kind, amount) VALUES($1, $2, $3)", "City tax", "per_guest_night", 300)
+
+	other, err := a.CreateTenant("Other Hotel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := CreateAPIKey(a.DB, other.ID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDB, release, _ := a.tenantDB(other.ID)
+	defer release()
+	defer func() {
+		for _, table := range []string{"guest_audit", "folio_lines", "folios", "stays", "guests", "rooms", "properties"} {
+			otherDB.Exec("DELETE FROM " + table)
+		}
+		a.DB.Exec("DELETE FROM api_keys WHERE tenant_id=$1", other.ID)
+		a.DB.Exec("DELETE FROM tenants WHERE id=$1", other.ID)
+	}()
+
+	asOther := func(req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("Authorization", "Bearer "+key)
+		return executeRequest(req)
+	}
+
+	// the same room number and passport as the first tenant's
+	payload := []byte(`{"number":1, "params":"other", "beds":1}`)
+
+	req, _ := http.NewRequest("POST", "/room", bytes.NewBuffer(payload))
+	response := asOther(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var room Room
+	json.Unmarshal(response.Body.Bytes(), &room)
+
+	payload = []byte(fmt.Sprintf(`{"name":"Eve", "passport":"ZZ178567", "room_id":%d}`, room.ID))
+
+	req, _ = http.NewRequest("POST", "/guest", bytes.NewBuffer(payload))
+	response = asOther(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var guest Guest
+	json.Unmarshal(response.Body.Bytes(), &guest)
+
+	req, _ = http.NewRequest("GET", "/rooms", nil)
+	response = asOther(req)
+
+	var rooms []Room
+	json.Unmarshal(response.Body.Bytes(), &rooms)
+
+	if len(rooms) != 1 || rooms[0].ID != room.ID {
+		t.Errorf("Expected only the other tenant's room. Got %v", rooms)
+	}
+
+	req, _ = http.NewRequest("GET", "/guests", nil)
+	response = asOther(req)
+
+	var guests []Guest
+	json.Unmarshal(response.Body.Bytes(), &guests)
+
+	if len(guests) != 1 || guests[0].Name != "Eve" {
+		t.Errorf("Expected only the other tenant's guest. Got %v", guests)
+	}
+
+	// neither tenant can reach the other's rows by id
+	for _, path := range []string{"/room/1", "/guest/1"} {
+		req, _ = http.NewRequest("GET", path, nil)
+		response = asOther(req)
+		checkResponseCode(t, http.StatusNotFound, response.Code)
+	}
+	for _, path := range []string{fmt.Sprintf("/room/%d", room.ID), fmt.Sprintf("/guest/%d", guest.ID)} {
+		req, _ = http.NewRequest("GET", path, nil)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusNotFound, response.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/guests?passport=ZZ178567", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &guest)
+
+	if guest.Name != "John" {
+		t.Errorf("Expected the first tenant's guest by passport. Got %v", guest)
+	}
+
+	req, _ = http.NewRequest("GET", "/rooms", nil)
+	req.Header.Set("Authorization", "Bearer hk_unknown")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	// row-level security hides the rows even without the queries' scoping.
+	// A test role that bypasses it checks the policies as one that does
+	// not, created and dropped with the transaction.
+	tx, err := otherDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	var bypass bool
+	tx.QueryRow("SELECT rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user").Scan(&bypass)
+	if bypass {
+		for _, q := range []string{"CREATE ROLE hotel_rls_test NOSUPERUSER NOBYPASSRLS",
+			"GRANT SELECT ON " + strings.Join(tenantTables, ", ") + " TO hotel_rls_test",
+			"SET LOCAL ROLE hotel_rls_test"} {
+			if _, err := tx.Exec(q); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, table := range tenantTables {
+		var n int
+		if err := tx.QueryRow("SELECT count(*) FROM "+table+" WHERE tenant_id <> $1", other.ID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("Expected no %s of other tenants to be visible. Got %d", table, n)
+		}
+	}
+}
+
+// the tables row-level security scopes to a tenant
+var tenantTables = []string{"properties", "room_types", "rate_plans", "tax_rules", "rooms", "guests",
+	"guest_documents", "stays", "guest_audit", "folios", "folio_lines", "invoice_counter", "invoices",
+	"exchange_rates", "reservations", "payment_transactions", "group_bookings", "group_blocks",
+	"waitlist", "holds", "overbooking_limits", "room_blocks", "maintenance_tickets", "night_audits"}
+
+func TestCloseIdleTenants(t *testing.T) {
+	b := App{connString: a.connString, tenantDBs: map[int]*tenantPool{FirstTenantID: {db: a.DB}}}
+	idle, release, err := b.tenantDB(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	busy, release, err := b.tenantDB(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if n := busy.Stats().MaxOpenConnections; n != tenantMaxOpenConns {
+		t.Errorf("Expected the pool to be limited to %d connections. Got %d", tenantMaxOpenConns, n)
+	}
+
+	// the pool in use and the first tenant's stay open however long ago
+	// they were used
+	for _, p := range b.tenantDBs {
+		p.lastUsed = time.Now().Add(-tenantPoolIdleTime)
+	}
+	b.closeIdleTenants(time.Now())
+
+	if _, ok := b.tenantDBs[2]; ok || idle.Ping() == nil {
+		t.Errorf("Expected the idle pool to be closed")
+	}
+	if b.tenantDBs[3] == nil || b.tenantDBs[FirstTenantID] == nil {
+		t.Errorf("Expected the pools in use to stay open. Got %v", b.tenantDBs)
+	}
+}
+
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	a.Router.ServeHTTP(rr, req)
@@ -365,6 +2767,16 @@ func checkResponseCode(t *testing.T, expected, actual int) {
 	}
 }
 
+func newTestKeyring() *Keyring {
+	kr, err := NewKeyring("k1", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+	}, bytes.Repeat([]byte{9}, 32))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return kr
+}
+
 func ensureTableExistsRooms() {
 	if _, err := a.DB.Exec(tableCreationQueryRooms); err != nil {
 		log.Fatal(err)
@@ -377,6 +2789,154 @@ func ensureTableExistsGuests() {
 	}
 }
 
+func ensureTableExistsGuestDocuments() {
+	if _, err := a.DB.Exec(tableCreationQueryGuestDocuments); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ensureTableExistsStays() {
+	if _, err := a.DB.Exec(tableCreationQueryStays); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ensureTableExistsGuestAudit() {
+	if _, err := a.DB.Exec(tableCreationQueryGuestAudit); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ensureTableExistsRoomTypes() {
+	if _, err := a.DB.Exec(tableCreationQueryRoomTypes); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTableRoomTypes() {
+	a.DB.Exec("DELETE FROM room_types")
+	a.DB.Exec("ALTER SEQUENCE room_types_id_seq RESTART WITH 1")
+}
+
+func ensureTableExistsRatePlans() {
+	if _, err := a.DB.Exec(tableCreationQueryRatePlans); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTableRatePlans() {
+	a.DB.Exec("DELETE FROM rate_plans")
+	a.DB.Exec("ALTER SEQUENCE rate_plans_id_seq RESTART WITH 1")
+}
+
+func ensureTableExistsFolios() {
+	if _, err := a.DB.Exec(tableCreationQueryFolios); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTableFolios() {
+	a.DB.Exec("DELETE FROM folio_lines")
+	a.DB.Exec("DELETE FROM folios")
+	a.DB.Exec("ALTER SEQUENCE folios_id_seq RESTART WITH 1")
+}
+
+func ensureTableExistsInvoices() {
+	if _, err := a.DB.Exec(tableCreationQueryInvoices); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTableInvoices() {
+	a.DB.Exec("DELETE FROM invoices")
+	a.DB.Exec("DELETE FROM invoice_counter")
+}
+
+func ensureTableExistsTaxRules() {
+	if _, err := a.DB.Exec(tableCreationQueryTaxRules); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTableTaxRules() {
+	a.DB.Exec("DELETE FROM tax_rules")
+	a.DB.Exec("ALTER SEQUENCE tax_rules_id_seq RESTART WITH 1")
+}
+
+func ensureTableExistsExchangeRates() {
+	if _, err := a.DB.Exec(tableCreationQueryExchangeRates); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ensureTableExistsReservations() {
+	if _, err := a.DB.Exec(tableCreationQueryReservations); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTableReservations() {
+	a.DB.Exec("DELETE FROM reservations")
+	a.DB.Exec("ALTER SEQUENCE reservations_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM payment_transactions")
+	a.DB.Exec("DELETE FROM group_blocks")
+	a.DB.Exec("DELETE FROM group_bookings")
+	a.DB.Exec("ALTER SEQUENCE group_bookings_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM waitlist")
+	a.DB.Exec("ALTER SEQUENCE waitlist_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM holds")
+	a.DB.Exec("ALTER SEQUENCE holds_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM overbooking_limits")
+}
+
+func ensureTableExistsMaintenance() {
+	if _, err := a.DB.Exec(tableCreationQueryMaintenance); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTableMaintenance() {
+	a.DB.Exec("DELETE FROM room_blocks")
+	a.DB.Exec("ALTER SEQUENCE room_blocks_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM maintenance_tickets")
+	a.DB.Exec("ALTER SEQUENCE maintenance_tickets_id_seq RESTART WITH 1")
+}
+
+func ensureTableExistsNightAudits() {
+	if _, err := a.DB.Exec(tableCreationQueryNightAudits); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTableNightAudits() {
+	a.DB.Exec("DELETE FROM night_audits")
+	a.DB.Exec("ALTER SEQUENCE night_audits_id_seq RESTART WITH 1")
+}
+
+func ensureTableExistsTenants() {
+	if _, err := a.DB.Exec(tableCreationQueryTenants); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ensureRowLevelSecurity() {
+	if _, err := a.DB.Exec(rowLevelSecurityQuery); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ensureTableExistsProperties() {
+	if _, err := a.DB.Exec(tableCreationQueryProperties); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// keeps the default property every room falls back to
+func clearTableProperties() {
+	a.DB.Exec("DELETE FROM properties WHERE id <> 1")
+	a.DB.Exec("SELECT setval('properties_id_seq', 1)")
+}
+
 func clearTableRooms() {
 	a.DB.Exec("DELETE FROM rooms")
 	a.DB.Exec("ALTER SEQUENCE rooms_id_seq RESTART WITH 1")
@@ -385,30 +2945,412 @@ func clearTableRooms() {
 func clearTableGuests() {
 	a.DB.Exec("DELETE FROM guests")
 	a.DB.Exec("ALTER SEQUENCE guests_id_seq RESTART WITH 1")
+	clearTableStays()
+	a.DB.Exec("DELETE FROM guest_audit")
+	a.DB.Exec("DELETE FROM guest_documents")
+	a.DB.Exec("ALTER SEQUENCE guest_documents_id_seq RESTART WITH 1")
+}
+
+func clearTableStays() {
+	clearTableFolios()
+	a.DB.Exec("DELETE FROM stays")
+	a.DB.Exec("ALTER SEQUENCE stays_id_seq RESTART WITH 1")
 }
 
 func addRoom() {
 	a.DB.Exec("INSERT INTO rooms(number, params, beds) VALUES($1, $2, $3)", 1, "five stars", 2)
 }
 
+func addRoomType() {
+	a.DB.Exec("INSERT INTO room_types(name, capacity, features, default_rate) VALUES($1, $2, $3, $4)",
+		"Double Deluxe", 2, `{"floor":2, "view":"garden", "accessible":false, "smoking":false}`, 12000)
+	a.DB.Exec("UPDATE rooms SET room_type_id=1")
+}
+
 func addGuest() {
-	a.DB.Exec("INSERT INTO guests(name, passport, room_id) VALUES($1, $2, $3)", "John", "ZZ178567", 1)
+	p, _ := a.Keys.Seal("ZZ178567")
+	a.DB.Exec(`INSERT INTO guests(name, passport_hash, passport_enc, passport_dek, passport_key_id)
+		VALUES($1, $2, $3, $4, $5)`,
+		"John", a.Keys.Hash("ZZ178567"), p.Ciphertext, p.WrappedKey, p.KeyID)
+	a.DB.Exec("INSERT INTO stays(guest_id, room_id) VALUES($1, $2)", 1, 1)
 }
 
+const tableCreationQueryTenants = `CREATE OR REPLACE FUNCTION current_tenant() RETURNS INTEGER AS $$
+    SELECT NULLIF(current_setting('app.tenant_id', true), '')::INTEGER
+$$ LANGUAGE SQL STABLE;
+
+CREATE TABLE IF NOT EXISTS tenants
+(
+    id SERIAL,
+    name TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT tenants_pkey PRIMARY KEY(id)
+);
+
+INSERT INTO tenants(id, name) VALUES(1, 'Default') ON CONFLICT DO NOTHING;
+SELECT setval('tenants_id_seq', GREATEST((SELECT max(id) FROM tenants), 1));
+
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    key_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMP,
+    CONSTRAINT api_keys_pkey PRIMARY KEY(id)
+);`
+
+const rowLevelSecurityQuery = `DO $$
+DECLARE t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['properties', 'room_types', 'rate_plans', 'tax_rules', 'rooms', 'guests',
+        'guest_documents', 'stays', 'guest_audit', 'folios', 'folio_lines', 'invoice_counter', 'invoices',
+        'exchange_rates', 'reservations', 'payment_transactions', 'group_bookings', 'group_blocks',
+        'waitlist', 'holds', 'overbooking_limits', 'room_blocks', 'maintenance_tickets', 'night_audits']
+    LOOP
+        EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %I', t);
+        EXECUTE format('CREATE POLICY tenant_isolation ON %I USING (tenant_id = current_tenant())', t);
+    END LOOP;
+END $$;`
+
 const tableCreationQueryRooms = `CREATE TABLE IF NOT EXISTS rooms
 (
     id SERIAL,
-    number INTEGER NOT NULL UNIQUE,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    property_id INTEGER NOT NULL DEFAULT 1,
+    number INTEGER NOT NULL,
     params TEXT,
     beds INTEGER,
-    CONSTRAINT rooms_pkey PRIMARY KEY(id)
+    room_type_id INTEGER,
+    features JSONB,
+    housekeeping_status TEXT NOT NULL DEFAULT 'clean',
+    housekeeper TEXT NOT NULL DEFAULT '',
+    CONSTRAINT rooms_pkey PRIMARY KEY(id),
+    CONSTRAINT rooms_number_key UNIQUE(property_id, number)
 );`
 
+const tableCreationQueryProperties = `CREATE TABLE IF NOT EXISTS properties
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    CONSTRAINT properties_pkey PRIMARY KEY(id)
+);
+
+INSERT INTO properties(name) SELECT 'Main' WHERE NOT EXISTS (SELECT 1 FROM properties);`
+
 const tableCreationQueryGuests = `CREATE TABLE IF NOT EXISTS guests
 (
     id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
     name TEXT NOT NULL,
-    passport TEXT NOT NULL UNIQUE,
+    passport_hash BYTEA NOT NULL,
+    passport_enc BYTEA NOT NULL,
+    passport_dek BYTEA NOT NULL,
+    passport_key_id TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    phone TEXT NOT NULL DEFAULT '',
+    nationality TEXT NOT NULL DEFAULT '',
+    date_of_birth DATE,
+    preferences JSONB NOT NULL DEFAULT '[]',
+    erased_at TIMESTAMP,
+    CONSTRAINT guests_pkey PRIMARY KEY(id),
+    CONSTRAINT guests_passport_hash_key UNIQUE(tenant_id, passport_hash)
+);`
+
+const tableCreationQueryGuestDocuments = `CREATE TABLE IF NOT EXISTS guest_documents
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    guest_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    number_enc BYTEA NOT NULL,
+    number_dek BYTEA NOT NULL,
+    number_key_id TEXT NOT NULL,
+    country TEXT NOT NULL DEFAULT '',
+    expires_on DATE,
+    CONSTRAINT guest_documents_pkey PRIMARY KEY(id)
+);`
+
+const tableCreationQueryStays = `CREATE TABLE IF NOT EXISTS stays
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    guest_id INTEGER NOT NULL,
     room_id INTEGER NOT NULL,
-    CONSTRAINT guests_pkey PRIMARY KEY(id)
+    property_id INTEGER NOT NULL DEFAULT 1,
+    checked_in_at TIMESTAMP NOT NULL DEFAULT now(),
+    checked_out_at TIMESTAMP,
+    rate_type_id INTEGER,
+    rate_plan_id INTEGER NOT NULL DEFAULT 0,
+    guests INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT stays_pkey PRIMARY KEY(id)
+);`
+
+const tableCreationQueryGuestAudit = `CREATE TABLE IF NOT EXISTS guest_audit
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    guest_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT guest_audit_pkey PRIMARY KEY(id)
+);`
+
+const tableCreationQueryRoomTypes = `CREATE TABLE IF NOT EXISTS room_types
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    property_id INTEGER NOT NULL DEFAULT 1,
+    name TEXT NOT NULL,
+    capacity INTEGER NOT NULL,
+    features JSONB,
+    default_rate BIGINT NOT NULL DEFAULT 0,
+    CONSTRAINT room_types_pkey PRIMARY KEY(id),
+    CONSTRAINT room_types_name_key UNIQUE(property_id, name)
+);`
+
+const tableCreationQueryRatePlans = `CREATE TABLE IF NOT EXISTS rate_plans
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_type_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'EUR',
+    base_rate BIGINT NOT NULL,
+    weekend_rate BIGINT NOT NULL DEFAULT 0,
+    base_occupancy INTEGER NOT NULL DEFAULT 0,
+    extra_guest_fee BIGINT NOT NULL DEFAULT 0,
+    seasons JSONB NOT NULL DEFAULT '[]',
+    los_discounts JSONB NOT NULL DEFAULT '[]',
+    cancellation_policy JSONB,
+    CONSTRAINT rate_plans_pkey PRIMARY KEY(id)
+);`
+
+const tableCreationQueryFolios = `CREATE TABLE IF NOT EXISTS folios
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    stay_id INTEGER NOT NULL UNIQUE,
+    closed_at TIMESTAMP,
+    CONSTRAINT folios_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS folio_lines
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    folio_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    category TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    amount BIGINT NOT NULL,
+    night DATE,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    original JSONB,
+    CONSTRAINT folio_lines_pkey PRIMARY KEY(id),
+    CONSTRAINT folio_lines_night_key UNIQUE(folio_id, night, category)
+);`
+
+const tableCreationQueryInvoices = `CREATE TABLE IF NOT EXISTS invoice_counter
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    last_number INTEGER NOT NULL,
+    CONSTRAINT invoice_counter_pkey PRIMARY KEY(tenant_id)
+);
+
+CREATE TABLE IF NOT EXISTS invoices
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    number INTEGER NOT NULL,
+    folio_id INTEGER NOT NULL UNIQUE,
+    guest_id INTEGER NOT NULL,
+    issued_at TIMESTAMP NOT NULL,
+    data JSONB NOT NULL,
+    CONSTRAINT invoices_pkey PRIMARY KEY(id),
+    CONSTRAINT invoices_number_key UNIQUE(tenant_id, number)
+);`
+
+const tableCreationQueryTaxRules = `CREATE TABLE IF NOT EXISTS tax_rules
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    basis_points BIGINT NOT NULL DEFAULT 0,
+    inclusive BOOLEAN NOT NULL DEFAULT false,
+    categories JSONB NOT NULL DEFAULT '[]',
+    amount BIGINT NOT NULL DEFAULT 0,
+    max_nights INTEGER NOT NULL DEFAULT 0,
+    rounding TEXT NOT NULL DEFAULT 'half_up',
+    cap BIGINT NOT NULL DEFAULT 0,
+    exempt_under_age INTEGER NOT NULL DEFAULT 0,
+    exempt_from_nights INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT tax_rules_pkey PRIMARY KEY(id),
+    CONSTRAINT tax_rules_name_key UNIQUE(tenant_id, name)
+);`
+
+const tableCreationQueryExchangeRates = `CREATE TABLE IF NOT EXISTS exchange_rates
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    currency TEXT NOT NULL,
+    effective_date DATE NOT NULL,
+    rate BIGINT NOT NULL,
+    CONSTRAINT exchange_rates_pkey PRIMARY KEY(tenant_id, currency, effective_date)
+);`
+
+const tableCreationQueryReservations = `CREATE TABLE IF NOT EXISTS reservations
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    room_type_id INTEGER NOT NULL,
+    rate_plan_id INTEGER NOT NULL DEFAULT 0,
+    arrival DATE NOT NULL,
+    departure DATE NOT NULL,
+    guests INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    total BIGINT NOT NULL,
+    deposit BIGINT NOT NULL DEFAULT 0,
+    payment_token TEXT NOT NULL DEFAULT '',
+    stay_id INTEGER,
+    group_id INTEGER,
+    penalty BIGINT NOT NULL DEFAULT 0,
+    penalty_due BIGINT NOT NULL DEFAULT 0,
+    settlement_pending BOOLEAN NOT NULL DEFAULT false,
+    closed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT reservations_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS payment_transactions
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    gateway_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    amount BIGINT NOT NULL,
+    currency TEXT NOT NULL,
+    reservation_id INTEGER,
+    folio_id INTEGER,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT payment_transactions_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS group_bookings
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    arrival DATE NOT NULL,
+    departure DATE NOT NULL,
+    release_date DATE NOT NULL,
+    rate_plan_id INTEGER NOT NULL DEFAULT 0,
+    released_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT group_bookings_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS group_blocks
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    group_id INTEGER NOT NULL,
+    room_type_id INTEGER NOT NULL,
+    rooms INTEGER NOT NULL,
+    CONSTRAINT group_blocks_pkey PRIMARY KEY(id),
+    CONSTRAINT group_blocks_type_key UNIQUE(group_id, room_type_id)
+);
+
+CREATE TABLE IF NOT EXISTS waitlist
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    name TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    room_type_id INTEGER NOT NULL,
+    arrival DATE NOT NULL,
+    departure DATE NOT NULL,
+    guests INTEGER NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    offer_expires_at TIMESTAMP,
+    reservation_id INTEGER,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT waitlist_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS holds
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_type_id INTEGER NOT NULL,
+    arrival DATE NOT NULL,
+    departure DATE NOT NULL,
+    status TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    reservation_id INTEGER,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT holds_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS overbooking_limits
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_type_id INTEGER NOT NULL,
+    from_date DATE NOT NULL,
+    to_date DATE NOT NULL,
+    percent INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT overbooking_limits_pkey PRIMARY KEY(id)
+);`
+
+const tableCreationQueryMaintenance = `CREATE TABLE IF NOT EXISTS room_blocks
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_id INTEGER NOT NULL,
+    from_date DATE NOT NULL,
+    to_date DATE NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT room_blocks_pkey PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS maintenance_tickets
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    room_id INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    assigned_to TEXT NOT NULL DEFAULT '',
+    opened_at TIMESTAMP NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMP,
+    CONSTRAINT maintenance_tickets_pkey PRIMARY KEY(id)
+);`
+
+const tableCreationQueryNightAudits = `CREATE TABLE IF NOT EXISTS night_audits
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant(),
+    business_date DATE NOT NULL,
+    step TEXT NOT NULL,
+    room_charges INTEGER NOT NULL DEFAULT 0,
+    no_shows INTEGER NOT NULL DEFAULT 0,
+    rooms INTEGER NOT NULL DEFAULT 0,
+    occupied INTEGER NOT NULL DEFAULT 0,
+    room_revenue BIGINT NOT NULL DEFAULT 0,
+    started_at TIMESTAMP NOT NULL DEFAULT now(),
+    completed_at TIMESTAMP,
+    CONSTRAINT night_audits_pkey PRIMARY KEY(id),
+    CONSTRAINT night_audits_business_date_key UNIQUE(tenant_id, business_date)
 );`
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// maintenance ticket statuses
+const (
+	TicketOpen     = "open"
+	TicketAssigned = "assigned"
+	TicketResolved = "resolved"
+)
+
+// RoomBlock takes a room out of inventory for the nights from From up to,
+// but excluding, To
+type RoomBlock struct {
+	ID        int       `json:"id"`
+	RoomID    int       `json:"room_id"`
+	From      Date      `json:"from"`
+	To        Date      `json:"to"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type MaintenanceTicket struct {
+	ID          int        `json:"id"`
+	RoomID      int        `json:"room_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description,omitempty"`
+	Status      string     `json:"status"`
+	AssignedTo  string     `json:"assigned_to,omitempty"`
+	OpenedAt    time.Time  `json:"opened_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+}
+
+// roomBlockedOn is the SQL condition for room r having a block on the
+// night given by the date expression
+func roomBlockedOn(date string) string {
+	return "EXISTS(SELECT 1 FROM room_blocks b WHERE b.room_id = r.id AND b.from_date <= " + date +
+		" AND b.to_date > " + date + ")"
+}
+
+func (b *RoomBlock) createRoomBlock(db *sql.DB) error {
+	if !b.To.After(b.From.Time) {
+		return invalidf("A block must end after it starts")
+	}
+	if b.Reason == "" {
+		return invalidf("Reason is required")
+	}
+	return db.QueryRow(
+		`INSERT INTO room_blocks(room_id, from_date, to_date, reason) VALUES($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		b.RoomID, b.From, b.To, b.Reason).Scan(&b.ID, &b.CreatedAt)
+}
+
+func (b *RoomBlock) deleteRoomBlock(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM room_blocks WHERE id=$1 AND room_id=$2", b.ID, b.RoomID)
+	return err
+}
+
+// GetRoomBlocks lists the blocks of a room that end after the given day
+func GetRoomBlocks(db *sql.DB, roomID int, after Date) ([]RoomBlock, error) {
+	rows, err := db.Query(
+		`SELECT id, room_id, from_date, to_date, reason, created_at FROM room_blocks
+		WHERE room_id=$1 AND to_date > $2 ORDER BY from_date`, roomID, after)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	blocks := []RoomBlock{}
+
+	for rows.Next() {
+		var b RoomBlock
+		if err := rows.Scan(&b.ID, &b.RoomID, &b.From, &b.To, &b.Reason, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, b)
+	}
+
+	return blocks, nil
+}
+
+const ticketColumns = "id, room_id, title, description, status, assigned_to, opened_at, resolved_at"
+
+func (t *MaintenanceTicket) scanFields() []interface{} {
+	return []interface{}{&t.ID, &t.RoomID, &t.Title, &t.Description, &t.Status, &t.AssignedTo,
+		&t.OpenedAt, &t.ResolvedAt}
+}
+
+func (t *MaintenanceTicket) getTicket(db *sql.DB) error {
+	return db.QueryRow("SELECT "+ticketColumns+" FROM maintenance_tickets WHERE id=$1",
+		t.ID).Scan(t.scanFields()...)
+}
+
+func (t *MaintenanceTicket) createTicket(db *sql.DB) error {
+	if t.Title == "" {
+		return invalidf("Title is required")
+	}
+	t.Status = TicketOpen
+	if t.AssignedTo != "" {
+		t.Status = TicketAssigned
+	}
+	return db.QueryRow(
+		`INSERT INTO maintenance_tickets(room_id, title, description, status, assigned_to)
+		VALUES($1, $2, $3, $4, $5) RETURNING id, opened_at`,
+		t.RoomID, t.Title, t.Description, t.Status, t.AssignedTo).Scan(&t.ID, &t.OpenedAt)
+}
+
+// assign hands an unresolved ticket to someone, or back to the open pool
+// with an empty assignee
+func (t *MaintenanceTicket) assign(db *sql.DB, assignee string) error {
+	status := TicketAssigned
+	if assignee == "" {
+		status = TicketOpen
+	}
+	return t.update(db,
+		"UPDATE maintenance_tickets SET status=$1, assigned_to=$2 WHERE id=$3 AND status <> 'resolved'",
+		status, assignee, t.ID)
+}
+
+func (t *MaintenanceTicket) resolve(db *sql.DB) error {
+	return t.update(db,
+		"UPDATE maintenance_tickets SET status=$1, resolved_at=now() WHERE id=$2 AND status <> 'resolved'",
+		TicketResolved, t.ID)
+}
+
+// update runs a status change and reloads the ticket. Resolved tickets
+// cannot change.
+func (t *MaintenanceTicket) update(db *sql.DB, query string, args ...interface{}) error {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if err := t.getTicket(db); err != nil {
+		return err
+	}
+	if n == 0 {
+		return invalidf("Ticket %d is already resolved", t.ID)
+	}
+	return nil
+}
+
+// GetTickets lists the tickets of one room, or of all rooms when roomID
+// is 0, optionally in one status
+func GetTickets(db *sql.DB, roomID int, status string) ([]MaintenanceTicket, error) {
+	rows, err := db.Query(
+		"SELECT "+ticketColumns+` FROM maintenance_tickets
+		WHERE ($1 = 0 OR room_id = $1) AND ($2 = '' OR status = $2) ORDER BY opened_at, id`,
+		roomID, status)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tickets := []MaintenanceTicket{}
+
+	for rows.Next() {
+		var t MaintenanceTicket
+		if err := rows.Scan(t.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		tickets = append(tickets, t)
+	}
+
+	return tickets, nil
+}
+
+// getActiveIssues loads the room's current and future blocks and its
+// unresolved tickets
+func (r *Room) getActiveIssues(db *sql.DB) error {
+	var err error
+	if r.Blocks, err = GetRoomBlocks(db, r.ID, today()); err != nil {
+		return err
+	}
+	tickets, err := GetTickets(db, r.ID, "")
+	if err != nil {
+		return err
+	}
+	r.Tickets = []MaintenanceTicket{}
+	for _, t := range tickets {
+		if t.Status != TicketResolved {
+			r.Tickets = append(r.Tickets, t)
+		}
+	}
+	return nil
+}
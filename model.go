@@ -4,36 +4,110 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 )
 
+// invalidError marks errors caused by the request rather than the server,
+// handlers answer them with 400
+type invalidError string
+
+func (e invalidError) Error() string {
+	return string(e)
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return invalidError(fmt.Sprintf(format, args...))
+}
+
+// nullID stores a zero id as NULL
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// queryer is what *sql.DB and *sql.Tx have in common, for queries that
+// run inside and outside of transactions
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type Room struct {
-	ID         int     `json:"id"`
-	Number     int     `json:"number"`
-	Parameters string  `json:"params"`
-	Beds       int     `json:"beds"`
-	Guests     []Guest `json:"guests,omitempty"`
+	ID         int           `json:"id"`
+	PropertyID int           `json:"property_id"`
+	Number     int           `json:"number"`
+	Parameters string        `json:"params"`
+	Beds       int           `json:"beds"`
+	TypeID     int           `json:"room_type_id,omitempty"`
+	Features   *RoomFeatures `json:"features,omitempty"`
+	Guests     []Guest       `json:"guests,omitempty"`
+
+	// set through the housekeeping endpoints
+	Housekeeping string `json:"housekeeping_status,omitempty"`
+	Housekeeper  string `json:"housekeeper,omitempty"`
+
+	// active issues, only filled for a single room
+	Blocks  []RoomBlock         `json:"blocks,omitempty"`
+	Tickets []MaintenanceTicket `json:"tickets,omitempty"`
+}
+
+// room columns with the features inherited from the room type
+const roomColumns = `r.id, r.property_id, r.number, r.params, r.beds, COALESCE(r.room_type_id, 0),
+	COALESCE(r.features, t.features), r.housekeeping_status, r.housekeeper
+	FROM rooms r LEFT JOIN room_types t ON t.id = r.room_type_id`
+
+func (r *Room) scanFields() []interface{} {
+	return []interface{}{&r.ID, &r.PropertyID, &r.Number, &r.Parameters, &r.Beds, &r.TypeID,
+		featuresScanner{&r.Features}, &r.Housekeeping, &r.Housekeeper}
 }
 
-func (r *Room) getRoom(db *sql.DB) error {
-	return db.QueryRow("SELECT number, params, beds FROM rooms WHERE id=$1",
-		r.ID).Scan(&r.Number, &r.Parameters, &r.Beds)
+func (r *Room) getRoom(db queryer) error {
+	return db.QueryRow("SELECT "+roomColumns+" WHERE r.id=$1 AND r.tenant_id = current_tenant()",
+		r.ID).Scan(r.scanFields()...)
 }
 
-func (r *Room) updateRoom(db *sql.DB) error {
-	_, err := db.Exec("UPDATE rooms SET number=$1, params=$2, beds=$3 WHERE id=$4",
-		r.Number, r.Parameters, r.Beds, r.ID)
+// params is kept for older clients, it is derived from the features
+// when only those were sent
+func (r *Room) fillParameters() {
+	if r.Parameters == "" && r.Features != nil {
+		r.Parameters = r.Features.Describe()
+	}
+}
+
+func (r *Room) updateRoom(db queryer) error {
+	r.fillParameters()
+	if r.PropertyID == 0 {
+		// rooms stay where they are unless a property is given
+		err := db.QueryRow("SELECT property_id FROM rooms WHERE id=$1 AND tenant_id = current_tenant()",
+			r.ID).Scan(&r.PropertyID)
+		if err != nil {
+			return err
+		}
+	}
+	if err := r.checkRoomProperty(db); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		`UPDATE rooms SET number=$1, params=$2, beds=$3, room_type_id=$4, features=$5, property_id=$6
+		WHERE id=$7 AND tenant_id = current_tenant()`,
+		r.Number, r.Parameters, r.Beds, nullID(r.TypeID), r.Features, r.PropertyID, r.ID)
 	return err
 }
 
 func (r *Room) deleteRoom(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM rooms WHERE id=$1", r.ID)
+	_, err := db.Exec("DELETE FROM rooms WHERE id=$1 AND tenant_id = current_tenant()", r.ID)
 	return err
 }
 
-func (r *Room) createRoom(db *sql.DB) error {
+func (r *Room) createRoom(db queryer) error {
+	r.fillParameters()
+	if err := r.checkRoomProperty(db); err != nil {
+		return err
+	}
 	err := db.QueryRow(
-		"INSERT INTO rooms(number, params, beds) VALUES($1, $2, $3) RETURNING id",
-		r.Number, r.Parameters, r.Beds).Scan(&r.ID)
+		`INSERT INTO rooms(property_id, number, params, beds, room_type_id, features)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id`,
+		r.PropertyID, r.Number, r.Parameters, r.Beds, nullID(r.TypeID), r.Features).Scan(&r.ID)
 
 	if err != nil {
 		return err
@@ -42,9 +116,11 @@ func (r *Room) createRoom(db *sql.DB) error {
 	return nil
 }
 
-func (r *Room) getRoomGuests(db *sql.DB) error {
+func (r *Room) getRoomGuests(db *sql.DB, kr *Keyring) error {
 	rows, err := db.Query(
-		"SELECT id, name, passport FROM guests WHERE room_id=$1", r.ID)
+		`SELECT g.id, g.name, g.passport_enc, g.passport_dek, g.passport_key_id FROM guests g
+		JOIN stays s ON s.guest_id = g.id
+		WHERE s.room_id=$1 AND s.checked_out_at IS NULL AND g.tenant_id = current_tenant()`, r.ID)
 
 	if err != nil {
 		return err
@@ -56,7 +132,11 @@ func (r *Room) getRoomGuests(db *sql.DB) error {
 
 	for rows.Next() {
 		var g Guest
-		if err := rows.Scan(&g.ID, &g.Name, &g.Passport); err != nil {
+		var p Sealed
+		if err := rows.Scan(&g.ID, &g.Name, &p.Ciphertext, &p.WrappedKey, &p.KeyID); err != nil {
+			return err
+		}
+		if g.Passport, err = kr.Open(p); err != nil {
 			return err
 		}
 
@@ -66,34 +146,43 @@ func (r *Room) getRoomGuests(db *sql.DB) error {
 	return nil
 }
 
-func GetAllGuests(db *sql.DB) ([]Guest, error) {
-	rows, err := db.Query(
-		"SELECT id, name, passport, room_id FROM guests")
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer rows.Close()
-
-	guests := []Guest{}
+// Checks whether the room has a guest with an open stay
+func (r *Room) isOccupied(db queryer) (bool, error) {
+	var occupied bool
+	err := db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM stays
+		WHERE room_id=$1 AND checked_out_at IS NULL AND tenant_id = current_tenant())`,
+		r.ID).Scan(&occupied)
+	return occupied, err
+}
 
-	for rows.Next() {
-		var g Guest
-		if err := rows.Scan(&g.ID, &g.Name, &g.Passport, &g.RoomID); err != nil {
-			return nil, err
-		}
+// Checks whether the room is blocked on any night from from to to
+func (r *Room) isBlocked(db queryer, from, to Date) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM room_blocks
+		WHERE room_id=$1 AND from_date < $3 AND to_date > $2 AND tenant_id = current_tenant())`,
+		r.ID, from, to).Scan(&blocked)
+	return blocked, err
+}
 
-		guests = append(guests, g)
+// roomsQuery selects the rooms of one property, or of all of them when
+// propertyID is 0, that have the features of the filter
+func roomsQuery(propertyID int, filter RoomFilter) (string, []interface{}) {
+	query := "SELECT " + roomColumns + " WHERE r.tenant_id = current_tenant() AND ($1 = 0 OR r.property_id = $1)"
+	args := []interface{}{propertyID}
+	if len(filter) > 0 {
+		query += " AND COALESCE(r.features, t.features) @> $2"
+		args = append(args, filter)
 	}
-
-	return guests, nil
-
+	return query + " ORDER BY r.id", args
 }
 
-func GetAllRoomsWithGuests(db *sql.DB) ([]Room, error) {
-	rows, err := db.Query(
-		"SELECT id, number,  params, beds FROM rooms")
+// GetAllRoomsWithGuests lists the rooms of one property, or of all of them
+// when propertyID is 0
+func GetAllRoomsWithGuests(db *sql.DB, kr *Keyring, propertyID int, filter RoomFilter) ([]Room, error) {
+	query, args := roomsQuery(propertyID, filter)
+	rows, err := db.Query(query, args...)
 
 	if err != nil {
 		return nil, err
@@ -105,10 +194,10 @@ func GetAllRoomsWithGuests(db *sql.DB) ([]Room, error) {
 
 	for rows.Next() {
 		var r Room
-		if err := rows.Scan(&r.ID, &r.Number, &r.Parameters, &r.Beds); err != nil {
+		if err := rows.Scan(r.scanFields()...); err != nil {
 			return nil, err
 		}
-		err = r.getRoomGuests(db)
+		err = r.getRoomGuests(db, kr)
 		if err != nil {
 			return nil, err
 		}
@@ -119,58 +208,384 @@ func GetAllRoomsWithGuests(db *sql.DB) ([]Room, error) {
 
 }
 
+// Guest is a person's profile. It outlives their stays, a returning guest
+// keeps the same profile.
 type Guest struct {
 	ID       int    `json:"id"`
 	Name     string `json:"name"`
 	Passport string `json:"passport"`
-	RoomID   int    `json:"room_id,omitempty"`
+
+	Email       string      `json:"email,omitempty"`
+	Phone       string      `json:"phone,omitempty"`
+	Nationality string      `json:"nationality,omitempty"` // ISO 3166-1 alpha-2
+	DateOfBirth *Date       `json:"date_of_birth,omitempty"`
+	Preferences Preferences `json:"preferences,omitempty"`
+
+	// only filled for a single guest
+	Documents []Document `json:"documents,omitempty"`
+
+	// the room of the open stay. On create, the room to check into, or
+	// RoomTypeID for any free room of that type.
+	RoomID     int `json:"room_id,omitempty"`
+	RoomTypeID int `json:"room_type_id,omitempty"`
 }
 
-func (g *Guest) getGuest(db *sql.DB) error {
-	return db.QueryRow("SELECT name, passport, room_id FROM guests WHERE id=$1",
-		g.ID).Scan(&g.Name, &g.Passport, &g.RoomID)
+// guest columns with the room of the open stay
+const guestColumns = `g.id, g.name, g.passport_enc, g.passport_dek, g.passport_key_id, g.email, g.phone,
+	g.nationality, g.date_of_birth, g.preferences, COALESCE(s.room_id, 0)
+	FROM guests g LEFT JOIN stays s ON s.guest_id = g.id AND s.checked_out_at IS NULL`
+
+// scanGuest reads a row of guestColumns and opens the passport
+func scanGuest(scan func(dest ...interface{}) error, kr *Keyring) (Guest, error) {
+	var g Guest
+	var p Sealed
+	err := scan(&g.ID, &g.Name, &p.Ciphertext, &p.WrappedKey, &p.KeyID, &g.Email, &g.Phone,
+		&g.Nationality, &g.DateOfBirth, &g.Preferences, &g.RoomID)
+	if err != nil {
+		return g, err
+	}
+	g.Passport, err = kr.Open(p)
+	return g, err
 }
 
-func (g *Guest) updateGuest(db *sql.DB) error {
-	_, err := db.Exec("UPDATE guests SET name=$1, passport=$2, room_id=$3 WHERE id=$4",
-		g.Name, g.Passport, g.RoomID, g.ID)
-	return err
+func (g *Guest) getGuest(db queryer, kr *Keyring) error {
+	row := db.QueryRow("SELECT "+guestColumns+" WHERE g.id=$1 AND g.tenant_id = current_tenant()", g.ID)
+	found, err := scanGuest(row.Scan, kr)
+	if err != nil {
+		return err
+	}
+	*g = found
+	return nil
+}
+
+// Looks a guest up by passport number through the keyed hash
+func (g *Guest) getGuestByPassport(db queryer, kr *Keyring) error {
+	err := db.QueryRow("SELECT id FROM guests WHERE passport_hash=$1 AND tenant_id = current_tenant()",
+		kr.Hash(g.Passport)).Scan(&g.ID)
+	if err != nil {
+		return err
+	}
+	return g.getGuest(db, kr)
+}
+
+// updateGuest replaces the profile. Rooms are changed with a move.
+func (g *Guest) updateGuest(db *sql.DB, kr *Keyring) error {
+	current := Guest{ID: g.ID}
+	if err := current.getGuest(db, kr); err != nil {
+		return err
+	}
+	if g.RoomID != 0 && g.RoomID != current.RoomID {
+		if current.RoomID == 0 {
+			return invalidf("Use POST /guest/%d/stays to check in", g.ID)
+		}
+		return invalidf("Use POST /guest/%d/move to change rooms", g.ID)
+	}
+	g.RoomID = current.RoomID
+	if err := g.validateProfile(); err != nil {
+		return err
+	}
+	return g.saveProfile(db, kr)
+}
+
+func (g *Guest) saveProfile(db queryer, kr *Keyring) error {
+	p, err := kr.Seal(g.Passport)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`UPDATE guests SET name=$1, passport_hash=$2, passport_enc=$3, passport_dek=$4,
+		passport_key_id=$5, email=$6, phone=$7, nationality=$8, date_of_birth=$9, preferences=$10
+		WHERE id=$11 AND tenant_id = current_tenant()`,
+		g.Name, kr.Hash(g.Passport), p.Ciphertext, p.WrappedKey, p.KeyID,
+		g.Email, g.Phone, g.Nationality, g.DateOfBirth, g.Preferences, g.ID)
+	if err != nil {
+		return err
+	}
+	return logGuestAudit(db, g.ID, "update")
 }
 
 func (g *Guest) deleteGuest(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM guests WHERE id=$1", g.ID)
+	_, err := db.Exec("DELETE FROM guests WHERE id=$1 AND tenant_id = current_tenant()", g.ID)
 	return err
 }
 
-func (g *Guest) createGuest(db *sql.DB) error {
-	err := g.checkRoom(db)
+// createGuest creates the guest's profile, or reuses the one with the same
+// passport for a returning guest, and checks them in when a room or room
+// type is given
+func (g *Guest) createGuest(db queryer, kr *Keyring) error {
+	if err := g.validateProfile(); err != nil {
+		return err
+	}
+	checkIn := g.RoomID != 0 || g.RoomTypeID != 0
+	if checkIn {
+		if err := g.pickRoom(db); err != nil {
+			return err
+		}
+	}
+
+	returning := Guest{Passport: g.Passport}
+	err := returning.getGuestByPassport(db, kr)
+	switch {
+	case err == sql.ErrNoRows:
+		if err := g.insertProfile(db, kr); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case returning.RoomID != 0 && checkIn:
+		return ErrGuestStaying
+	default:
+		g.ID = returning.ID
+		g.mergeProfile(returning)
+		if !checkIn {
+			g.RoomID = returning.RoomID
+		}
+		if err := g.saveProfile(db, kr); err != nil {
+			return err
+		}
+	}
+
+	if !checkIn {
+		return nil
+	}
+	return g.startStay(db)
+}
+
+func (g *Guest) insertProfile(db queryer, kr *Keyring) error {
+	p, err := kr.Seal(g.Passport)
 	if err != nil {
 		return err
 	}
 
 	err = db.QueryRow(
-		"INSERT INTO guests(name, passport, room_id) VALUES($1, $2, $3) RETURNING id",
-		g.Name, g.Passport, g.RoomID).Scan(&g.ID)
+		`INSERT INTO guests(name, passport_hash, passport_enc, passport_dek, passport_key_id,
+		email, phone, nationality, date_of_birth, preferences)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		g.Name, kr.Hash(g.Passport), p.Ciphertext, p.WrappedKey, p.KeyID,
+		g.Email, g.Phone, g.Nationality, g.DateOfBirth, g.Preferences).Scan(&g.ID)
+	if err != nil {
+		return err
+	}
+	return logGuestAudit(db, g.ID, "create")
+}
+
+// pickRoom resolves RoomTypeID to a free room and checks that the room
+// can be given to the guest
+func (g *Guest) pickRoom(db queryer) error {
+	if g.RoomID == 0 && g.RoomTypeID != 0 {
+		roomID, err := findFreeRoomOfType(db, g.RoomTypeID)
+		if err != nil {
+			return err
+		}
+		g.RoomID = roomID
+	}
+	return g.checkRoom(db)
+}
+
+// startStay checks the guest into g.RoomID
+func (g *Guest) startStay(db queryer) error {
+	_, err := db.Exec(
+		`INSERT INTO stays(guest_id, room_id, property_id)
+		SELECT $1, id, property_id FROM rooms WHERE id=$2 AND tenant_id = current_tenant()`,
+		g.ID, g.RoomID)
+	if err != nil {
+		return err
+	}
+	if err := markOccupied(db, g.RoomID); err != nil {
+		return err
+	}
+	return logGuestAudit(db, g.ID, fmt.Sprintf("check in to room %d", g.RoomID))
+}
+
+// Closes the guest's open stay, which frees the room. Room nights are
+// posted first and the folio is settled with the gateway: a balance is
+// charged to the card, an overpayment refunded. Whatever is left open
+// needs a manager's override. The stay is locked throughout, so a second
+// checkout waits and then finds it closed instead of charging again.
+func (g *Guest) checkout(db *sql.DB, gw PaymentGateway, req CheckoutRequest) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stay, err := g.getLatestStay(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow("SELECT checked_out_at FROM stays WHERE id=$1 FOR UPDATE",
+		stay.ID).Scan(&stay.CheckedOutAt)
+	if err != nil {
+		return err
+	}
+	if stay.CheckedOutAt != nil {
+		return sql.ErrNoRows
+	}
+
+	folio, err := getFolioForStay(tx, stay.ID)
+	if err != nil {
+		return err
+	}
+	if err := folio.postRoomNights(tx, stay, today()); err != nil {
+		return err
+	}
 
+	balance, err := folio.balance(tx)
 	if err != nil {
 		return err
 	}
+	override := req.Override
+	overridden := override != nil && override.Manager != ""
+
+	token := req.PaymentToken
+	if token == "" {
+		if token, err = paymentTokenForStay(tx, stay.ID); err != nil {
+			return err
+		}
+	}
+	var settled int64
+	switch {
+	case balance > 0 && token != "":
+		settled, err = folio.settle(tx, gw, token, balance)
+	case balance < 0:
+		settled, err = folio.refundOverpayment(tx, gw, -balance)
+		settled = -settled
+	}
+	balance -= settled
+
+	// the stay stays open, but what the gateway did is kept
+	if err == nil && balance != 0 {
+		err = ErrBalanceDue
+	}
+	if err != nil && !overridden {
+		if cerr := tx.Commit(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+
+	action := "checkout"
+	if balance != 0 {
+		action = fmt.Sprintf("checkout with balance %d approved by %s: %s",
+			balance, override.Manager, override.Reason)
+	}
+
+	res, err := tx.Exec(`UPDATE stays SET checked_out_at=now()
+		WHERE id=$1 AND checked_out_at IS NULL AND tenant_id = current_tenant()`, stay.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := markDirty(tx, stay.RoomID); err != nil {
+		return err
+	}
+	if err := folio.close(tx); err != nil {
+		return err
+	}
+	if err := logGuestAudit(tx, g.ID, action); err != nil {
+		return err
+	}
+	typeID, err := checkOutReservation(tx, stay)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if typeID != 0 {
+		offerFreedRoom(db, typeID)
+	}
 	return nil
 }
 
+type Stay struct {
+	ID           int        `json:"id"`
+	GuestID      int        `json:"guest_id"`
+	RoomID       int        `json:"room_id"`
+	PropertyID   int        `json:"property_id"`
+	CheckedInAt  time.Time  `json:"checked_in_at"`
+	CheckedOutAt *time.Time `json:"checked_out_at,omitempty"`
+
+	// how the nights are priced: the rate plan of the reservation, and the
+	// room type they are priced as when a rate change was waived on a move
+	RatePlanID     int `json:"rate_plan_id,omitempty"`
+	Guests         int `json:"guests"`
+	PricedAsTypeID int `json:"priced_as_type_id,omitempty"`
+}
+
+const stayColumns = `id, guest_id, room_id, property_id, checked_in_at, checked_out_at, rate_plan_id, guests,
+	COALESCE(rate_type_id, 0)`
+
+func (s *Stay) scanFields() []interface{} {
+	return []interface{}{&s.ID, &s.GuestID, &s.RoomID, &s.PropertyID, &s.CheckedInAt, &s.CheckedOutAt,
+		&s.RatePlanID, &s.Guests, &s.PricedAsTypeID}
+}
+
+func (g *Guest) getGuestStays(db *sql.DB) ([]Stay, error) {
+	rows, err := db.Query(
+		"SELECT "+stayColumns+` FROM stays WHERE guest_id=$1 AND tenant_id = current_tenant()
+		ORDER BY checked_in_at, id`, g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	stays := []Stay{}
+
+	for rows.Next() {
+		var s Stay
+		if err := rows.Scan(s.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		stays = append(stays, s)
+	}
+
+	return stays, nil
+}
+
+func (g *Guest) getLatestStay(db queryer) (Stay, error) {
+	var s Stay
+	err := db.QueryRow(
+		"SELECT "+stayColumns+` FROM stays WHERE guest_id=$1 AND tenant_id = current_tenant()
+		ORDER BY checked_in_at DESC, id DESC LIMIT 1`,
+		g.ID).Scan(s.scanFields()...)
+	return s, err
+}
+
 // Checks if room is available for guest
-func (g *Guest) checkRoom(db *sql.DB) error {
+func (g *Guest) checkRoom(db queryer) error {
 	room := Room{ID: g.RoomID}
 	err := room.getRoom(db)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Room with ID: %d does not exist", room.ID))
 
 	}
-	err = room.getRoomGuests(db)
+	if room.Housekeeping == HousekeepingOutOfOrder {
+		return errors.New(fmt.Sprintf("Room with ID: %d is out of order", room.ID))
+	}
+	if room.Housekeeping == HousekeepingOutOfService {
+		return errors.New(fmt.Sprintf("Room with ID: %d is out of service", room.ID))
+	}
+	blocked, err := room.isBlocked(db, today(), today().AddDays(1))
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errors.New(fmt.Sprintf("Room with ID: %d is blocked", room.ID))
+	}
+	occupied, err := room.isOccupied(db)
 	if err != nil {
 		return err
 	}
-	if len(room.Guests) > 0 {
+	if occupied {
 		return errors.New(fmt.Sprintf("Room with ID: %d already occupied", room.ID))
 	}
 	return nil
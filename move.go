@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrRoomOccupied is returned when moving a guest into an occupied room
+var ErrRoomOccupied = errors.New("Room is occupied")
+
+// MoveRequest is the body of POST /guest/{id}/move
+type MoveRequest struct {
+	RoomID int    `json:"room_id"`
+	Reason string `json:"reason"`
+
+	// keep pricing the remaining nights as the current room type when
+	// moving to another type
+	WaiveRateChange bool `json:"waive_rate_change"`
+}
+
+// move splits the guest's open stay: the stay in the current room ends
+// with its nights posted, a new one starts in the target room and the
+// folio and reservation follow it. The old room is left dirty and the new
+// one occupied. Everything happens in one transaction.
+func (g *Guest) move(db *sql.DB, req MoveRequest) (*Stay, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stay, err := g.getLatestStay(tx)
+	if err != nil {
+		return nil, err
+	}
+	if stay.CheckedOutAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	if req.RoomID == stay.RoomID {
+		return nil, invalidf("Guest is already in room %d", req.RoomID)
+	}
+
+	// lock both rooms, in id order so concurrent moves cannot deadlock
+	if _, err := tx.Exec("SELECT id FROM rooms WHERE id IN ($1, $2) ORDER BY id FOR UPDATE",
+		stay.RoomID, req.RoomID); err != nil {
+		return nil, err
+	}
+	current := Room{ID: stay.RoomID}
+	if err := current.getRoom(tx); err != nil {
+		return nil, err
+	}
+	target := Room{ID: req.RoomID}
+	if err := target.getRoom(tx); err == sql.ErrNoRows {
+		return nil, invalidf("Room with ID: %d does not exist", req.RoomID)
+	} else if err != nil {
+		return nil, err
+	}
+	if target.PropertyID != current.PropertyID {
+		return nil, invalidf("Room with ID: %d is in another property", target.ID)
+	}
+	switch target.Housekeeping {
+	case HousekeepingOutOfOrder:
+		return nil, invalidf("Room with ID: %d is out of order", target.ID)
+	case HousekeepingOutOfService:
+		return nil, invalidf("Room with ID: %d is out of service", target.ID)
+	}
+	if occupied, err := target.isOccupied(tx); err != nil {
+		return nil, err
+	} else if occupied {
+		return nil, ErrRoomOccupied
+	}
+
+	// the reservation already holds a room of its own type; another type
+	// must have a room left for every remaining night
+	departure, err := stayDeparture(tx, stay.ID)
+	if err != nil {
+		return nil, err
+	}
+	if blocked, err := target.isBlocked(tx, today(), departure); err != nil {
+		return nil, err
+	} else if blocked {
+		return nil, invalidf("Room with ID: %d is blocked before departure", target.ID)
+	}
+	if target.TypeID != 0 && target.TypeID != current.TypeID {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", target.TypeID); err != nil {
+			return nil, err
+		}
+		if n, err := availableRooms(tx, target.TypeID, today(), departure); err != nil {
+			return nil, err
+		} else if n < 1 {
+			return nil, ErrNoAvailability
+		}
+	}
+
+	f, err := getFolioForStay(tx, stay.ID)
+	if err != nil {
+		return nil, err
+	}
+	if today().After(stay.CheckedInAt) {
+		if err := f.postRoomNights(tx, stay, today()); err != nil {
+			return nil, err
+		}
+	}
+
+	next := Stay{GuestID: g.ID, RoomID: target.ID, PropertyID: target.PropertyID, Guests: stay.Guests}
+	switch {
+	case target.TypeID == current.TypeID:
+		next.RatePlanID, next.PricedAsTypeID = stay.RatePlanID, stay.PricedAsTypeID
+	case req.WaiveRateChange:
+		next.RatePlanID, next.PricedAsTypeID = stay.RatePlanID, stay.PricedAsTypeID
+		if next.PricedAsTypeID == 0 {
+			next.PricedAsTypeID = current.TypeID
+		}
+	}
+	// otherwise the new type's rates apply
+
+	if _, err := tx.Exec("UPDATE stays SET checked_out_at=now() WHERE id=$1", stay.ID); err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(
+		`INSERT INTO stays(guest_id, room_id, property_id, rate_plan_id, guests, rate_type_id)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id, checked_in_at`,
+		next.GuestID, next.RoomID, next.PropertyID, next.RatePlanID, next.Guests, nullID(next.PricedAsTypeID),
+	).Scan(&next.ID, &next.CheckedInAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE folios SET stay_id=$1 WHERE id=$2", next.ID, f.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE reservations SET stay_id=$1, room_type_id=COALESCE($2, room_type_id) WHERE stay_id=$3",
+		next.ID, nullID(target.TypeID), stay.ID); err != nil {
+		return nil, err
+	}
+	if err := markDirty(tx, current.ID); err != nil {
+		return nil, err
+	}
+	if err := markOccupied(tx, target.ID); err != nil {
+		return nil, err
+	}
+
+	action := fmt.Sprintf("moved from room %d to room %d", current.Number, target.Number)
+	if req.Reason != "" {
+		action += ": " + req.Reason
+	}
+	if err := logGuestAudit(tx, g.ID, action); err != nil {
+		return nil, err
+	}
+
+	return &next, tx.Commit()
+}
+
+// stayDeparture is the reservation's departure, or tomorrow for walk-ins
+// and guests staying past it
+func stayDeparture(db queryer, stayID int) (Date, error) {
+	var departure Date
+	err := db.QueryRow("SELECT departure FROM reservations WHERE stay_id=$1", stayID).Scan(&departure)
+	if err != nil && err != sql.ErrNoRows {
+		return Date{}, err
+	}
+	if tomorrow := today().AddDays(1); departure.Before(tomorrow.Time) {
+		departure = tomorrow
+	}
+	return departure, nil
+}
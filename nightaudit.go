@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// night audit steps, each done once; an interrupted audit resumes after
+// the last one it finished
+const (
+	AuditStarted     = "started"
+	AuditRoomCharges = "room_charges"
+	AuditNoShows     = "no_shows"
+	AuditCompleted   = "completed"
+)
+
+// ErrAuditDone is returned when auditing a business date that was closed
+var ErrAuditDone = errors.New("The night audit of this date has already run")
+
+// ErrAuditRunning is returned when another run of the same audit finished
+// a step first
+var ErrAuditRunning = errors.New("The night audit of this date is running elsewhere")
+
+// NightAudit closes a business date: it posts the night's room charges to
+// the folios of the guests in house, marks the reservations that never
+// arrived as no-shows and keeps the night's statistics. The business date
+// then moves to the next day.
+type NightAudit struct {
+	ID           int         `json:"id"`
+	BusinessDate Date        `json:"business_date"`
+	Step         string      `json:"step"`
+	RoomCharges  int         `json:"room_charges"`
+	NoShows      int         `json:"no_shows"`
+	Stats        *NightStats `json:"stats,omitempty"`
+	StartedAt    time.Time   `json:"started_at"`
+	CompletedAt  *time.Time  `json:"completed_at,omitempty"`
+
+	stats NightStats
+}
+
+const nightAuditColumns = `id, business_date, step, room_charges, no_shows, rooms, occupied, room_revenue,
+	started_at, completed_at`
+
+func (n *NightAudit) scanFields() []interface{} {
+	return []interface{}{&n.ID, &n.BusinessDate, &n.Step, &n.RoomCharges, &n.NoShows, &n.stats.Rooms,
+		&n.stats.Occupied, &n.stats.RoomRevenue, &n.StartedAt, &n.CompletedAt}
+}
+
+// the statistics are kept once the audit completed
+func (n *NightAudit) scanned() {
+	n.Stats = nil
+	if n.Step == AuditCompleted {
+		s := n.stats
+		s.Date = n.BusinessDate
+		s.compute()
+		n.Stats = &s
+	}
+}
+
+// BusinessDate is the day the next night audit closes: the day after the
+// last audit, the date of an interrupted one, or today before the first
+func BusinessDate(db *sql.DB) (Date, error) {
+	var date Date
+	var step string
+	err := db.QueryRow("SELECT business_date, step FROM night_audits ORDER BY business_date DESC LIMIT 1").
+		Scan(&date, &step)
+	switch {
+	case err == sql.ErrNoRows:
+		return today(), nil
+	case err != nil:
+		return Date{}, err
+	case step == AuditCompleted:
+		return date.AddDays(1), nil
+	}
+	return date, nil
+}
+
+// RunNightAudit closes date, the current business date by default. Only
+// the first audit may close an earlier day and no day is closed before it
+// has begun. Every step can be repeated safely, so an audit that was
+// interrupted is finished by running it again.
+func RunNightAudit(db *sql.DB, gw PaymentGateway, date Date) (*NightAudit, error) {
+	current, err := BusinessDate(db)
+	if err != nil {
+		return nil, err
+	}
+	if date.IsZero() {
+		date = current
+	}
+	switch {
+	case date.After(today().Time):
+		return nil, invalidf("The night audit of %s cannot run before that day", date)
+	case date.Before(current.Time):
+		// the first audit may close an earlier day
+		var done, audited bool
+		err := db.QueryRow(
+			`SELECT EXISTS(SELECT 1 FROM night_audits WHERE business_date=$1),
+			EXISTS(SELECT 1 FROM night_audits)`, date).Scan(&done, &audited)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return nil, ErrAuditDone
+		}
+		if audited {
+			return nil, invalidf("The business date is %s", current)
+		}
+	case date.After(current.Time):
+		return nil, invalidf("The business date is %s, audit it first", current)
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO night_audits(business_date, step) VALUES($1, $2)
+		ON CONFLICT (tenant_id, business_date) DO NOTHING`, date, AuditStarted)
+	if err != nil {
+		return nil, err
+	}
+	n := &NightAudit{BusinessDate: date}
+	if err := n.getNightAudit(db); err != nil {
+		return nil, err
+	}
+
+	if n.Step == AuditStarted {
+		if n.RoomCharges, err = postNightCharges(db, date); err != nil {
+			return nil, err
+		}
+		if err := n.setStep(db, AuditStarted, AuditRoomCharges); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Step == AuditRoomCharges {
+		if n.NoShows, err = markAuditNoShows(db, gw, date); err != nil {
+			return nil, err
+		}
+		if err := n.setStep(db, AuditRoomCharges, AuditNoShows); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Step == AuditNoShows {
+		report, err := GetOccupancyReport(db, date, date.AddDays(1))
+		if err != nil {
+			return nil, err
+		}
+		s := report.Nights[0]
+		res, err := db.Exec(
+			`UPDATE night_audits SET step=$1, rooms=$2, occupied=$3, room_revenue=$4, completed_at=now()
+			WHERE id=$5 AND step=$6`,
+			AuditCompleted, s.Rooms, s.Occupied, s.RoomRevenue, n.ID, AuditNoShows)
+		if err != nil {
+			return nil, err
+		}
+		if rows, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if rows == 0 {
+			return nil, ErrAuditRunning
+		}
+	}
+
+	return n, n.getNightAudit(db)
+}
+
+func (n *NightAudit) getNightAudit(db *sql.DB) error {
+	err := db.QueryRow("SELECT "+nightAuditColumns+" FROM night_audits WHERE business_date=$1",
+		n.BusinessDate).Scan(n.scanFields()...)
+	if err != nil {
+		return err
+	}
+	n.scanned()
+	return nil
+}
+
+// setStep records a finished step with its counts. It only moves on from
+// the step before, so concurrent runs cannot take the audit back.
+func (n *NightAudit) setStep(db *sql.DB, from, to string) error {
+	res, err := db.Exec(
+		"UPDATE night_audits SET step=$1, room_charges=$2, no_shows=$3 WHERE id=$4 AND step=$5",
+		to, n.RoomCharges, n.NoShows, n.ID, from)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrAuditRunning
+	}
+	n.Step = to
+	return nil
+}
+
+// postNightCharges posts the nights up to and including date to the folio
+// of every stay in house that night. Nights already posted are skipped.
+// It returns how many stays were charged.
+func postNightCharges(db *sql.DB, date Date) (int, error) {
+	rows, err := db.Query(
+		"SELECT "+stayColumns+` FROM stays WHERE checked_out_at IS NULL AND checked_in_at::date <= $1
+		ORDER BY id`, date)
+
+	if err != nil {
+		return 0, err
+	}
+
+	stays := []Stay{}
+	for rows.Next() {
+		var s Stay
+		if err := rows.Scan(s.scanFields()...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stays = append(stays, s)
+	}
+	rows.Close()
+
+	n := 0
+	for _, s := range stays {
+		if err := postStayNights(db, s, date.AddDays(1)); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+func postStayNights(db *sql.DB, s Stay, until Date) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	f, err := getFolioForStay(tx, s.ID)
+	if err != nil {
+		return err
+	}
+	if f.ClosedAt != nil {
+		return nil
+	}
+	if err := f.postRoomNights(tx, s, until); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// markAuditNoShows flags every confirmed reservation that should have
+// arrived by date and charges the penalties, whatever the no-show cutoff
+// of its policy. It returns how many were marked.
+func markAuditNoShows(db *sql.DB, gw PaymentGateway, date Date) (int, error) {
+	candidates, err := unarrivedReservations(db, date.Time)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := range candidates {
+		err := candidates[i].noShow(db, gw)
+		if err == ErrReservationStatus {
+			// checked in or cancelled meanwhile
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// GetNightAudits lists the audits of the business dates from from up to,
+// but excluding, to, the latest first
+func GetNightAudits(db *sql.DB, from, to Date) ([]NightAudit, error) {
+	rows, err := db.Query(
+		"SELECT "+nightAuditColumns+` FROM night_audits WHERE business_date >= $1 AND business_date < $2
+		ORDER BY business_date DESC`,
+		from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	audits := []NightAudit{}
+
+	for rows.Next() {
+		var n NightAudit
+		if err := rows.Scan(n.scanFields()...); err != nil {
+			return nil, err
+		}
+		n.scanned()
+
+		audits = append(audits, n)
+	}
+
+	return audits, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// OverbookingLimit lets a room type sell Percent more rooms than it has on
+// the nights from From up to, but excluding, To. Where limits overlap the
+// latest one applies.
+type OverbookingLimit struct {
+	ID         int       `json:"id"`
+	RoomTypeID int       `json:"room_type_id"`
+	From       Date      `json:"from"`
+	To         Date      `json:"to"`
+	Percent    int       `json:"percent"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WalkList is a room type booked beyond its rooms on a night, with the
+// arrivals to walk to another hotel. The latest bookings are walked first.
+type WalkList struct {
+	RoomTypeID   int           `json:"room_type_id"`
+	Name         string        `json:"name"`
+	Rooms        int           `json:"rooms"`
+	Booked       int           `json:"booked"`
+	Excess       int           `json:"excess"`
+	Reservations []Reservation `json:"reservations"`
+}
+
+// overbookingOn is the SQL for the overbooking percent of type $1 on the
+// night given by the date expression
+func overbookingOn(date string) string {
+	return `COALESCE((SELECT o.percent FROM overbooking_limits o WHERE o.room_type_id = $1
+		AND o.from_date <= ` + date + ` AND o.to_date > ` + date + ` ORDER BY o.id DESC LIMIT 1), 0)`
+}
+
+func (l *OverbookingLimit) createOverbookingLimit(db *sql.DB) error {
+	if !l.To.After(l.From.Time) {
+		return invalidf("A limit must end after it starts")
+	}
+	if l.Percent < 0 || l.Percent > 100 {
+		return invalidf("Percent must be between 0 and 100")
+	}
+	t := RoomType{ID: l.RoomTypeID}
+	if err := t.getRoomType(db); err != nil {
+		return err
+	}
+	return db.QueryRow(
+		`INSERT INTO overbooking_limits(room_type_id, from_date, to_date, percent) VALUES($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		l.RoomTypeID, l.From, l.To, l.Percent).Scan(&l.ID, &l.CreatedAt)
+}
+
+func (l *OverbookingLimit) deleteOverbookingLimit(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM overbooking_limits WHERE id=$1 AND room_type_id=$2", l.ID, l.RoomTypeID)
+	return err
+}
+
+// GetOverbookingLimits lists a room type's limits still in force after the
+// given date
+func GetOverbookingLimits(db *sql.DB, typeID int, after Date) ([]OverbookingLimit, error) {
+	rows, err := db.Query(
+		`SELECT id, room_type_id, from_date, to_date, percent, created_at FROM overbooking_limits
+		WHERE room_type_id=$1 AND to_date > $2 ORDER BY from_date, id`, typeID, after)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	limits := []OverbookingLimit{}
+
+	for rows.Next() {
+		var l OverbookingLimit
+		if err := rows.Scan(&l.ID, &l.RoomTypeID, &l.From, &l.To, &l.Percent, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		limits = append(limits, l)
+	}
+
+	return limits, nil
+}
+
+// GetWalkList finds the room types with more reservations on the night of
+// date than rooms to put them in. The confirmed arrivals of that day are
+// listed to be walked, the latest booked first, as many as the excess.
+func GetWalkList(db *sql.DB, date Date) ([]WalkList, error) {
+	rows, err := db.Query(
+		`SELECT t.id, t.name,
+			(SELECT count(*) FROM rooms r WHERE r.room_type_id = t.id
+				AND `+roomSellableOn("$1::date")+`),
+			(SELECT count(*) FROM reservations v WHERE v.room_type_id = t.id
+				AND v.status IN ('confirmed', 'checked_in') AND v.arrival <= $1 AND v.departure > $1)
+			+ CASE WHEN $1::date >= $2 THEN (SELECT count(*) FROM stays s JOIN rooms r ON r.id = s.room_id
+				WHERE r.room_type_id = t.id AND s.checked_out_at IS NULL
+				AND NOT EXISTS(SELECT 1 FROM reservations v WHERE v.stay_id = s.id)) ELSE 0 END
+		FROM room_types t ORDER BY t.id`, date, today())
+
+	if err != nil {
+		return nil, err
+	}
+
+	lists := []WalkList{}
+	for rows.Next() {
+		var w WalkList
+		if err := rows.Scan(&w.RoomTypeID, &w.Name, &w.Rooms, &w.Booked); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if w.Booked > w.Rooms {
+			w.Excess = w.Booked - w.Rooms
+			lists = append(lists, w)
+		}
+	}
+	rows.Close()
+
+	for i := range lists {
+		w := &lists[i]
+		if w.Reservations, err = walkReservations(db, w.RoomTypeID, date, w.Excess); err != nil {
+			return nil, err
+		}
+	}
+
+	return lists, nil
+}
+
+func walkReservations(db *sql.DB, typeID int, date Date, n int) ([]Reservation, error) {
+	rows, err := db.Query(
+		"SELECT "+reservationColumns+` FROM reservations
+		WHERE room_type_id=$1 AND status=$2 AND arrival=$3
+		ORDER BY created_at DESC, id DESC LIMIT $4`,
+		typeID, ReservationConfirmed, date, n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	reservations := []Reservation{}
+
+	for rows.Next() {
+		var r Reservation
+		if err := rows.Scan(r.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		reservations = append(reservations, r)
+	}
+
+	return reservations, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// page layout of generated documents, in points on A4
+const (
+	pdfPageWidth   = 595
+	pdfPageHeight  = 842
+	pdfMargin      = 50
+	pdfFontSize    = 10
+	pdfLineHeight  = 14
+	pdfLinesOnPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+)
+
+// renderTextPDF lays out lines of monospaced text on as many pages as
+// needed. It only uses the standard Courier font, so no fonts are embedded.
+func renderTextPDF(lines []string) []byte {
+	pages := [][]string{}
+	for len(lines) > pdfLinesOnPage {
+		pages = append(pages, lines[:pdfLinesOnPage])
+		lines = lines[pdfLinesOnPage:]
+	}
+	pages = append(pages, lines)
+
+	// objects: 1 catalog, 2 page tree, 3 font, then a page and its content per page
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	}
+
+	kids := []string{}
+	for _, page := range pages {
+		pageID := len(objects) + 1
+		contentID := pageID + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n",
+			pdfFontSize, pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] "+
+				"/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+				pdfPageWidth, pdfPageHeight, contentID),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>",
+		strings.Join(kids, " "), len(pages))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1, xref)
+
+	return out.Bytes()
+}
+
+// pdfEscape escapes a string literal and replaces what WinAnsi cannot show
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
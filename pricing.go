@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// maximum number of nights a single quote covers
+const maxQuoteNights = 365
+
+// Date is a calendar day, encoded as "2006-01-02"
+type Date struct {
+	time.Time
+}
+
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return Date{}, invalidf("Invalid date '%s', expected YYYY-MM-DD", s)
+	}
+	return Date{t}, nil
+}
+
+func (d Date) String() string {
+	return d.Format(dateLayout)
+}
+
+func (d Date) AddDays(n int) Date {
+	return Date{d.AddDate(0, 0, n)}
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Date) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseDate(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func (d Date) Value() (driver.Value, error) {
+	return d.Time, nil
+}
+
+func (d *Date) Scan(src interface{}) error {
+	t, ok := src.(time.Time)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Date", src)
+	}
+	d.Time = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return nil
+}
+
+// Season overrides the plan's rates between From and To, both inclusive
+type Season struct {
+	Name        string `json:"name"`
+	From        Date   `json:"from"`
+	To          Date   `json:"to"`
+	Rate        int64  `json:"rate"`
+	WeekendRate int64  `json:"weekend_rate,omitempty"`
+}
+
+// LOSDiscount takes Percent off the room rate of stays of at least MinNights
+type LOSDiscount struct {
+	MinNights int   `json:"min_nights"`
+	Percent   int64 `json:"percent"`
+}
+
+// RatePlan prices a room type. All amounts are minor units per night.
+type RatePlan struct {
+	ID         int    `json:"id"`
+	RoomTypeID int    `json:"room_type_id"`
+	Name       string `json:"name"`
+	Currency   string `json:"currency"`
+	BaseRate   int64  `json:"base_rate"`
+
+	// applies to Friday and Saturday nights, 0 means same as BaseRate
+	WeekendRate int64 `json:"weekend_rate,omitempty"`
+
+	// guests above BaseOccupancy pay ExtraGuestFee each per night
+	BaseOccupancy int   `json:"base_occupancy"`
+	ExtraGuestFee int64 `json:"extra_guest_fee,omitempty"`
+
+	Seasons      seasonList      `json:"seasons"`
+	LOSDiscounts losDiscountList `json:"los_discounts"`
+
+	// the default policy applies when not set
+	Cancellation *CancellationPolicy `json:"cancellation_policy,omitempty"`
+}
+
+type seasonList []Season
+
+func (l seasonList) Value() (driver.Value, error) {
+	if l == nil {
+		l = seasonList{}
+	}
+	return json.Marshal([]Season(l))
+}
+
+func (l *seasonList) Scan(src interface{}) error {
+	return scanJSON(src, (*[]Season)(l))
+}
+
+type losDiscountList []LOSDiscount
+
+func (l losDiscountList) Value() (driver.Value, error) {
+	if l == nil {
+		l = losDiscountList{}
+	}
+	return json.Marshal([]LOSDiscount(l))
+}
+
+func (l *losDiscountList) Scan(src interface{}) error {
+	return scanJSON(src, (*[]LOSDiscount)(l))
+}
+
+func scanJSON(src interface{}, dest interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(v, dest)
+	case string:
+		return json.Unmarshal([]byte(v), dest)
+	default:
+		return fmt.Errorf("cannot scan %T into %T", src, dest)
+	}
+}
+
+// Validate checks the plan for values the engine cannot price
+func (p *RatePlan) Validate() error {
+	if p.Currency == "" {
+		p.Currency = BaseCurrency
+	}
+	var err error
+	if p.Currency, err = normaliseCurrency(p.Currency); err != nil {
+		return err
+	}
+	if p.BaseRate < 0 || p.WeekendRate < 0 || p.ExtraGuestFee < 0 {
+		return invalidf("Rates must not be negative")
+	}
+	for _, s := range p.Seasons {
+		if s.To.Before(s.From.Time) {
+			return invalidf("Season '%s' ends before it starts", s.Name)
+		}
+		if s.Rate < 0 || s.WeekendRate < 0 {
+			return invalidf("Rates must not be negative")
+		}
+	}
+	for _, d := range p.LOSDiscounts {
+		if d.Percent < 0 || d.Percent > 100 {
+			return invalidf("Discount percent must be between 0 and 100")
+		}
+	}
+	if p.Cancellation != nil {
+		return p.Cancellation.Validate()
+	}
+	return nil
+}
+
+// NightPrice is the price of one night of a quote
+type NightPrice struct {
+	Date      Date   `json:"date"`
+	Season    string `json:"season,omitempty"`
+	Rate      int64  `json:"rate"`
+	Discount  int64  `json:"discount"`
+	Surcharge int64  `json:"surcharge"`
+	Amount    int64  `json:"amount"`
+}
+
+type Quote struct {
+	RoomTypeID int          `json:"room_type_id"`
+	RatePlanID int          `json:"rate_plan_id,omitempty"`
+	Currency   string       `json:"currency"`
+	From       Date         `json:"from"`
+	To         Date         `json:"to"`
+	Guests     int          `json:"guests"`
+	Nights     []NightPrice `json:"nights"`
+	Total      int64        `json:"total"`
+
+	// taxes and fees, GrandTotal adds those not included in the rates
+	Taxes      []TaxAmount `json:"taxes"`
+	GrandTotal int64       `json:"grand_total"`
+
+	// set when the quote was converted from the rate plan's currency
+	ExchangeRate string `json:"exchange_rate,omitempty"`
+}
+
+// applyTaxes adds the taxes of the stay to the quote. ages has one entry
+// per guest, -1 when not known.
+func (q *Quote) applyTaxes(rules []TaxRule, ages []int) {
+	taxables := []Taxable{}
+	for _, n := range q.Nights {
+		taxables = append(taxables, Taxable{Category: "room", Amount: n.Amount})
+	}
+
+	q.Taxes = ComputeTaxes(rules, taxables, TaxContext{Nights: len(q.Nights), Ages: ages})
+	q.GrandTotal = q.Total
+	for _, t := range q.Taxes {
+		if !t.Inclusive {
+			q.GrandTotal += t.Amount
+		}
+	}
+}
+
+// Price computes the quote for the nights from..to-1. The result only
+// depends on its arguments.
+func (p *RatePlan) Price(from, to Date, guests int) (*Quote, error) {
+	nights := int(to.Sub(from.Time).Hours() / 24)
+	if nights < 1 {
+		return nil, invalidf("'to' must be after 'from'")
+	}
+	if nights > maxQuoteNights {
+		return nil, invalidf("Stays longer than %d nights cannot be quoted", maxQuoteNights)
+	}
+	if guests < 1 {
+		return nil, invalidf("At least one guest is required")
+	}
+
+	var percent int64
+	for _, d := range p.LOSDiscounts {
+		if nights >= d.MinNights && d.Percent > percent {
+			percent = d.Percent
+		}
+	}
+
+	var surcharge int64
+	if p.BaseOccupancy > 0 && guests > p.BaseOccupancy {
+		surcharge = int64(guests-p.BaseOccupancy) * p.ExtraGuestFee
+	}
+
+	q := &Quote{RoomTypeID: p.RoomTypeID, RatePlanID: p.ID, Currency: p.Currency,
+		From: from, To: to, Guests: guests}
+	for i := 0; i < nights; i++ {
+		night := from.AddDays(i)
+		n := NightPrice{Date: night, Surcharge: surcharge}
+		n.Season, n.Rate = p.nightlyRate(night)
+		n.Discount = percentOf(n.Rate, percent)
+		n.Amount = n.Rate - n.Discount + n.Surcharge
+
+		q.Nights = append(q.Nights, n)
+		q.Total += n.Amount
+	}
+
+	return q, nil
+}
+
+// rate of a single night before discounts, and the season it came from
+func (p *RatePlan) nightlyRate(night Date) (string, int64) {
+	weekend := night.Weekday() == time.Friday || night.Weekday() == time.Saturday
+
+	for _, s := range p.Seasons {
+		if night.Before(s.From.Time) || night.After(s.To.Time) {
+			continue
+		}
+		if weekend && s.WeekendRate > 0 {
+			return s.Name, s.WeekendRate
+		}
+		return s.Name, s.Rate
+	}
+
+	if weekend && p.WeekendRate > 0 {
+		return "", p.WeekendRate
+	}
+	return "", p.BaseRate
+}
+
+// percentOf rounds half up
+func percentOf(amount, percent int64) int64 {
+	return (amount*percent + 50) / 100
+}
+
+// convert restates every amount of the quote in currency, at the rates
+// effective on the day the quote is made. Totals are summed again from
+// the converted amounts.
+func (q *Quote) convert(db *sql.DB, currency string, on Date) error {
+	if currency == q.Currency {
+		return nil
+	}
+	fromRate, err := getRate(db, q.Currency, on)
+	if err != nil {
+		return err
+	}
+	toRate, err := getRate(db, currency, on)
+	if err != nil {
+		return err
+	}
+
+	conv := func(amount int64) int64 {
+		return convertAt(amount, q.Currency, currency, fromRate, toRate).Amount
+	}
+
+	q.Total = 0
+	for i := range q.Nights {
+		n := &q.Nights[i]
+		n.Rate, n.Discount, n.Surcharge = conv(n.Rate), conv(n.Discount), conv(n.Surcharge)
+		n.Amount = n.Rate - n.Discount + n.Surcharge
+		q.Total += n.Amount
+	}
+	q.GrandTotal = q.Total
+	for i := range q.Taxes {
+		t := &q.Taxes[i]
+		t.Amount = conv(t.Amount)
+		if !t.Inclusive {
+			q.GrandTotal += t.Amount
+		}
+	}
+
+	q.ExchangeRate = crossRate(fromRate, toRate)
+	q.Currency = currency
+	return nil
+}
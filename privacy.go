@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	GuestID   int       `json:"guest_id"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// the name an erased guest is left with
+const erasedName = "Erased guest"
+
+// GuestExport is everything we hold about a single guest
+type GuestExport struct {
+	Profile      Guest           `json:"profile"`
+	ErasedAt     *time.Time      `json:"erased_at,omitempty"`
+	Stays        []Stay          `json:"stays"`
+	Folios       []Folio         `json:"folios"`
+	Invoices     []Invoice       `json:"invoices"`
+	Reservations []Reservation   `json:"reservations"`
+	Payments     []PaymentRecord `json:"payments"`
+	Waitlist     []WaitlistEntry `json:"waitlist"`
+	Audit        []AuditEntry    `json:"audit"`
+	ExportedAt   time.Time       `json:"exported_at"`
+}
+
+func logGuestAudit(db queryer, guestID int, action string) error {
+	_, err := db.Exec("INSERT INTO guest_audit(guest_id, action) VALUES($1, $2)",
+		guestID, action)
+	return err
+}
+
+func (g *Guest) getGuestAudit(db *sql.DB) ([]AuditEntry, error) {
+	rows, err := db.Query(
+		`SELECT id, guest_id, action, created_at FROM guest_audit
+		WHERE guest_id=$1 AND tenant_id = current_tenant() ORDER BY id`,
+		g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.GuestID, &e.Action, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func (g *Guest) exportGuest(db *sql.DB, kr *Keyring) (*GuestExport, error) {
+	if err := g.getGuest(db, kr); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if g.Documents, err = g.getDocuments(db, kr); err != nil {
+		return nil, err
+	}
+
+	e := &GuestExport{Profile: *g, ExportedAt: time.Now().UTC()}
+	err = db.QueryRow("SELECT erased_at FROM guests WHERE id=$1 AND tenant_id = current_tenant()",
+		g.ID).Scan(&e.ErasedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Stays, err = g.getGuestStays(db); err != nil {
+		return nil, err
+	}
+	if e.Folios, err = g.getGuestFolios(db); err != nil {
+		return nil, err
+	}
+	if e.Invoices, err = g.getGuestInvoices(db); err != nil {
+		return nil, err
+	}
+	if e.Reservations, err = g.getGuestReservations(db); err != nil {
+		return nil, err
+	}
+	if e.Payments, err = g.getGuestPayments(db); err != nil {
+		return nil, err
+	}
+	if e.Waitlist, err = g.getGuestWaitlist(db); err != nil {
+		return nil, err
+	}
+
+	// the export itself is recorded before the audit trail is read,
+	// so the bundle shows that it was handed out
+	if err = logGuestAudit(db, g.ID, "export"); err != nil {
+		return nil, err
+	}
+	if e.Audit, err = g.getGuestAudit(db); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Replaces personal fields with placeholders and deletes the documents,
+// also where the guest's name was copied to reservations, waitlist entries
+// and invoices. Stays are kept so that occupancy statistics stay intact,
+// but no longer point to a person.
+func (g *Guest) eraseGuest(db *sql.DB, kr *Keyring) error {
+	pseudonym := fmt.Sprintf("ERASED-%d", g.ID)
+	p, err := kr.Seal(pseudonym)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// matched by the guest's email, so before it is cleared
+	_, err = tx.Exec("UPDATE waitlist w SET name=$2, email='' WHERE "+guestWaitlistEntries, g.ID, erasedName)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(
+		`UPDATE guests SET name=$1, passport_hash=$2, passport_enc=$3, passport_dek=$4,
+		passport_key_id=$5, email='', phone='', nationality='', date_of_birth=NULL, preferences='[]',
+		erased_at=now() WHERE id=$6 AND erased_at IS NULL AND tenant_id = current_tenant()`,
+		erasedName, kr.Hash(pseudonym), p.Ciphertext, p.WrappedKey, p.KeyID, g.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM guest_documents WHERE guest_id=$1 AND tenant_id = current_tenant()",
+		g.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`UPDATE invoices SET data = jsonb_set(data, '{guest_name}', to_jsonb($1::text))
+		WHERE guest_id=$2 AND tenant_id = current_tenant()`, erasedName, g.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`UPDATE reservations SET name=$1 WHERE tenant_id = current_tenant()
+		AND stay_id IN (SELECT id FROM stays WHERE guest_id=$2)`, erasedName, g.ID)
+	if err != nil {
+		return err
+	}
+	if err := logGuestAudit(tx, g.ID, "erase"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return g.getGuest(db, kr)
+}
+
+// AnonymiseExpiredGuests erases every guest whose last stay ended more
+// than days ago and returns how many were erased
+func AnonymiseExpiredGuests(db *sql.DB, kr *Keyring, days int) (int, error) {
+	rows, err := db.Query(
+		`SELECT g.id FROM guests g
+		JOIN stays s ON s.guest_id = g.id
+		WHERE g.erased_at IS NULL AND g.tenant_id = current_tenant()
+		GROUP BY g.id
+		HAVING bool_and(s.checked_out_at IS NOT NULL)
+		AND max(s.checked_out_at) < now() - make_interval(days => $1)`, days)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		g := Guest{ID: id}
+		if err := g.eraseGuest(db, kr); err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+
+	return len(ids), nil
+}
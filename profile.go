@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrGuestStaying is returned when checking in a guest who has an open stay
+var ErrGuestStaying = errors.New("Guest is already checked in")
+
+// Preferences are free-form wishes kept on the profile, e.g. "high floor"
+type Preferences []string
+
+func (p Preferences) Value() (driver.Value, error) {
+	if p == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(p)
+}
+
+func (p *Preferences) Scan(src interface{}) error {
+	return scanJSON(src, p)
+}
+
+// document kinds
+var documentKinds = map[string]bool{
+	"passport": true, "id_card": true, "visa": true, "driving_licence": true,
+}
+
+// Document is an identity document of a guest. The number is sealed like
+// the passport.
+type Document struct {
+	ID        int    `json:"id"`
+	GuestID   int    `json:"guest_id"`
+	Kind      string `json:"kind"`
+	Number    string `json:"number"`
+	Country   string `json:"country,omitempty"`
+	ExpiresOn *Date  `json:"expires_on,omitempty"`
+}
+
+// GuestSearch filters GET /guests. Name matches any part of the name,
+// phone numbers match on their digits.
+type GuestSearch struct {
+	Name        string
+	Email       string
+	Phone       string
+	Nationality string
+	InHouse     bool
+}
+
+// DuplicateGuests is a pair of profiles that look like the same person
+type DuplicateGuests struct {
+	GuestIDs []int    `json:"guest_ids"`
+	Reasons  []string `json:"reasons"`
+}
+
+// MergeRequest is the body of POST /guest/{id}/merge
+type MergeRequest struct {
+	GuestIDs []int `json:"guest_ids"`
+}
+
+func isCountryCode(c string) bool {
+	if len(c) != 2 {
+		return false
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func phoneDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func (g *Guest) validateProfile() error {
+	if g.Name == "" {
+		return invalidf("Name is required")
+	}
+	g.Email = strings.ToLower(strings.TrimSpace(g.Email))
+	if g.Email != "" && !strings.Contains(g.Email, "@") {
+		return invalidf("Invalid email '%s'", g.Email)
+	}
+	g.Nationality = strings.ToUpper(strings.TrimSpace(g.Nationality))
+	if g.Nationality != "" && !isCountryCode(g.Nationality) {
+		return invalidf("Invalid nationality '%s', expected a two-letter country code", g.Nationality)
+	}
+	if g.DateOfBirth != nil && !g.DateOfBirth.Before(today().Time) {
+		return invalidf("Date of birth must be in the past")
+	}
+	return nil
+}
+
+// mergeProfile fills what g does not have from other and adds other's
+// preferences
+func (g *Guest) mergeProfile(other Guest) {
+	if g.Email == "" {
+		g.Email = other.Email
+	}
+	if g.Phone == "" {
+		g.Phone = other.Phone
+	}
+	if g.Nationality == "" {
+		g.Nationality = other.Nationality
+	}
+	if g.DateOfBirth == nil {
+		g.DateOfBirth = other.DateOfBirth
+	}
+	seen := map[string]bool{}
+	for _, p := range g.Preferences {
+		seen[p] = true
+	}
+	for _, p := range other.Preferences {
+		if !seen[p] {
+			g.Preferences = append(g.Preferences, p)
+			seen[p] = true
+		}
+	}
+}
+
+// guestSearchConditions match the guest g with the open stay s to the
+// arguments of a GuestSearch
+const guestSearchConditions = `g.tenant_id = current_tenant()
+	AND ($1 = '' OR g.name ILIKE '%' || $1 || '%')
+	AND ($2 = '' OR g.email = lower($2))
+	AND ($3 = '' OR regexp_replace(g.phone, '\D', '', 'g') = $3)
+	AND ($4 = '' OR g.nationality = upper($4))
+	AND (NOT $5 OR s.id IS NOT NULL)`
+
+func (q GuestSearch) args() []interface{} {
+	return []interface{}{q.Name, strings.TrimSpace(q.Email), phoneDigits(q.Phone), q.Nationality, q.InHouse}
+}
+
+// SearchGuests lists the profiles matching the search, all of them for an
+// empty one
+func SearchGuests(db *sql.DB, kr *Keyring, q GuestSearch) ([]Guest, error) {
+	rows, err := db.Query("SELECT "+guestColumns+" WHERE "+guestSearchConditions+" ORDER BY g.id", q.args()...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	guests := []Guest{}
+
+	for rows.Next() {
+		g, err := scanGuest(rows.Scan, kr)
+		if err != nil {
+			return nil, err
+		}
+
+		guests = append(guests, g)
+	}
+
+	return guests, nil
+}
+
+// checkInProfile starts a new stay for an existing profile
+func (g *Guest) checkInProfile(db queryer, kr *Keyring, room Guest) (*Stay, error) {
+	if err := g.getGuest(db, kr); err != nil {
+		return nil, err
+	}
+	if g.RoomID != 0 {
+		return nil, ErrGuestStaying
+	}
+	g.RoomID, g.RoomTypeID = room.RoomID, room.RoomTypeID
+	if g.RoomID == 0 && g.RoomTypeID == 0 {
+		return nil, invalidf("room_id or room_type_id is required")
+	}
+	if err := g.pickRoom(db); err != nil {
+		return nil, err
+	}
+	if err := g.startStay(db); err != nil {
+		return nil, err
+	}
+	stay, err := g.getLatestStay(db)
+	return &stay, err
+}
+
+func (d *Document) createDocument(db *sql.DB, kr *Keyring) error {
+	if !documentKinds[d.Kind] {
+		return invalidf("Unknown document kind '%s'", d.Kind)
+	}
+	if d.Number == "" {
+		return invalidf("Number is required")
+	}
+	d.Country = strings.ToUpper(d.Country)
+	if d.Country != "" && !isCountryCode(d.Country) {
+		return invalidf("Invalid country '%s', expected a two-letter country code", d.Country)
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM guests WHERE id=$1 AND tenant_id = current_tenant())",
+		d.GuestID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	p, err := kr.Seal(d.Number)
+	if err != nil {
+		return err
+	}
+	return db.QueryRow(
+		`INSERT INTO guest_documents(guest_id, kind, number_enc, number_dek, number_key_id, country, expires_on)
+		VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		d.GuestID, d.Kind, p.Ciphertext, p.WrappedKey, p.KeyID, d.Country, d.ExpiresOn).Scan(&d.ID)
+}
+
+func (d *Document) deleteDocument(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM guest_documents WHERE id=$1 AND guest_id=$2", d.ID, d.GuestID)
+	return err
+}
+
+func (g *Guest) getDocuments(db *sql.DB, kr *Keyring) ([]Document, error) {
+	rows, err := db.Query(
+		`SELECT id, guest_id, kind, number_enc, number_dek, number_key_id, country, expires_on
+		FROM guest_documents WHERE guest_id=$1 ORDER BY id`, g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	documents := []Document{}
+
+	for rows.Next() {
+		var d Document
+		var p Sealed
+		if err := rows.Scan(&d.ID, &d.GuestID, &d.Kind, &p.Ciphertext, &p.WrappedKey, &p.KeyID,
+			&d.Country, &d.ExpiresOn); err != nil {
+			return nil, err
+		}
+		if d.Number, err = kr.Open(p); err != nil {
+			return nil, err
+		}
+
+		documents = append(documents, d)
+	}
+
+	return documents, nil
+}
+
+// FindDuplicateGuests pairs up profiles with the same email, the same phone
+// number, or the same name and date of birth. Erased guests are left out.
+func FindDuplicateGuests(db *sql.DB) ([]DuplicateGuests, error) {
+	rows, err := db.Query(
+		`SELECT a.id, b.id,
+		a.email <> '' AND a.email = b.email,
+		regexp_replace(a.phone, '\D', '', 'g') <> ''
+			AND regexp_replace(a.phone, '\D', '', 'g') = regexp_replace(b.phone, '\D', '', 'g'),
+		a.date_of_birth = b.date_of_birth AND lower(a.name) = lower(b.name)
+		FROM guests a JOIN guests b ON a.id < b.id AND b.tenant_id = a.tenant_id
+		WHERE a.tenant_id = current_tenant() AND a.erased_at IS NULL AND b.erased_at IS NULL
+		AND ((a.email <> '' AND a.email = b.email)
+			OR (regexp_replace(a.phone, '\D', '', 'g') <> ''
+			AND regexp_replace(a.phone, '\D', '', 'g') = regexp_replace(b.phone, '\D', '', 'g'))
+			OR (a.date_of_birth = b.date_of_birth AND lower(a.name) = lower(b.name)))
+		ORDER BY a.id, b.id`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	pairs := []DuplicateGuests{}
+
+	for rows.Next() {
+		var a, b int
+		var email, phone, nameAndBirth sql.NullBool
+		if err := rows.Scan(&a, &b, &email, &phone, &nameAndBirth); err != nil {
+			return nil, err
+		}
+		d := DuplicateGuests{GuestIDs: []int{a, b}, Reasons: []string{}}
+		if email.Bool {
+			d.Reasons = append(d.Reasons, "email")
+		}
+		if phone.Bool {
+			d.Reasons = append(d.Reasons, "phone")
+		}
+		if nameAndBirth.Bool {
+			d.Reasons = append(d.Reasons, "name_and_date_of_birth")
+		}
+
+		pairs = append(pairs, d)
+	}
+
+	return pairs, nil
+}
+
+// merge folds the other profiles into g: their stays, documents, invoices
+// and audit trail move over, missing details are filled in and their
+// passports are kept as documents. The other profiles are deleted. Two
+// profiles with open stays cannot be merged.
+func (g *Guest) merge(db *sql.DB, kr *Keyring, ids []int) error {
+	if len(ids) == 0 {
+		return invalidf("guest_ids is required")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the profiles in id order so concurrent merges cannot deadlock
+	locked := append([]int{g.ID}, ids...)
+	sort.Ints(locked)
+	for i, id := range locked {
+		if i > 0 && locked[i-1] == id {
+			return invalidf("Guest %d is given twice", id)
+		}
+		var erased bool
+		err := tx.QueryRow(
+			"SELECT erased_at IS NOT NULL FROM guests WHERE id=$1 AND tenant_id = current_tenant() FOR UPDATE",
+			id).Scan(&erased)
+		if err == sql.ErrNoRows && id != g.ID {
+			return invalidf("Guest with ID: %d does not exist", id)
+		}
+		if err != nil {
+			return err
+		}
+		if erased {
+			return invalidf("Guest with ID: %d is erased", id)
+		}
+	}
+
+	if err := g.getGuest(tx, kr); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		other := Guest{ID: id}
+		if err := other.getGuest(tx, kr); err != nil {
+			return err
+		}
+		if g.RoomID != 0 && other.RoomID != 0 {
+			return ErrGuestStaying
+		}
+		if g.RoomID == 0 {
+			g.RoomID = other.RoomID
+		}
+		g.mergeProfile(other)
+
+		for _, table := range []string{"stays", "guest_documents", "invoices", "guest_audit"} {
+			if _, err := tx.Exec("UPDATE "+table+" SET guest_id=$1 WHERE guest_id=$2", g.ID, id); err != nil {
+				return err
+			}
+		}
+		if other.Passport != g.Passport {
+			_, err := tx.Exec(
+				`INSERT INTO guest_documents(guest_id, kind, number_enc, number_dek, number_key_id)
+				SELECT $1, 'passport', passport_enc, passport_dek, passport_key_id FROM guests WHERE id=$2`,
+				g.ID, id)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM guests WHERE id=$1", id); err != nil {
+			return err
+		}
+		if err := logGuestAudit(tx, g.ID, fmt.Sprintf("merged guest %d", id)); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		`UPDATE guests SET email=$1, phone=$2, nationality=$3, date_of_birth=$4, preferences=$5
+		WHERE id=$6`,
+		g.Email, g.Phone, g.Nationality, g.DateOfBirth, g.Preferences, g.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
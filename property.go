@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ErrPropertyInUse is returned when deleting a property that has rooms
+var ErrPropertyInUse = errors.New("Property still has rooms")
+
+// Property is one hotel of the group. Rooms, room types and stays belong
+// to a property; guests are shared by all of them.
+type Property struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+}
+
+func (p *Property) getProperty(db queryer) error {
+	return db.QueryRow("SELECT name, address FROM properties WHERE id=$1 AND tenant_id = current_tenant()",
+		p.ID).Scan(&p.Name, &p.Address)
+}
+
+func (p *Property) updateProperty(db *sql.DB) error {
+	if p.Name == "" {
+		return invalidf("Name is required")
+	}
+	_, err := db.Exec("UPDATE properties SET name=$1, address=$2 WHERE id=$3 AND tenant_id = current_tenant()",
+		p.Name, p.Address, p.ID)
+	return err
+}
+
+func (p *Property) deleteProperty(db *sql.DB) error {
+	var inUse bool
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM rooms WHERE property_id=$1 AND tenant_id = current_tenant())",
+		p.ID).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrPropertyInUse
+	}
+	_, err = db.Exec("DELETE FROM properties WHERE id=$1 AND tenant_id = current_tenant()", p.ID)
+	return err
+}
+
+func (p *Property) createProperty(db *sql.DB) error {
+	if p.Name == "" {
+		return invalidf("Name is required")
+	}
+	return db.QueryRow("INSERT INTO properties(name, address) VALUES($1, $2) RETURNING id",
+		p.Name, p.Address).Scan(&p.ID)
+}
+
+// defaultPropertyID is the property rooms and room types belong to when
+// none is given, the tenant's first one
+func defaultPropertyID(db queryer) (int, error) {
+	var id int
+	err := db.QueryRow(
+		"SELECT COALESCE(min(id), 0) FROM properties WHERE tenant_id = current_tenant()").Scan(&id)
+	return id, err
+}
+
+func GetAllProperties(db *sql.DB) ([]Property, error) {
+	rows, err := db.Query(
+		"SELECT id, name, address FROM properties WHERE tenant_id = current_tenant() ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	properties := []Property{}
+
+	for rows.Next() {
+		var p Property
+		if err := rows.Scan(&p.ID, &p.Name, &p.Address); err != nil {
+			return nil, err
+		}
+
+		properties = append(properties, p)
+	}
+
+	return properties, nil
+}
+
+// checkRoomProperty fills in the default property and makes sure the
+// room number is free in it and the room's type belongs to it
+func (r *Room) checkRoomProperty(db queryer) error {
+	if r.PropertyID == 0 {
+		id, err := defaultPropertyID(db)
+		if err != nil {
+			return err
+		}
+		r.PropertyID = id
+	}
+	p := Property{ID: r.PropertyID}
+	if err := p.getProperty(db); err == sql.ErrNoRows {
+		return invalidf("Property with ID: %d does not exist", r.PropertyID)
+	} else if err != nil {
+		return err
+	}
+	var taken bool
+	err := db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM rooms
+		WHERE property_id=$1 AND number=$2 AND id<>$3 AND tenant_id = current_tenant())`,
+		r.PropertyID, r.Number, r.ID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return invalidf("Room %d already exists in %s", r.Number, p.Name)
+	}
+	if r.TypeID == 0 {
+		return nil
+	}
+	var typeProperty int
+	err = db.QueryRow(
+		"SELECT property_id FROM room_types WHERE id=$1 AND tenant_id = current_tenant()",
+		r.TypeID).Scan(&typeProperty)
+	if err == sql.ErrNoRows {
+		return invalidf("Room type with ID: %d does not exist", r.TypeID)
+	}
+	if err != nil {
+		return err
+	}
+	if typeProperty != r.PropertyID {
+		return invalidf("Room type %d belongs to another property", r.TypeID)
+	}
+	return nil
+}
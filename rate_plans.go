@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+)
+
+const ratePlanColumns = `id, room_type_id, name, currency, base_rate, weekend_rate, base_occupancy,
+	extra_guest_fee, seasons, los_discounts, cancellation_policy`
+
+func (p *RatePlan) scanFields() []interface{} {
+	return []interface{}{&p.ID, &p.RoomTypeID, &p.Name, &p.Currency, &p.BaseRate, &p.WeekendRate,
+		&p.BaseOccupancy, &p.ExtraGuestFee, &p.Seasons, &p.LOSDiscounts,
+		policyScanner{&p.Cancellation}}
+}
+
+func (p *RatePlan) getRatePlan(db queryer) error {
+	return db.QueryRow("SELECT "+ratePlanColumns+" FROM rate_plans WHERE id=$1",
+		p.ID).Scan(p.scanFields()...)
+}
+
+func (p *RatePlan) updateRatePlan(db *sql.DB) error {
+	_, err := db.Exec(
+		`UPDATE rate_plans SET room_type_id=$1, name=$2, currency=$3, base_rate=$4, weekend_rate=$5,
+		base_occupancy=$6, extra_guest_fee=$7, seasons=$8, los_discounts=$9, cancellation_policy=$10
+		WHERE id=$11`,
+		p.RoomTypeID, p.Name, p.Currency, p.BaseRate, p.WeekendRate, p.BaseOccupancy, p.ExtraGuestFee,
+		p.Seasons, p.LOSDiscounts, p.Cancellation, p.ID)
+	return err
+}
+
+func (p *RatePlan) deleteRatePlan(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM rate_plans WHERE id=$1", p.ID)
+	return err
+}
+
+func (p *RatePlan) createRatePlan(db *sql.DB) error {
+	return db.QueryRow(
+		`INSERT INTO rate_plans(room_type_id, name, currency, base_rate, weekend_rate, base_occupancy,
+		extra_guest_fee, seasons, los_discounts, cancellation_policy)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		p.RoomTypeID, p.Name, p.Currency, p.BaseRate, p.WeekendRate, p.BaseOccupancy, p.ExtraGuestFee,
+		p.Seasons, p.LOSDiscounts, p.Cancellation).Scan(&p.ID)
+}
+
+// GetAllRatePlans lists the plans of one room type, or all plans when typeID is 0
+func GetAllRatePlans(db *sql.DB, typeID int) ([]RatePlan, error) {
+	rows, err := db.Query(
+		"SELECT "+ratePlanColumns+" FROM rate_plans WHERE $1 = 0 OR room_type_id = $1 ORDER BY id",
+		typeID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	plans := []RatePlan{}
+
+	for rows.Next() {
+		var p RatePlan
+		if err := rows.Scan(p.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		plans = append(plans, p)
+	}
+
+	return plans, nil
+}
+
+// Finds the plan to price a room type with: the requested plan, else the
+// type's first plan, else a flat plan built from the type's default rate
+func ratePlanForType(db queryer, typeID, planID int) (*RatePlan, error) {
+	if planID != 0 {
+		p := RatePlan{ID: planID}
+		if err := p.getRatePlan(db); err != nil {
+			return nil, err
+		}
+		if p.RoomTypeID != typeID {
+			return nil, sql.ErrNoRows
+		}
+		return &p, nil
+	}
+
+	p := RatePlan{}
+	err := db.QueryRow(
+		"SELECT "+ratePlanColumns+" FROM rate_plans WHERE room_type_id=$1 ORDER BY id LIMIT 1",
+		typeID).Scan(p.scanFields()...)
+	if err != sql.ErrNoRows {
+		return &p, err
+	}
+
+	t := RoomType{ID: typeID}
+	if err := t.getRoomType(db); err != nil {
+		return nil, err
+	}
+	return &RatePlan{RoomTypeID: typeID, Name: "Default", Currency: BaseCurrency, BaseRate: t.DefaultRate}, nil
+}
+
+// GetQuote prices a stay in a room type including taxes, in currency or
+// in the rate plan's currency when empty. ages has one entry per guest,
+// -1 when not known.
+func GetQuote(db *sql.DB, typeID, planID int, from, to Date, ages []int, currency string) (*Quote, error) {
+	guests := len(ages)
+
+	plan, err := ratePlanForType(db, typeID, planID)
+	if err != nil {
+		return nil, err
+	}
+
+	t := RoomType{ID: typeID}
+	if err := t.getRoomType(db); err != nil {
+		return nil, err
+	}
+	if t.Capacity > 0 && guests > t.Capacity {
+		return nil, invalidf("Room type '%s' sleeps at most %d guests", t.Name, t.Capacity)
+	}
+
+	q, err := plan.Price(from, to, guests)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := GetAllTaxRules(db)
+	if err != nil {
+		return nil, err
+	}
+	q.applyTaxes(rules, ages)
+
+	if currency != "" {
+		if err := q.convert(db, currency, today()); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"strconv"
+)
+
+// longest range a report covers
+const maxReportNights = 366
+
+// OccupancyStats are the sold rooms and room revenue over some nights.
+// Revenue is in minor units of BaseCurrency, ADR is the revenue per sold
+// room and RevPAR the revenue per available room.
+type OccupancyStats struct {
+	Rooms       int     `json:"rooms"`
+	Occupied    int     `json:"occupied"`
+	Occupancy   float64 `json:"occupancy"` // percent
+	RoomRevenue int64   `json:"room_revenue"`
+	ADR         int64   `json:"adr"`
+	RevPAR      int64   `json:"revpar"`
+}
+
+// NightStats are the statistics of a single night
+type NightStats struct {
+	Date Date `json:"date"`
+	OccupancyStats
+}
+
+// OccupancyReport lists the nights from From up to, but excluding, To.
+// Total counts room nights over the whole range.
+type OccupancyReport struct {
+	From     Date           `json:"from"`
+	To       Date           `json:"to"`
+	Currency string         `json:"currency"`
+	Nights   []NightStats   `json:"nights"`
+	Total    OccupancyStats `json:"total"`
+}
+
+// GuestMovement is a guest arriving, departing or staying on a date, from
+// a reservation or a walk-in stay. Walk-ins still in house have no
+// departure.
+type GuestMovement struct {
+	GuestID       int    `json:"guest_id,omitempty"`
+	ReservationID int    `json:"reservation_id,omitempty"`
+	Name          string `json:"name"`
+	RoomNumber    int    `json:"room_number,omitempty"`
+	RoomTypeID    int    `json:"room_type_id"`
+	Arrival       Date   `json:"arrival"`
+	Departure     *Date  `json:"departure,omitempty"`
+	Guests        int    `json:"guests"`
+	Status        string `json:"status"`
+}
+
+// NationalityStats counts the guests of a nationality and the nights they
+// stayed. Guests without a nationality are counted under "".
+type NationalityStats struct {
+	Nationality string `json:"nationality"`
+	Guests      int    `json:"guests"`
+	Nights      int    `json:"nights"`
+}
+
+func (s *OccupancyStats) compute() {
+	if s.Rooms > 0 {
+		s.Occupancy = math.Round(float64(s.Occupied)*10000/float64(s.Rooms)) / 100
+		s.RevPAR = divRound(s.RoomRevenue, int64(s.Rooms), RoundHalfUp)
+	}
+	if s.Occupied > 0 {
+		s.ADR = divRound(s.RoomRevenue, int64(s.Occupied), RoundHalfUp)
+	}
+}
+
+func checkReportRange(from, to Date) error {
+	if !to.After(from.Time) {
+		return invalidf("'to' must be after 'from'")
+	}
+	if to.Sub(from.Time).Hours()/24 > maxReportNights {
+		return invalidf("A report covers at most %d nights", maxReportNights)
+	}
+	return nil
+}
+
+// occupiedOn is the SQL condition for a stay s in house on the night given
+// by the date expression. Open stays count up to tonight, the night of
+// the today expression.
+func occupiedOn(date, today string) string {
+	return `s.checked_in_at::date <= ` + date + ` AND (s.checked_out_at::date > ` + date + `
+		OR s.checked_out_at IS NULL AND ` + date + ` <= ` + today + `)`
+}
+
+// GetOccupancyReport counts the rooms, sold rooms and room revenue of every
+// night. Rooms blocked for maintenance are not available. Revenue is the
+// room nights posted to folios, so a night is only complete once it is
+// posted.
+func GetOccupancyReport(db *sql.DB, from, to Date) (*OccupancyReport, error) {
+	if err := checkReportRange(from, to); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		`SELECT n.night,
+			(SELECT count(*) FROM rooms r WHERE NOT `+roomBlockedOn("n.night")+`),
+			(SELECT count(DISTINCT s.room_id) FROM stays s WHERE `+occupiedOn("n.night", "$3")+`),
+			(SELECT COALESCE(sum(l.amount), 0) FROM folio_lines l WHERE l.kind = $4 AND l.night = n.night)
+		FROM (SELECT d::date AS night FROM generate_series($1::date, $2::date - 1, '1 day') d) n
+		ORDER BY n.night`,
+		from, to, today(), LineRoom)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	report := &OccupancyReport{From: from, To: to, Currency: BaseCurrency, Nights: []NightStats{}}
+
+	for rows.Next() {
+		var n NightStats
+		if err := rows.Scan(&n.Date, &n.Rooms, &n.Occupied, &n.RoomRevenue); err != nil {
+			return nil, err
+		}
+		n.compute()
+
+		report.Total.Rooms += n.Rooms
+		report.Total.Occupied += n.Occupied
+		report.Total.RoomRevenue += n.RoomRevenue
+		report.Nights = append(report.Nights, n)
+	}
+	report.Total.compute()
+
+	return report, nil
+}
+
+// the columns of a GuestMovement for a stay s, its guest g, room r and
+// reservation v. Moving rooms closes a stay and opens the next at the same
+// instant; those stays are one visit.
+const stayMovementColumns = `g.id, COALESCE(v.id, 0), g.name, r.number, COALESCE(r.room_type_id, 0),
+	COALESCE(v.arrival, s.checked_in_at::date), COALESCE(v.departure, s.checked_out_at::date), s.guests,
+	CASE WHEN s.checked_out_at IS NULL THEN 'checked_in' ELSE 'checked_out' END
+	FROM stays s JOIN guests g ON g.id = s.guest_id JOIN rooms r ON r.id = s.room_id
+	LEFT JOIN reservations v ON v.stay_id = s.id`
+
+func getMovements(db *sql.DB, query string, args ...interface{}) ([]GuestMovement, error) {
+	rows, err := db.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	movements := []GuestMovement{}
+
+	for rows.Next() {
+		var m GuestMovement
+		if err := rows.Scan(&m.GuestID, &m.ReservationID, &m.Name, &m.RoomNumber, &m.RoomTypeID,
+			&m.Arrival, &m.Departure, &m.Guests, &m.Status); err != nil {
+			return nil, err
+		}
+
+		movements = append(movements, m)
+	}
+
+	return movements, nil
+}
+
+// GetArrivals lists the reservations arriving on date that were not
+// cancelled, and the walk-ins who checked in that day
+func GetArrivals(db *sql.DB, date Date) ([]GuestMovement, error) {
+	return getMovements(db,
+		`SELECT COALESCE(g.id, 0), v.id, v.name, COALESCE(r.number, 0), v.room_type_id, v.arrival,
+			v.departure, v.guests, v.status
+		FROM reservations v LEFT JOIN stays s ON s.id = v.stay_id
+		LEFT JOIN guests g ON g.id = s.guest_id LEFT JOIN rooms r ON r.id = s.room_id
+		WHERE v.arrival = $1 AND v.status <> $2
+		UNION ALL
+		SELECT `+stayMovementColumns+`
+		WHERE v.id IS NULL AND s.checked_in_at::date = $1 AND NOT EXISTS(SELECT 1 FROM stays p
+			WHERE p.guest_id = s.guest_id AND p.checked_out_at = s.checked_in_at)
+		ORDER BY 3, 2`,
+		date, ReservationCancelled)
+}
+
+// GetDepartures lists the guests who checked out on date and those still
+// in house whose reservation departs that day
+func GetDepartures(db *sql.DB, date Date) ([]GuestMovement, error) {
+	return getMovements(db,
+		`SELECT `+stayMovementColumns+`
+		WHERE (s.checked_out_at::date = $1 AND NOT EXISTS(SELECT 1 FROM stays n
+				WHERE n.guest_id = s.guest_id AND n.checked_in_at = s.checked_out_at))
+			OR (s.checked_out_at IS NULL AND v.departure = $1)
+		ORDER BY g.name, g.id`,
+		date)
+}
+
+// GetInHouse lists the guests staying the night of date
+func GetInHouse(db *sql.DB, date Date) ([]GuestMovement, error) {
+	return getMovements(db,
+		`SELECT `+stayMovementColumns+`
+		WHERE `+occupiedOn("$1::date", "$2::date")+`
+		ORDER BY r.number`,
+		date, today())
+}
+
+// GetNationalityStats counts the guests in house on the nights from from up
+// to, but excluding, to by nationality, most nights first
+func GetNationalityStats(db *sql.DB, from, to Date) ([]NationalityStats, error) {
+	if err := checkReportRange(from, to); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		`SELECT g.nationality, count(DISTINCT g.id),
+			sum(GREATEST(LEAST(COALESCE(s.checked_out_at::date, $3::date + 1), $2)
+				- GREATEST(s.checked_in_at::date, $1), 0))
+		FROM stays s JOIN guests g ON g.id = s.guest_id
+		WHERE s.checked_in_at::date < $2 AND COALESCE(s.checked_out_at::date, $3::date + 1) > $1
+			AND COALESCE(s.checked_out_at::date, $3::date + 1) > s.checked_in_at::date
+		GROUP BY g.nationality ORDER BY 3 DESC, 1`,
+		from, to, today())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	stats := []NationalityStats{}
+
+	for rows.Next() {
+		var n NationalityStats
+		if err := rows.Scan(&n.Nationality, &n.Guests, &n.Nights); err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, n)
+	}
+
+	return stats, nil
+}
+
+var occupancyCSVHeader = []string{"date", "rooms", "occupied", "occupancy", "room_revenue", "adr", "revpar"}
+
+func (s OccupancyStats) csvRecord(date string) []string {
+	return []string{date, strconv.Itoa(s.Rooms), strconv.Itoa(s.Occupied),
+		strconv.FormatFloat(s.Occupancy, 'f', 2, 64), formatMinor(s.RoomRevenue), formatMinor(s.ADR),
+		formatMinor(s.RevPAR)}
+}
+
+// csvRecords has a row per night and the total last
+func (r *OccupancyReport) csvRecords() [][]string {
+	records := [][]string{occupancyCSVHeader}
+	for _, n := range r.Nights {
+		records = append(records, n.csvRecord(n.Date.String()))
+	}
+	return append(records, r.Total.csvRecord("total"))
+}
+
+func movementCSVRecords(movements []GuestMovement) [][]string {
+	records := [][]string{{"guest_id", "reservation_id", "name", "room_number", "room_type_id", "arrival",
+		"departure", "guests", "status"}}
+	for _, m := range movements {
+		departure := ""
+		if m.Departure != nil {
+			departure = m.Departure.String()
+		}
+		records = append(records, []string{strconv.Itoa(m.GuestID), strconv.Itoa(m.ReservationID), m.Name,
+			strconv.Itoa(m.RoomNumber), strconv.Itoa(m.RoomTypeID), m.Arrival.String(), departure,
+			strconv.Itoa(m.Guests), m.Status})
+	}
+	return records
+}
+
+func nationalityCSVRecords(stats []NationalityStats) [][]string {
+	records := [][]string{{"nationality", "guests", "nights"}}
+	for _, n := range stats {
+		records = append(records, []string{n.Nationality, strconv.Itoa(n.Guests), strconv.Itoa(n.Nights)})
+	}
+	return records
+}
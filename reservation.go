@@ -0,0 +1,445 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// reservation statuses
+const (
+	ReservationConfirmed  = "confirmed"
+	ReservationCheckedIn  = "checked_in"
+	ReservationCheckedOut = "checked_out"
+)
+
+// ErrNoAvailability is returned when a room type is sold out for some
+// night of a reservation
+var ErrNoAvailability = errors.New("No rooms of this type available for these dates")
+
+// ErrReservationStatus is returned when a reservation cannot go from its
+// status to the requested one
+var ErrReservationStatus = errors.New("Reservation is not confirmed")
+
+// Reservation books a room type for future nights. The deposit, the
+// first night, is captured when it is made; the room is only picked at
+// check-in.
+type Reservation struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	RoomTypeID int    `json:"room_type_id"`
+	RatePlanID int    `json:"rate_plan_id,omitempty"`
+	Arrival    Date   `json:"arrival"`
+	Departure  Date   `json:"departure"`
+	Guests     int    `json:"guests"`
+	Status     string `json:"status"`
+	Currency   string `json:"currency"`
+	Total      int64  `json:"total"`
+	Deposit    int64  `json:"deposit"`
+	StayID     int    `json:"stay_id,omitempty"`
+	GroupID    int    `json:"group_id,omitempty"`
+	HoldID     int    `json:"hold_id,omitempty"`
+
+	// kept of the deposit when cancelled late or not shown, and what of
+	// it is still to be collected beyond the deposit
+	Penalty    int64      `json:"penalty,omitempty"`
+	PenaltyDue int64      `json:"penalty_due,omitempty"`
+	ClosedAt   *time.Time `json:"closed_at,omitempty"`
+
+	// the refund or charge of the penalty is still to be made
+	SettlementPending bool `json:"settlement_pending,omitempty"`
+
+	// issued by the payment gateway, only accepted on creation
+	PaymentToken string `json:"payment_token,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// the waitlist entry whose offered room this books
+	waitlistID int
+}
+
+const reservationColumns = `id, name, room_type_id, rate_plan_id, arrival, departure, guests, status,
+	currency, total, deposit, COALESCE(stay_id, 0), COALESCE(group_id, 0), penalty, penalty_due, closed_at,
+	settlement_pending, created_at`
+
+func (r *Reservation) scanFields() []interface{} {
+	return []interface{}{&r.ID, &r.Name, &r.RoomTypeID, &r.RatePlanID, &r.Arrival, &r.Departure,
+		&r.Guests, &r.Status, &r.Currency, &r.Total, &r.Deposit, &r.StayID, &r.GroupID, &r.Penalty,
+		&r.PenaltyDue, &r.ClosedAt, &r.SettlementPending, &r.CreatedAt}
+}
+
+func (r *Reservation) getReservation(db queryer) error {
+	return db.QueryRow("SELECT "+reservationColumns+" FROM reservations WHERE id=$1",
+		r.ID).Scan(r.scanFields()...)
+}
+
+// createReservation prices the stay, captures the deposit with the
+// gateway and stores the reservation if the room type is still available,
+// or its hold still active. The deposit is refunded when the reservation
+// cannot be stored.
+func (r *Reservation) createReservation(db *sql.DB, gw PaymentGateway) error {
+	if r.HoldID != 0 {
+		if err := r.applyHold(db); err != nil {
+			return err
+		}
+	}
+	if r.Name == "" {
+		return invalidf("Name is required")
+	}
+	if r.PaymentToken == "" {
+		return invalidf("Payment token is required")
+	}
+	if r.Guests == 0 {
+		r.Guests = 1
+	}
+	ages := make([]int, r.Guests)
+	for i := range ages {
+		ages[i] = -1
+	}
+
+	q, err := GetQuote(db, r.RoomTypeID, r.RatePlanID, r.Arrival, r.Departure, ages, "")
+	if err != nil {
+		return err
+	}
+	r.RatePlanID = q.RatePlanID
+	r.Currency = q.Currency
+	r.Total = q.GrandTotal
+	r.Status = ReservationConfirmed
+
+	// a held or offered room counts as taken until it is claimed
+	if r.waitlistID == 0 && r.HoldID == 0 {
+		if n, err := availableRooms(db, r.RoomTypeID, r.Arrival, r.Departure); err != nil {
+			return err
+		} else if n < 1 {
+			return ErrNoAvailability
+		}
+	}
+
+	deposit := q.Nights[0].Amount
+	auth, err := gw.Authorize(r.PaymentToken, deposit, r.Currency)
+	if err != nil {
+		return err
+	}
+	if auth.Amount < deposit {
+		// a partial approval does not secure the booking
+		gw.Void(auth.ID)
+		return ErrPaymentDeclined
+	}
+	capture, err := gw.Capture(auth.ID, deposit)
+	if err != nil {
+		gw.Void(auth.ID)
+		return err
+	}
+	r.Deposit = capture.Amount
+
+	if err := r.insert(db, auth, capture); err != nil {
+		refundDeposit(db, gw, auth, capture)
+		return err
+	}
+	return nil
+}
+
+// refundDeposit gives back the deposit of a reservation that could not be
+// stored. The transactions are kept without a reservation; if the refund
+// fails, the capture stays on record and in the log to be reconciled.
+func refundDeposit(db *sql.DB, gw PaymentGateway, auth, capture Transaction) {
+	transactions := []Transaction{auth, capture}
+	refund, err := gw.Refund(capture.ID, capture.Amount)
+	if err != nil {
+		log.Printf("deposit %s of %d %s not refunded: %v", capture.ID, capture.Amount, capture.Currency, err)
+	} else {
+		transactions = append(transactions, refund)
+	}
+	for _, t := range transactions {
+		if err := recordTransaction(db, t, 0, 0); err != nil {
+			log.Printf("transaction %s not recorded: %v", t.ID, err)
+		}
+	}
+}
+
+// insert stores the reservation with the transactions of its deposit after
+// checking availability again while holding a lock on the room type, so the
+// last room is not sold twice
+func (r *Reservation) insert(db *sql.DB, auth, capture Transaction) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", r.RoomTypeID); err != nil {
+		return err
+	}
+	if r.waitlistID != 0 {
+		if err := claimOffer(tx, r.waitlistID); err != nil {
+			return err
+		}
+	}
+	if r.HoldID != 0 {
+		if err := claimHold(tx, r.HoldID); err != nil {
+			return err
+		}
+	}
+	if n, err := availableRooms(tx, r.RoomTypeID, r.Arrival, r.Departure); err != nil {
+		return err
+	} else if n < 1 {
+		return ErrNoAvailability
+	}
+
+	err = tx.QueryRow(
+		`INSERT INTO reservations(name, room_type_id, rate_plan_id, arrival, departure, guests,
+		status, currency, total, deposit, payment_token)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, created_at`,
+		r.Name, r.RoomTypeID, r.RatePlanID, r.Arrival, r.Departure, r.Guests, r.Status,
+		r.Currency, r.Total, r.Deposit, r.PaymentToken).Scan(&r.ID, &r.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if r.waitlistID != 0 {
+		if _, err := tx.Exec("UPDATE waitlist SET reservation_id=$1 WHERE id=$2", r.ID, r.waitlistID); err != nil {
+			return err
+		}
+	}
+	if r.HoldID != 0 {
+		if _, err := tx.Exec("UPDATE holds SET reservation_id=$1 WHERE id=$2", r.ID, r.HoldID); err != nil {
+			return err
+		}
+	}
+	if err := recordTransaction(tx, auth, r.ID, 0); err != nil {
+		return err
+	}
+	if err := recordTransaction(tx, capture, r.ID, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkIn checks the guest into a free room of the reserved type and moves
+// the deposit to the new stay's folio. A guest with an ID is an existing
+// profile, otherwise the profile is created like with POST /guest. It all
+// happens in one transaction.
+func (r *Reservation) checkIn(db *sql.DB, kr *Keyring, g *Guest) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := r.getReservation(tx); err != nil {
+		return err
+	}
+	if r.Status != ReservationConfirmed {
+		return ErrReservationStatus
+	}
+
+	if g.RoomID == 0 {
+		g.RoomTypeID = r.RoomTypeID
+	}
+	if g.ID != 0 {
+		if _, err := g.checkInProfile(tx, kr, Guest{RoomID: g.RoomID, RoomTypeID: g.RoomTypeID}); err != nil {
+			return err
+		}
+	} else {
+		if g.Name == "" {
+			g.Name = r.Name
+		}
+		if err := g.createGuest(tx, kr); err != nil {
+			return err
+		}
+	}
+	stay, err := g.getLatestStay(tx)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE reservations SET status=$1, stay_id=$2 WHERE id=$3 AND status=$4",
+		ReservationCheckedIn, stay.ID, r.ID, ReservationConfirmed)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrReservationStatus
+	}
+	r.Status, r.StayID = ReservationCheckedIn, stay.ID
+
+	// the stay is priced like the reservation
+	if _, err := tx.Exec("UPDATE stays SET rate_plan_id=$1, guests=$2 WHERE id=$3",
+		r.RatePlanID, r.Guests, stay.ID); err != nil {
+		return err
+	}
+
+	f, err := getFolioForStay(tx, stay.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE payment_transactions SET folio_id=$1 WHERE reservation_id=$2",
+		f.ID, r.ID); err != nil {
+		return err
+	}
+	if r.Deposit != 0 {
+		err := f.post(tx, LinePayment, Posting{Description: "Deposit", Amount: r.Deposit, Currency: r.Currency})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// checkOutReservation closes the reservation of a stay that ended. It
+// returns the room type whose waitlist gets the nights left after an early
+// departure, or tonight for a walk-in, 0 for rooms without a type.
+func checkOutReservation(db queryer, stay Stay) (int, error) {
+	var typeID int
+	err := db.QueryRow(
+		`UPDATE reservations SET status=$1, closed_at=now() WHERE stay_id=$2 AND status=$3
+		RETURNING room_type_id`,
+		ReservationCheckedOut, stay.ID, ReservationCheckedIn).Scan(&typeID)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow("SELECT COALESCE(room_type_id, 0) FROM rooms WHERE id=$1", stay.RoomID).Scan(&typeID)
+	}
+	return typeID, err
+}
+
+func GetAllReservations(db *sql.DB) ([]Reservation, error) {
+	rows, err := db.Query("SELECT " + reservationColumns + " FROM reservations ORDER BY arrival, id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	reservations := []Reservation{}
+
+	for rows.Next() {
+		var r Reservation
+		if err := rows.Scan(r.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		reservations = append(reservations, r)
+	}
+
+	return reservations, nil
+}
+
+// getGuestReservations are the reservations the guest checked in with
+func (g *Guest) getGuestReservations(db *sql.DB) ([]Reservation, error) {
+	rows, err := db.Query(
+		"SELECT "+reservationColumns+` FROM reservations WHERE tenant_id = current_tenant()
+		AND stay_id IN (SELECT id FROM stays WHERE guest_id=$1) ORDER BY id`, g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	reservations := []Reservation{}
+
+	for rows.Next() {
+		var r Reservation
+		if err := rows.Scan(r.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		reservations = append(reservations, r)
+	}
+
+	return reservations, nil
+}
+
+// paymentTokenForStay returns the card of the reservation a stay was
+// checked in from. Walk-ins have none.
+func paymentTokenForStay(db queryer, stayID int) (string, error) {
+	var token string
+	err := db.QueryRow("SELECT payment_token FROM reservations WHERE stay_id=$1", stayID).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return token, err
+}
+
+// availableRooms is the number of rooms of a type still free on every
+// night from arrival to departure. Reservations count on their nights;
+// walk-ins have no departure date and count on every night from tonight
+// until they check out. Group blocks count their unassigned rooms until
+// released, waitlist offers and holds until they expire. Overbooking
+// limits add to the rooms that can be sold. Rooms out of order or service
+// are not counted at all, blocked rooms not on the nights blocked.
+func availableRooms(q queryer, typeID int, arrival, departure Date) (int, error) {
+	nights, err := roomTypeNights(q, typeID, arrival, departure)
+	if err != nil {
+		return 0, err
+	}
+	available := -1
+	for _, n := range nights {
+		if available < 0 || n.Available < available {
+			available = n.Available
+		}
+	}
+	if available < 0 {
+		return 0, nil
+	}
+	return available, nil
+}
+
+// NightAvailability of a room type on one night. Overbooking is how many
+// rooms may be sold beyond Total.
+type NightAvailability struct {
+	Date        Date `json:"date"`
+	Total       int  `json:"total"`
+	Overbooking int  `json:"overbooking,omitempty"`
+	Booked      int  `json:"booked"`
+	Available   int  `json:"available"`
+}
+
+func roomTypeNights(q queryer, typeID int, from, to Date) ([]NightAvailability, error) {
+	if !to.After(from.Time) {
+		return nil, invalidf("Departure must be after arrival")
+	}
+	if to.Sub(from.Time) > maxQuoteNights*24*time.Hour {
+		return nil, invalidf("Availability is limited to %d nights", maxQuoteNights)
+	}
+
+	rows, err := q.Query(
+		`SELECT d::date,
+			(SELECT count(*) FROM rooms r WHERE r.room_type_id = $1 AND `+roomSellableOn("d::date")+`),
+			(SELECT count(*) FROM reservations WHERE room_type_id = $1
+				AND status IN ('confirmed', 'checked_in') AND arrival <= d AND departure > d)
+			+ CASE WHEN d::date >= $4 THEN (SELECT count(*) FROM stays s JOIN rooms r ON r.id = s.room_id
+				WHERE r.room_type_id = $1 AND s.checked_out_at IS NULL
+				AND NOT EXISTS(SELECT 1 FROM reservations v WHERE v.stay_id = s.id)) ELSE 0 END
+			+ `+groupHoldsOn("d::date")+` + `+waitlistOffersOn("d::date")+` + `+holdsOn("d::date")+`,
+			`+overbookingOn("d::date")+`
+		FROM generate_series($2::date, $3::date - 1, interval '1 day') d ORDER BY d`,
+		typeID, from, to, today())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	nights := []NightAvailability{}
+
+	for rows.Next() {
+		var n NightAvailability
+		var percent int
+		if err := rows.Scan(&n.Date, &n.Total, &n.Booked, &percent); err != nil {
+			return nil, err
+		}
+		n.Overbooking = n.Total * percent / 100
+		n.Available = n.Total + n.Overbooking - n.Booked
+		if n.Available < 0 {
+			n.Available = 0
+		}
+
+		nights = append(nights, n)
+	}
+
+	return nights, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// RoomType is a bookable category of rooms, e.g. "Double Deluxe".
+// Rooms without their own features inherit the type's features.
+type RoomType struct {
+	ID          int           `json:"id"`
+	PropertyID  int           `json:"property_id"`
+	Name        string        `json:"name"`
+	Capacity    int           `json:"capacity"`
+	Features    *RoomFeatures `json:"features,omitempty"`
+	DefaultRate int64         `json:"default_rate"` // minor units per night
+}
+
+// Availability of a room type right now, or for a range of nights with
+// Available the lowest of them
+type Availability struct {
+	RoomTypeID int                 `json:"room_type_id"`
+	Name       string              `json:"name"`
+	Total      int                 `json:"total"`
+	Available  int                 `json:"available"`
+	Nights     []NightAvailability `json:"nights,omitempty"`
+}
+
+func (t *RoomType) getRoomType(db queryer) error {
+	return db.QueryRow(
+		"SELECT property_id, name, capacity, features, default_rate FROM room_types WHERE id=$1",
+		t.ID).Scan(&t.PropertyID, &t.Name, &t.Capacity, featuresScanner{&t.Features}, &t.DefaultRate)
+}
+
+// updateRoomType keeps the type in its property
+func (t *RoomType) updateRoomType(db *sql.DB) error {
+	return db.QueryRow(
+		`UPDATE room_types SET name=$1, capacity=$2, features=$3, default_rate=$4 WHERE id=$5
+		RETURNING property_id`,
+		t.Name, t.Capacity, t.Features, t.DefaultRate, t.ID).Scan(&t.PropertyID)
+}
+
+func (t *RoomType) deleteRoomType(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM room_types WHERE id=$1", t.ID)
+	return err
+}
+
+func (t *RoomType) createRoomType(db *sql.DB) error {
+	if t.PropertyID == 0 {
+		id, err := defaultPropertyID(db)
+		if err != nil {
+			return err
+		}
+		t.PropertyID = id
+	}
+	p := Property{ID: t.PropertyID}
+	if err := p.getProperty(db); err == sql.ErrNoRows {
+		return invalidf("Property with ID: %d does not exist", t.PropertyID)
+	} else if err != nil {
+		return err
+	}
+	return db.QueryRow(
+		`INSERT INTO room_types(property_id, name, capacity, features, default_rate)
+		VALUES($1, $2, $3, $4, $5) RETURNING id`,
+		t.PropertyID, t.Name, t.Capacity, t.Features, t.DefaultRate).Scan(&t.ID)
+}
+
+// GetAllRoomTypes lists the room types of one property, or of all of them
+// when propertyID is 0
+func GetAllRoomTypes(db *sql.DB, propertyID int) ([]RoomType, error) {
+	rows, err := db.Query(
+		`SELECT id, property_id, name, capacity, features, default_rate FROM room_types
+		WHERE $1 = 0 OR property_id = $1 ORDER BY id`, propertyID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	types := []RoomType{}
+
+	for rows.Next() {
+		var t RoomType
+		if err := rows.Scan(&t.ID, &t.PropertyID, &t.Name, &t.Capacity, featuresScanner{&t.Features},
+			&t.DefaultRate); err != nil {
+			return nil, err
+		}
+
+		types = append(types, t)
+	}
+
+	return types, nil
+}
+
+// GetAvailability counts free rooms per type, for one type when typeID is set
+func GetAvailability(db *sql.DB, typeID int) ([]Availability, error) {
+	rows, err := db.Query(
+		`SELECT t.id, t.name, count(r.id),
+		count(r.id) FILTER (WHERE NOT EXISTS(
+			SELECT 1 FROM stays s WHERE s.room_id = r.id AND s.checked_out_at IS NULL))
+		FROM room_types t LEFT JOIN rooms r ON r.room_type_id = t.id
+			AND `+roomSellableOn("$2::date")+`
+		WHERE $1 = 0 OR t.id = $1
+		GROUP BY t.id, t.name ORDER BY t.id`, typeID, today())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := []Availability{}
+
+	for rows.Next() {
+		var a Availability
+		if err := rows.Scan(&a.RoomTypeID, &a.Name, &a.Total, &a.Available); err != nil {
+			return nil, err
+		}
+
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+// GetAvailabilityForDates counts free rooms per type on every night from
+// from to to, for one type when typeID is set
+func GetAvailabilityForDates(db *sql.DB, typeID int, from, to Date) ([]Availability, error) {
+	types, err := GetAllRoomTypes(db, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Availability{}
+
+	for _, t := range types {
+		if typeID != 0 && t.ID != typeID {
+			continue
+		}
+		nights, err := roomTypeNights(db, t.ID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		a := Availability{RoomTypeID: t.ID, Name: t.Name, Nights: nights}
+		for i, n := range nights {
+			if i == 0 || n.Available < a.Available {
+				a.Available = n.Available
+			}
+			a.Total = n.Total
+		}
+
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+// Picks a free room of the given type, inspected and clean rooms first
+func findFreeRoomOfType(db queryer, typeID int) (int, error) {
+	var roomID int
+	err := db.QueryRow(
+		`SELECT r.id FROM rooms r WHERE r.room_type_id=$1
+		AND `+roomSellableOn("$2::date")+` AND NOT EXISTS(
+			SELECT 1 FROM stays s WHERE s.room_id = r.id AND s.checked_out_at IS NULL)
+		ORDER BY r.housekeeping_status <> 'inspected', r.housekeeping_status <> 'clean', r.number
+		LIMIT 1`, typeID, today()).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("No rooms of type %d available", typeID)
+	}
+	return roomID, err
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// maxXLSXPartBytes limits each part of a workbook once unpacked, so that a
+// small upload cannot inflate to more than the server can hold
+const maxXLSXPartBytes = 64 << 20
+
+// readSheet reads the rows of a CSV file, or of the first worksheet of an
+// XLSX workbook, which is recognised by its zip signature
+func readSheet(src io.Reader) ([][]string, error) {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return readXLSX(data)
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, invalidf("Invalid CSV: %v", err)
+	}
+	return records, nil
+}
+
+// the parts of an XLSX workbook needed to read cell values
+type xlsxWorkbook struct {
+	Sheets []struct {
+		RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxText is a shared or inline string, plain or in rich text runs
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var b strings.Builder
+	for _, r := range t.Runs {
+		b.WriteString(r.T)
+	}
+	return b.String()
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func readXLSX(data []byte) ([][]string, error) {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, invalidf("Invalid XLSX: %v", err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+	decode := func(name string, v interface{}) error {
+		f, ok := files[name]
+		if !ok {
+			return invalidf("Invalid XLSX: %s is missing", name)
+		}
+		if f.UncompressedSize64 > maxXLSXPartBytes {
+			return invalidf("Invalid XLSX: %s is larger than %d MB unpacked", name, maxXLSXPartBytes>>20)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return invalidf("Invalid XLSX: %v", err)
+		}
+		defer rc.Close()
+		if err := xml.NewDecoder(io.LimitReader(rc, maxXLSXPartBytes)).Decode(v); err != nil {
+			return invalidf("Invalid XLSX: %s: %v", name, err)
+		}
+		return nil
+	}
+
+	var wb xlsxWorkbook
+	if err := decode("xl/workbook.xml", &wb); err != nil {
+		return nil, err
+	}
+	var rels xlsxRelationships
+	if err := decode("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	if len(wb.Sheets) == 0 {
+		return nil, invalidf("Invalid XLSX: the workbook has no sheets")
+	}
+	sheetPath := ""
+	for _, rel := range rels.Relationships {
+		if rel.ID == wb.Sheets[0].RelID {
+			// targets are relative to xl/, or absolute within the package
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetPath = strings.TrimPrefix(rel.Target, "/")
+			} else {
+				sheetPath = path.Join("xl", rel.Target)
+			}
+		}
+	}
+
+	var shared xlsxSharedStrings
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := decode("xl/sharedStrings.xml", &shared); err != nil {
+			return nil, err
+		}
+	}
+	var ws xlsxWorksheet
+	if err := decode(sheetPath, &ws); err != nil {
+		return nil, err
+	}
+
+	records := [][]string{}
+	for _, row := range ws.Rows {
+		record := []string{}
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				col = xlsxColumn(c.Ref)
+			}
+			for len(record) < col {
+				record = append(record, "")
+			}
+			value := c.Value
+			switch c.Type {
+			case "s":
+				n, err := strconv.Atoi(c.Value)
+				if err != nil || n < 0 || n >= len(shared.Items) {
+					return nil, invalidf("Invalid XLSX: cell %s refers to a missing string", c.Ref)
+				}
+				value = shared.Items[n].String()
+			case "inlineStr":
+				value = c.Inline.String()
+			}
+			record = append(record, value)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// xlsxColumn is the zero based column of a cell reference such as "AB12"
+func xlsxColumn(ref string) int {
+	col := 0
+	for _, ch := range ref {
+		if ch < 'A' || ch > 'Z' {
+			break
+		}
+		col = col*26 + int(ch-'A'+1)
+	}
+	return col - 1
+}
+
+// the package parts of a workbook with a single worksheet
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// xlsxWriter writes a workbook row by row. Strings are stored inline, so
+// nothing but the current row is kept in memory.
+type xlsxWriter struct {
+	z     *zip.Writer
+	sheet io.Writer
+	rows  int
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	x := &xlsxWriter{z: zip.NewWriter(w)}
+	for _, p := range xlsxParts {
+		f, err := x.z.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, p.content); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if x.sheet, err = x.z.Create("xl/worksheets/sheet1.xml"); err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(x.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return x, err
+}
+
+// writeRow stores numbers and booleans as such and everything else as
+// text. Empty values leave the cell out.
+func (x *xlsxWriter) writeRow(values []interface{}) error {
+	x.rows++
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<row r="%d">`, x.rows)
+	for i, v := range values {
+		ref := xlsxColumnName(i) + strconv.Itoa(x.rows)
+		switch v := v.(type) {
+		case nil:
+		case int, int64:
+			fmt.Fprintf(&b, `<c r="%s"><v>%d</v></c>`, ref, v)
+		case bool:
+			n := 0
+			if v {
+				n = 1
+			}
+			fmt.Fprintf(&b, `<c r="%s" t="b"><v>%d</v></c>`, ref, n)
+		default:
+			text := cellText(v)
+			if text == "" {
+				continue
+			}
+			fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(&b, []byte(text))
+			b.WriteString(`</t></is></c>`)
+		}
+	}
+	b.WriteString(`</row>`)
+	_, err := x.sheet.Write(b.Bytes())
+	return err
+}
+
+// cellText is a value as text, lists separated by semicolons like imports
+// expect them
+func cellText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []string:
+		return strings.Join(v, ";")
+	}
+	return fmt.Sprint(v)
+}
+
+func (x *xlsxWriter) close() error {
+	if _, err := io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return x.z.Close()
+}
+
+// xlsxColumnName is the letters of a zero based column, "AB" for 27
+func xlsxColumnName(col int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+)
+
+// tax rule kinds
+const (
+	TaxPercent       = "percent"         // BasisPoints of the taxed lines
+	TaxPerNight      = "per_night"       // Amount per room night
+	TaxPerGuestNight = "per_guest_night" // Amount per guest per room night
+)
+
+// rounding modes, applied once to the total of a rule
+const (
+	RoundHalfUp = "half_up"
+	RoundDown   = "down"
+	RoundUp     = "up"
+)
+
+// TaxRule is one tax or fee. All amounts are minor units.
+type TaxRule struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+
+	// percent rules, 1000 is 10%
+	BasisPoints int64 `json:"basis_points,omitempty"`
+	// percent rules whose tax is already contained in the prices, like VAT
+	Inclusive bool `json:"inclusive"`
+	// line categories a percent rule applies to, all when empty
+	Categories stringList `json:"categories"`
+
+	// flat rules
+	Amount    int64 `json:"amount,omitempty"`
+	MaxNights int   `json:"max_nights,omitempty"` // only the first nights are taxed, 0 for all
+
+	Rounding string `json:"rounding"`
+	Cap      int64  `json:"cap,omitempty"` // per stay, 0 for none
+
+	// guests younger than this are not counted, 0 for none
+	ExemptUnderAge int `json:"exempt_under_age,omitempty"`
+	// stays of at least this many nights are exempt, 0 for none
+	ExemptFromNights int `json:"exempt_from_nights,omitempty"`
+}
+
+type stringList []string
+
+func (l stringList) Value() (driver.Value, error) {
+	if l == nil {
+		l = stringList{}
+	}
+	return json.Marshal([]string(l))
+}
+
+func (l *stringList) Scan(src interface{}) error {
+	return scanJSON(src, (*[]string)(l))
+}
+
+// Taxable is an amount taxes are computed on
+type Taxable struct {
+	Category string
+	Amount   int64
+}
+
+// TaxContext describes the stay the taxed lines belong to
+type TaxContext struct {
+	Nights int
+	// one entry per guest, -1 when the age is not known
+	Ages []int
+}
+
+// TaxAmount is the result of one rule
+type TaxAmount struct {
+	Name      string `json:"name"`
+	Inclusive bool   `json:"inclusive"`
+	Base      int64  `json:"base"`
+	Amount    int64  `json:"amount"`
+}
+
+func (t *TaxRule) Validate() error {
+	switch t.Kind {
+	case TaxPercent:
+		if t.BasisPoints <= 0 {
+			return invalidf("Percent rules need positive basis_points")
+		}
+	case TaxPerNight, TaxPerGuestNight:
+		if t.Amount <= 0 {
+			return invalidf("Flat rules need a positive amount")
+		}
+		if t.Inclusive {
+			return invalidf("Only percent rules can be inclusive")
+		}
+	default:
+		return invalidf("Unknown tax kind '%s'", t.Kind)
+	}
+
+	switch t.Rounding {
+	case "":
+		t.Rounding = RoundHalfUp
+	case RoundHalfUp, RoundDown, RoundUp:
+	default:
+		return invalidf("Unknown rounding '%s'", t.Rounding)
+	}
+
+	if t.Cap < 0 || t.MaxNights < 0 || t.ExemptUnderAge < 0 || t.ExemptFromNights < 0 {
+		return invalidf("Limits must not be negative")
+	}
+	return nil
+}
+
+// ComputeTaxes applies every rule to the lines of one stay. Room nights are
+// the lines in the "room" category.
+func ComputeTaxes(rules []TaxRule, lines []Taxable, ctx TaxContext) []TaxAmount {
+	result := []TaxAmount{}
+	for _, rule := range rules {
+		if rule.ExemptFromNights > 0 && ctx.Nights >= rule.ExemptFromNights {
+			continue
+		}
+		t := rule.compute(lines, ctx)
+		if t.Amount != 0 {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func (t *TaxRule) compute(lines []Taxable, ctx TaxContext) TaxAmount {
+	result := TaxAmount{Name: t.Name, Inclusive: t.Inclusive}
+
+	switch t.Kind {
+	case TaxPercent:
+		for _, l := range lines {
+			if t.appliesTo(l.Category) {
+				result.Base += l.Amount
+			}
+		}
+		if t.Inclusive {
+			// the base contains the tax: tax = gross - gross / (1 + rate)
+			net := divRound(result.Base*10000, 10000+t.BasisPoints, t.Rounding)
+			result.Amount = result.Base - net
+			result.Base = net
+		} else {
+			result.Amount = divRound(result.Base*t.BasisPoints, 10000, t.Rounding)
+		}
+
+	case TaxPerNight, TaxPerGuestNight:
+		nights := ctx.Nights
+		if t.MaxNights > 0 && nights > t.MaxNights {
+			nights = t.MaxNights
+		}
+		units := int64(nights)
+		if t.Kind == TaxPerGuestNight {
+			units *= int64(t.countedGuests(ctx.Ages))
+		}
+		result.Base = units
+		result.Amount = units * t.Amount
+	}
+
+	if t.Cap > 0 && result.Amount > t.Cap {
+		result.Amount = t.Cap
+	}
+	return result
+}
+
+func (t *TaxRule) appliesTo(category string) bool {
+	if len(t.Categories) == 0 {
+		return true
+	}
+	for _, c := range t.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TaxRule) countedGuests(ages []int) int {
+	n := 0
+	for _, age := range ages {
+		if t.ExemptUnderAge > 0 && age >= 0 && age < t.ExemptUnderAge {
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// divRound divides non-negative num by den with the given rounding
+func divRound(num, den int64, mode string) int64 {
+	q, r := num/den, num%den
+	switch mode {
+	case RoundDown:
+		return q
+	case RoundUp:
+		if r > 0 {
+			q++
+		}
+		return q
+	default:
+		if 2*r >= den {
+			q++
+		}
+		return q
+	}
+}
+
+const taxRuleColumns = `id, name, kind, basis_points, inclusive, categories, amount, max_nights,
+	rounding, cap, exempt_under_age, exempt_from_nights`
+
+func (t *TaxRule) scanFields() []interface{} {
+	return []interface{}{&t.ID, &t.Name, &t.Kind, &t.BasisPoints, &t.Inclusive, &t.Categories,
+		&t.Amount, &t.MaxNights, &t.Rounding, &t.Cap, &t.ExemptUnderAge, &t.ExemptFromNights}
+}
+
+func (t *TaxRule) getTaxRule(db *sql.DB) error {
+	return db.QueryRow("SELECT "+taxRuleColumns+" FROM tax_rules WHERE id=$1",
+		t.ID).Scan(t.scanFields()...)
+}
+
+func (t *TaxRule) updateTaxRule(db *sql.DB) error {
+	_, err := db.Exec(
+		`UPDATE tax_rules SET name=$1, kind=$2, basis_points=$3, inclusive=$4, categories=$5,
+		amount=$6, max_nights=$7, rounding=$8, cap=$9, exempt_under_age=$10, exempt_from_nights=$11
+		WHERE id=$12`,
+		t.Name, t.Kind, t.BasisPoints, t.Inclusive, t.Categories, t.Amount, t.MaxNights,
+		t.Rounding, t.Cap, t.ExemptUnderAge, t.ExemptFromNights, t.ID)
+	return err
+}
+
+func (t *TaxRule) deleteTaxRule(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM tax_rules WHERE id=$1", t.ID)
+	return err
+}
+
+func (t *TaxRule) createTaxRule(db *sql.DB) error {
+	return db.QueryRow(
+		`INSERT INTO tax_rules(name, kind, basis_points, inclusive, categories, amount, max_nights,
+		rounding, cap, exempt_under_age, exempt_from_nights)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		t.Name, t.Kind, t.BasisPoints, t.Inclusive, t.Categories, t.Amount, t.MaxNights,
+		t.Rounding, t.Cap, t.ExemptUnderAge, t.ExemptFromNights).Scan(&t.ID)
+}
+
+func GetAllTaxRules(db queryer) ([]TaxRule, error) {
+	rows, err := db.Query("SELECT " + taxRuleColumns + " FROM tax_rules ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	rules := []TaxRule{}
+
+	for rows.Next() {
+		var t TaxRule
+		if err := rows.Scan(t.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, t)
+	}
+
+	return rules, nil
+}
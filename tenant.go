@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FirstTenantID is the tenant db.sql creates. App.DB acts for it.
+const FirstTenantID = 1
+
+// limits of every tenant's connection pool, so that many tenants cannot
+// run the server out of connections
+const (
+	tenantMaxOpenConns    = 10
+	tenantMaxIdleConns    = 2
+	tenantConnMaxIdleTime = 5 * time.Minute
+
+	// pools of tenants without requests for this long are closed
+	tenantPoolIdleTime = 30 * time.Minute
+)
+
+// Tenant is an independent hotelier with its own properties, rooms and
+// guests. Tenants never see each other's rows.
+type Tenant struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Principal is who a request acts for, from its API key
+type Principal struct {
+	TenantID int
+	KeyID    int // 0 for requests without a key on the default tenant
+
+	// connection pool with app.tenant_id set to the tenant on every
+	// connection, which row-level security and the queries scope by
+	DB *sql.DB
+}
+
+type contextKey int
+
+const principalKey contextKey = 0
+
+func hashAPIKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// CreateTenant adds a tenant with a first property named after it
+func (a *App) CreateTenant(name string) (*Tenant, error) {
+	if name == "" {
+		return nil, invalidf("Name is required")
+	}
+	t := &Tenant{Name: name}
+	err := a.DB.QueryRow("INSERT INTO tenants(name) VALUES($1) RETURNING id", name).Scan(&t.ID)
+	if err != nil {
+		return nil, err
+	}
+	db, release, err := a.tenantDB(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	p := Property{Name: name}
+	return t, p.createProperty(db)
+}
+
+// CreateAPIKey issues a key for the tenant. Only its hash is stored, the
+// key itself cannot be shown again.
+func CreateAPIKey(db *sql.DB, tenantID int, name string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := "hk_" + hex.EncodeToString(b)
+	res, err := db.Exec(
+		`INSERT INTO api_keys(tenant_id, name, key_hash)
+		SELECT id, $2, $3 FROM tenants WHERE id=$1`,
+		tenantID, name, hashAPIKey(key))
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", invalidf("Tenant with ID: %d does not exist", tenantID)
+	}
+	return key, nil
+}
+
+func (p *Principal) lookupAPIKey(db *sql.DB, key string) error {
+	return db.QueryRow(
+		"SELECT id, tenant_id FROM api_keys WHERE key_hash=$1 AND revoked_at IS NULL",
+		hashAPIKey(key)).Scan(&p.KeyID, &p.TenantID)
+}
+
+// tenantIDs lists all tenants, for the jobs that run over every one
+func tenantIDs(db *sql.DB) ([]int, error) {
+	rows, err := db.Query("SELECT id FROM tenants ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := []int{}
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// forEachTenant runs a background job on every tenant's database
+func (a *App) forEachTenant(job string, fn func(db *sql.DB)) {
+	ids, err := tenantIDs(a.DB)
+	if err != nil {
+		log.Println(job+":", err)
+		return
+	}
+	for _, id := range ids {
+		db, release, err := a.tenantDB(id)
+		if err != nil {
+			log.Println(job+":", err)
+			continue
+		}
+		fn(db)
+		release()
+	}
+}
+
+// every runs a background job on every tenant once per interval until the
+// process exits. The job returns how many rows it handled, which is logged
+// under name.
+func (a *App) every(interval time.Duration, name string, job func(db *sql.DB) (int, error)) {
+	for {
+		a.forEachTenant(name, func(db *sql.DB) {
+			if n, err := job(db); err != nil {
+				log.Println(name+":", err)
+			} else if n > 0 {
+				log.Printf("%s: %d", name, n)
+			}
+		})
+		time.Sleep(interval)
+	}
+}
+
+// tenantPool is an open tenant connection pool and who is using it
+type tenantPool struct {
+	db       *sql.DB
+	users    int
+	lastUsed time.Time
+}
+
+// tenantDB is the connection pool of a tenant, opened on first use. The
+// tenant is set at connection startup so it cannot be changed or lost
+// between the statements of a request. The pool stays open until release
+// is called; pools left unused for tenantPoolIdleTime are closed.
+func (a *App) tenantDB(id int) (db *sql.DB, release func(), err error) {
+	a.tenantsMu.Lock()
+	defer a.tenantsMu.Unlock()
+
+	a.closeIdleTenants(time.Now())
+	p, ok := a.tenantDBs[id]
+	if !ok {
+		if db, err = openTenantDB(a.connString, id); err != nil {
+			return nil, nil, err
+		}
+		p = &tenantPool{db: db}
+		a.tenantDBs[id] = p
+	}
+	p.users++
+	return p.db, func() {
+		a.tenantsMu.Lock()
+		defer a.tenantsMu.Unlock()
+		p.users--
+		p.lastUsed = time.Now()
+	}, nil
+}
+
+// closeIdleTenants closes the pools nobody used since tenantPoolIdleTime
+// before now. App.DB stays open. Callers hold tenantsMu.
+func (a *App) closeIdleTenants(now time.Time) {
+	for id, p := range a.tenantDBs {
+		if id == FirstTenantID || p.users > 0 || now.Sub(p.lastUsed) < tenantPoolIdleTime {
+			continue
+		}
+		if err := p.db.Close(); err != nil {
+			log.Printf("tenant %d: %v", id, err)
+		}
+		delete(a.tenantDBs, id)
+	}
+}
+
+func openTenantDB(conn string, tenantID int) (*sql.DB, error) {
+	db, err := sql.Open("postgres", tenantConnString(conn, tenantID))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(tenantMaxOpenConns)
+	db.SetMaxIdleConns(tenantMaxIdleConns)
+	db.SetConnMaxIdleTime(tenantConnMaxIdleTime)
+	return db, nil
+}
+
+func tenantConnString(conn string, tenantID int) string {
+	return fmt.Sprintf("%s options='-c app.tenant_id=%d'", conn, tenantID)
+}
+
+// authenticate resolves the API key of the request to its tenant. Requests
+// without a key act as DefaultTenant when it is set.
+func (a *App) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &Principal{}
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch {
+		case key != "":
+			if err := p.lookupAPIKey(a.DB, key); err == sql.ErrNoRows {
+				respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			} else if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		case a.DefaultTenant != 0:
+			p.TenantID = a.DefaultTenant
+		default:
+			respondWithError(w, http.StatusUnauthorized, "API key required")
+			return
+		}
+
+		var release func()
+		var err error
+		if p.DB, release, err = a.tenantDB(p.TenantID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// db is the database of the request's tenant
+func (a *App) db(r *http.Request) *sql.DB {
+	return r.Context().Value(principalKey).(*Principal).DB
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// waitlist entry statuses
+const (
+	WaitlistWaiting   = "waiting"
+	WaitlistOffered   = "offered"
+	WaitlistAccepted  = "accepted"
+	WaitlistExpired   = "expired"
+	WaitlistCancelled = "cancelled"
+)
+
+// WaitlistOfferTTL is how long an offered room is held for the entry
+var WaitlistOfferTTL = 2 * time.Hour
+
+// ErrRoomsAvailable is returned when joining the waitlist for dates that
+// can be booked right away
+var ErrRoomsAvailable = errors.New("Rooms are available for these dates, make a reservation instead")
+
+// ErrOfferExpired is returned when accepting an entry that holds no offer
+var ErrOfferExpired = errors.New("The waitlist entry has no open offer")
+
+// WaitlistEntry queues a request for a sold out room type. When a room
+// frees up, entries are offered it by priority, then in the order they
+// joined; an offer holds the room until OfferExpiresAt.
+type WaitlistEntry struct {
+	ID             int        `json:"id"`
+	Name           string     `json:"name"`
+	Email          string     `json:"email,omitempty"`
+	RoomTypeID     int        `json:"room_type_id"`
+	Arrival        Date       `json:"arrival"`
+	Departure      Date       `json:"departure"`
+	Guests         int        `json:"guests"`
+	Priority       int        `json:"priority"`
+	Status         string     `json:"status"`
+	OfferExpiresAt *time.Time `json:"offer_expires_at,omitempty"`
+	ReservationID  int        `json:"reservation_id,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+const waitlistColumns = `id, name, email, room_type_id, arrival, departure, guests, priority, status,
+	offer_expires_at, COALESCE(reservation_id, 0), created_at`
+
+func (e *WaitlistEntry) scanFields() []interface{} {
+	return []interface{}{&e.ID, &e.Name, &e.Email, &e.RoomTypeID, &e.Arrival, &e.Departure, &e.Guests,
+		&e.Priority, &e.Status, &e.OfferExpiresAt, &e.ReservationID, &e.CreatedAt}
+}
+
+// waitlistOffersOn is the SQL for the rooms of type $1 held by open
+// offers on the night given by the date expression
+func waitlistOffersOn(date string) string {
+	return `(SELECT count(*) FROM waitlist w WHERE w.room_type_id = $1 AND w.status = 'offered'
+		AND w.offer_expires_at > now() AND w.arrival <= ` + date + ` AND w.departure > ` + date + `)`
+}
+
+func (e *WaitlistEntry) getWaitlistEntry(db *sql.DB) error {
+	return db.QueryRow("SELECT "+waitlistColumns+" FROM waitlist WHERE id=$1", e.ID).Scan(e.scanFields()...)
+}
+
+// createWaitlistEntry queues the request if the room type is sold out for
+// some of its nights
+func (e *WaitlistEntry) createWaitlistEntry(db *sql.DB) error {
+	if e.Name == "" {
+		return invalidf("Name is required")
+	}
+	if e.Guests == 0 {
+		e.Guests = 1
+	}
+	t := RoomType{ID: e.RoomTypeID}
+	if err := t.getRoomType(db); err == sql.ErrNoRows {
+		return invalidf("Room type with ID: %d does not exist", e.RoomTypeID)
+	} else if err != nil {
+		return err
+	}
+	if n, err := availableRooms(db, e.RoomTypeID, e.Arrival, e.Departure); err != nil {
+		return err
+	} else if n > 0 {
+		return ErrRoomsAvailable
+	}
+
+	e.Status = WaitlistWaiting
+	return db.QueryRow(
+		`INSERT INTO waitlist(name, email, room_type_id, arrival, departure, guests, priority, status)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		e.Name, e.Email, e.RoomTypeID, e.Arrival, e.Departure, e.Guests, e.Priority,
+		e.Status).Scan(&e.ID, &e.CreatedAt)
+}
+
+// cancelWaitlistEntry takes the entry off the list. A room it was offered
+// goes to the next entry.
+func (e *WaitlistEntry) cancelWaitlistEntry(db *sql.DB) error {
+	res, err := db.Exec("UPDATE waitlist SET status=$1 WHERE id=$2 AND status IN ($3, $4)",
+		WaitlistCancelled, e.ID, WaitlistWaiting, WaitlistOffered)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := e.getWaitlistEntry(db); err != nil {
+		return err
+	}
+	_, err = OfferWaitlist(db, e.RoomTypeID)
+	return err
+}
+
+// acceptOffer books the offered room as a reservation, capturing the
+// deposit like POST /reservation
+func (e *WaitlistEntry) acceptOffer(db *sql.DB, gw PaymentGateway, paymentToken string) (*Reservation, error) {
+	if err := e.getWaitlistEntry(db); err != nil {
+		return nil, err
+	}
+	var open bool
+	err := db.QueryRow("SELECT status=$1 AND offer_expires_at > now() FROM waitlist WHERE id=$2",
+		WaitlistOffered, e.ID).Scan(&open)
+	if err != nil {
+		return nil, err
+	}
+	if !open {
+		return nil, ErrOfferExpired
+	}
+
+	r := &Reservation{
+		Name: e.Name, RoomTypeID: e.RoomTypeID, Arrival: e.Arrival, Departure: e.Departure,
+		Guests: e.Guests, PaymentToken: paymentToken, waitlistID: e.ID,
+	}
+	if err := r.createReservation(db, gw); err != nil {
+		return nil, err
+	}
+	r.PaymentToken = ""
+	return r, e.getWaitlistEntry(db)
+}
+
+// claimOffer accepts the entry's offer within the reservation's
+// transaction, which stops its room from being counted twice
+func claimOffer(tx *sql.Tx, waitlistID int) error {
+	res, err := tx.Exec(
+		"UPDATE waitlist SET status=$1 WHERE id=$2 AND status=$3 AND offer_expires_at > now()",
+		WaitlistAccepted, waitlistID, WaitlistOffered)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrOfferExpired
+	}
+	return nil
+}
+
+// OfferWaitlist offers free rooms of the type to the waiting entries, by
+// priority and then in the order they joined, as long as there are rooms
+// for an entry's dates. It returns how many offers were made.
+func OfferWaitlist(db *sql.DB, typeID int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", typeID); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(
+		`SELECT id, arrival, departure FROM waitlist
+		WHERE room_type_id=$1 AND status=$2 AND departure > $3
+		ORDER BY priority DESC, created_at, id`,
+		typeID, WaitlistWaiting, today())
+	if err != nil {
+		return 0, err
+	}
+	waiting := []WaitlistEntry{}
+	for rows.Next() {
+		var e WaitlistEntry
+		if err := rows.Scan(&e.ID, &e.Arrival, &e.Departure); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		waiting = append(waiting, e)
+	}
+	rows.Close()
+
+	n := 0
+	for _, e := range waiting {
+		// rooms tonight count from today, earlier nights are past
+		arrival := e.Arrival
+		if arrival.Before(today().Time) {
+			arrival = today()
+		}
+		available, err := availableRooms(tx, typeID, arrival, e.Departure)
+		if err != nil {
+			return n, err
+		}
+		if available < 1 {
+			continue
+		}
+		_, err = tx.Exec(
+			"UPDATE waitlist SET status=$1, offer_expires_at=now() + make_interval(secs => $2) WHERE id=$3",
+			WaitlistOffered, WaitlistOfferTTL.Seconds(), e.ID)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, tx.Commit()
+}
+
+// offerFreedRoom runs the waitlist of a room type after one of its rooms
+// was freed. The room is freed either way, so failures are only logged.
+func offerFreedRoom(db *sql.DB, typeID int) {
+	if _, err := OfferWaitlist(db, typeID); err != nil {
+		log.Println("waitlist:", err)
+	}
+}
+
+// ExpireWaitlistOffers marks lapsed offers as expired and offers their
+// rooms to the next entries. It returns how many offers expired.
+func ExpireWaitlistOffers(db *sql.DB) (int, error) {
+	rows, err := db.Query(
+		`UPDATE waitlist SET status=$1 WHERE status=$2 AND offer_expires_at <= now()
+		RETURNING room_type_id`,
+		WaitlistExpired, WaitlistOffered)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	types := map[int]bool{}
+	for rows.Next() {
+		var typeID int
+		if err := rows.Scan(&typeID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		types[typeID] = true
+		n++
+	}
+	rows.Close()
+
+	for typeID := range types {
+		if _, err := OfferWaitlist(db, typeID); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func GetWaitlist(db *sql.DB, typeID int, status string) ([]WaitlistEntry, error) {
+	rows, err := db.Query(
+		"SELECT "+waitlistColumns+` FROM waitlist
+		WHERE ($1 = 0 OR room_type_id = $1) AND ($2 = '' OR status = $2)
+		ORDER BY room_type_id, priority DESC, created_at, id`,
+		typeID, status)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []WaitlistEntry{}
+
+	for rows.Next() {
+		var e WaitlistEntry
+		if err := rows.Scan(e.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// guestWaitlistEntries is the SQL condition for the entries w of guest $1:
+// those that became one of the guest's reservations and those left with
+// the guest's email
+const guestWaitlistEntries = `w.tenant_id = current_tenant() AND (
+	w.reservation_id IN (SELECT r.id FROM reservations r JOIN stays s ON s.id = r.stay_id
+		WHERE s.guest_id = $1)
+	OR w.email <> '' AND w.email = (SELECT g.email FROM guests g WHERE g.id = $1))`
+
+func (g *Guest) getGuestWaitlist(db *sql.DB) ([]WaitlistEntry, error) {
+	rows, err := db.Query(
+		"SELECT "+waitlistColumns+" FROM waitlist w WHERE "+guestWaitlistEntries+" ORDER BY w.id", g.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []WaitlistEntry{}
+
+	for rows.Next() {
+		var e WaitlistEntry
+		if err := rows.Scan(e.scanFields()...); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}